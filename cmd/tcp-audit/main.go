@@ -0,0 +1,43 @@
+// tcp-audit checks the audit log written by the tcp server.
+//
+//	tcp-audit verify audit.log.2 audit.log.1 audit.log
+//
+// Files are checked in the order given, so list the rotated files oldest first.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Oyal2/tcp-server/internal/audit"
+)
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: tcp-audit verify FILE...")
+		os.Exit(2)
+	}
+
+	var verifier audit.Verifier
+	for _, path := range os.Args[2:] {
+		if err := verifyFile(&verifier, path); err != nil {
+			fmt.Fprintf(os.Stderr, "FAILED %v\n", err)
+			var verifyErr *audit.VerifyError
+			if errors.As(err, &verifyErr) {
+				os.Exit(1)
+			}
+			os.Exit(2)
+		}
+	}
+	fmt.Printf("OK %d records, last seq %d, last hash %s\n", verifier.Records, verifier.Seq, verifier.Hash)
+}
+
+func verifyFile(verifier *audit.Verifier, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return verifier.Verify(path, f)
+}
@@ -0,0 +1,133 @@
+// tcp-bench sends requests to a tcp server over a number of connections and
+// reports the throughput, latency percentiles and errors.
+//
+//	tcp-bench -address 127.0.0.1:3000 -connections 50 -requests 10000 -sleep 10
+//	tcp-bench -command "/bin/echo hello" -report v1.2.json
+//
+// By default every request runs the test/helper/printer binary, which has to
+// be built on the server's host first. -command runs something else instead.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Oyal2/tcp-server/internal/bench"
+	"github.com/Oyal2/tcp-server/internal/listener"
+	"github.com/Oyal2/tcp-server/pkg/client"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+func main() {
+	address := flag.String("address", "127.0.0.1:3000", "server address, e.g. tcp://127.0.0.1:3000 or unix:///run/tcp-server.sock")
+	token := flag.String("token", "", "token to send with every request")
+	connections := flag.Int("connections", 10, "number of connections sending requests at once")
+	requests := flag.Int("requests", 1000, "number of requests to send in total")
+	command := flag.String("command", "", "space separated command to run instead of the printer")
+	printer := flag.String("printer", "test/helper/printer/printer", "path of the printer binary on the server's host")
+	sleep := flag.Int("sleep", 0, "milliseconds the printer sleeps for")
+	repeat := flag.Int("repeat", 1, "number of lines the printer prints")
+	timeout := flag.Duration("timeout", 0, "timeout of every task (0 means no timeout)")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	reportFile := flag.String("report", "", "also write the JSON report to this file")
+	flag.Parse()
+
+	if *connections < 1 || *requests < 1 {
+		log.Fatal("-connections and -requests must be at least 1")
+	}
+	spec, err := listener.ParseSpec(*address)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// Keep a connection open per worker and count rate limit rejections rather than retrying them
+	c, err := client.New(client.Params{
+		Network:      spec.Network,
+		Address:      spec.Address,
+		Token:        *token,
+		MaxIdleConns: *connections,
+		Retry:        client.Retry{MaxAttempts: 1},
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	argv := strings.Fields(*command)
+	if len(argv) == 0 {
+		argv = []string{*printer, fmt.Sprintf("-sleep=%d", *sleep), fmt.Sprintf("-repeat=%d", *repeat)}
+	}
+
+	// Ctrl+C stops sending and reports what was done so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report := bench.Run(ctx, bench.Params{
+		Client:      c,
+		Connections: *connections,
+		Requests:    *requests,
+		Request:     model.TaskRequest{Command: argv, Timeout: int(timeout.Milliseconds())},
+	})
+
+	if *reportFile != "" {
+		if err := writeReport(*reportFile, report); err != nil {
+			log.Fatalf("cannot write report: %s", err)
+		}
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return
+	}
+	printReport(os.Stdout, report)
+}
+
+func writeReport(path string, report *bench.Report) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+func printReport(out io.Writer, report *bench.Report) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "command:\t%s\n", strings.Join(report.Command, " "))
+	fmt.Fprintf(w, "connections:\t%d\n", report.Connections)
+	fmt.Fprintf(w, "requests:\t%d (%d succeeded, %d failed)\n", report.Requests, report.Succeeded, report.Failed)
+	fmt.Fprintf(w, "duration:\t%.0fms\n", report.DurationMs)
+	fmt.Fprintf(w, "throughput:\t%.1f requests/s\n", report.Throughput)
+	l := report.Latency
+	fmt.Fprintf(w, "latency:\tmin %.2fms, mean %.2fms, p50 %.2fms, p90 %.2fms, p95 %.2fms, p99 %.2fms, max %.2fms\n",
+		l.Min, l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max)
+	fmt.Fprintf(w, "rate limited:\t%d\n", report.RateLimited)
+
+	// Most common errors first
+	types := make([]string, 0, len(report.Errors))
+	for t := range report.Errors {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if report.Errors[types[i]] != report.Errors[types[j]] {
+			return report.Errors[types[i]] > report.Errors[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	for i, t := range types {
+		label := ""
+		if i == 0 {
+			label = "errors:"
+		}
+		fmt.Fprintf(w, "%s\t%s: %d\n", label, t, report.Errors[t])
+	}
+}
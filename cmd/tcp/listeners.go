@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/Oyal2/tcp-server/internal/listener"
+	"github.com/Oyal2/tcp-server/internal/systemd"
+	"github.com/Oyal2/tcp-server/internal/upgrade"
+)
+
+// openListeners opens a listener for every spec, reusing the ones handed down
+// by a previous process where the spec matches. Inherited listeners we no
+// longer need are closed. Listeners from systemd socket activation replace the
+// specs entirely, since the socket units decide what we listen on.
+func openListeners(specs []string, inherited map[string]net.Listener) ([]upgrade.Listener, error) {
+	var activated []string
+	for spec := range inherited {
+		if strings.HasPrefix(spec, systemd.SpecPrefix) {
+			activated = append(activated, spec)
+		}
+	}
+	if len(activated) > 0 {
+		sort.Strings(activated)
+		specs = activated
+	}
+
+	listeners := make([]upgrade.Listener, 0, len(specs))
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, l := range inherited {
+			l.Close()
+		}
+	}
+
+	for _, s := range specs {
+		if l, ok := inherited[s]; ok {
+			delete(inherited, s)
+			listeners = append(listeners, upgrade.Listener{Spec: s, Listener: l})
+			continue
+		}
+
+		spec, err := listener.ParseSpec(s)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		l, err := listener.Listen(spec)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("error listening on %s: %w", spec, err)
+		}
+		listeners = append(listeners, upgrade.Listener{Spec: s, Listener: l})
+	}
+
+	// Anything left over was removed from the config
+	for _, l := range inherited {
+		l.Close()
+	}
+	return listeners, nil
+}
+
+// openSideListener opens the tcp listener of one of the HTTP servers that run
+// next to the task listeners (e.g. metrics), reusing the one from the previous
+// process if we are an upgrade. It has to be taken out of inherited before
+// openListeners closes the leftovers.
+func openSideListener(inherited map[string]net.Listener, name, address string) (upgrade.Listener, error) {
+	spec := name + ":" + address
+	if l, ok := inherited[spec]; ok {
+		delete(inherited, spec)
+		return upgrade.Listener{Spec: spec, Listener: l}, nil
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return upgrade.Listener{}, fmt.Errorf("error listening on %s: %w", address, err)
+	}
+	return upgrade.Listener{Spec: spec, Listener: l}, nil
+}
@@ -2,51 +2,348 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"sync"
 	"syscall"
 
+	"github.com/Oyal2/tcp-server/internal/admin"
+	"github.com/Oyal2/tcp-server/internal/audit"
+	"github.com/Oyal2/tcp-server/internal/config"
 	"github.com/Oyal2/tcp-server/internal/constant"
 	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/internal/systemd"
+	"github.com/Oyal2/tcp-server/internal/upgrade"
 	"github.com/Oyal2/tcp-server/pkg/executor"
 	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+	"google.golang.org/grpc"
 )
 
 func main() {
-	// Create a signal chan to gracefully shutdown
+	// Load the configuration from the config file, env and flags
+	cfg, err := config.Load(os.Args[0], os.Args[1:], os.Environ(), os.Stderr)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatal(err.Error())
+	}
+	logLevel := &slog.LevelVar{}
+	logLevel.Set(parseLevel(cfg.Log.Level))
+	logger := newLogger(cfg.Log, logLevel)
+	slog.SetDefault(logger)
+	// Send trace spans to the configured exporter
+	stopTracing, err := startTracing(cfg.Tracing)
+	if err != nil {
+		log.Fatalf("cannot start tracing: %s", err)
+	}
+	defer stopTracing()
+	// Talk to systemd if it started us, this is a no-op otherwise
+	notifier := systemd.NewNotifierFromEnv()
+
+	// Create signal chans to gracefully shutdown, reload the config and upgrade the binary
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	usr2 := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(usr2, upgradeSignals...)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Create an Executor
-	executor := executor.NewCommandExecutor()
+	executor := executor.NewCommandExecutorWithParams(executor.CommandExecutorParams{
+		MaxConcurrent: cfg.Executor.MaxConcurrent,
+		Logger:        logger,
+		RunAs:         cfg.Executor.RunAs,
+		AllowRoot:     cfg.Executor.AllowRoot,
+	})
 	// Create a ratelimiter
-	rateLimiter, err := ratelimit.NewIPRateLimiter(constant.DefaultRateLimit, constant.DefaultRateInterval)
+	rateLimiter, err := newRateLimiter(cfg.RateLimit)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	// Open the audit log before we accept any task
+	var auditSink audit.Sink
+	if cfg.Audit.File != "" {
+		auditLog, err := audit.NewLog(audit.LogParams{
+			Path:       cfg.Audit.File,
+			MaxSize:    int64(cfg.Audit.MaxSizeMB) << 20,
+			MaxBackups: cfg.Audit.MaxBackups,
+		})
+		if err != nil {
+			log.Fatalf("cannot open audit log: %s", err)
+		}
+		defer auditLog.Close()
+		auditSink = auditLog
+	}
+	// Open the listeners, taking over the ones from the previous process if we are an upgrade
+	// or the ones systemd passed us if we are socket activated
+	inherited, err := upgrade.Inherited()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	activated, err := systemd.Listeners()
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	maps.Copy(inherited, activated)
+	// The HTTP side servers are handed over on upgrades too
+	var sideListeners []upgrade.Listener
+	var sideServers []*http.Server
+	closeSideServers := func() {
+		for _, srv := range sideServers {
+			srv.Close()
+		}
+		sideServers = nil
+	}
+	defer closeSideServers()
+	if cfg.Metrics.Listen != "" {
+		l, err := openSideListener(inherited, "metrics", cfg.Metrics.Listen)
+		if err != nil {
+			log.Fatalf("cannot start metrics server: %s", err)
+		}
+		sideListeners = append(sideListeners, l)
+		sideServers = append(sideServers, startMetricsServer(l))
+	}
+	var adminListener net.Listener
+	if cfg.Admin.Listen != "" {
+		l, err := openSideListener(inherited, "admin", cfg.Admin.Listen)
+		if err != nil {
+			log.Fatalf("cannot start admin server: %s", err)
+		}
+		sideListeners = append(sideListeners, l)
+		adminListener = l
+	}
+	var gatewayListener net.Listener
+	if cfg.HTTP.Listen != "" {
+		l, err := openSideListener(inherited, "http", cfg.HTTP.Listen)
+		if err != nil {
+			log.Fatalf("cannot start http gateway: %s", err)
+		}
+		sideListeners = append(sideListeners, l)
+		gatewayListener = l
+	}
+	var webSocketListener net.Listener
+	if cfg.WebSocket.Listen != "" {
+		l, err := openSideListener(inherited, "websocket", cfg.WebSocket.Listen)
+		if err != nil {
+			log.Fatalf("cannot start websocket server: %s", err)
+		}
+		sideListeners = append(sideListeners, l)
+		webSocketListener = l
+	}
+	var grpcListener net.Listener
+	if cfg.GRPC.Listen != "" {
+		l, err := openSideListener(inherited, "grpc", cfg.GRPC.Listen)
+		if err != nil {
+			log.Fatalf("cannot start grpc server: %s", err)
+		}
+		sideListeners = append(sideListeners, l)
+		grpcListener = l
+	}
+	listeners, err := openListeners(cfg.Listen, inherited)
+	if err != nil {
+		log.Fatalf("cannot create server: %s", err)
+	}
+	netListeners := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		netListeners = append(netListeners, l.Listener)
+	}
+	// Serve the task connections over TLS when there is a certificate
+	var certificate *tls.Certificate
+	if cfg.TLS.CertFile != "" {
+		certificate, err = server.LoadCertificate(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			log.Fatalf("cannot load tls certificate: %s", err)
+		}
+	}
 	// Create a tcp server
 	params := server.TCPServerParams{
-		Port:         3000,
-		ReadTimeout:  constant.DefaultReadTimeout,
-		WriteTimeout: constant.DefaultWriteTimeout,
-		Executor:     executor,
-		WaitGroup:    &sync.WaitGroup{},
-		RateLimiter:  rateLimiter,
-	}
-	server, err := server.NewTCPServer(params)
+		Listeners:       netListeners,
+		ReadTimeout:     cfg.ReadTimeout,
+		WriteTimeout:    cfg.WriteTimeout,
+		MaxFrameSize:    cfg.MaxFrameSize,
+		DrainTimeout:    cfg.Shutdown.DrainTimeout,
+		Executor:        executor,
+		WaitGroup:       &sync.WaitGroup{},
+		RateLimiter:     rateLimiter,
+		Tokens:          cfg.Auth.Tokens,
+		RunAs:           cfg.Policy.RunAs,
+		Logger:          logger,
+		Audit:           auditSink,
+		AuditFailClosed: cfg.Audit.FailClosed,
+		Certificate:     certificate,
+	}
+	tcpServer, err := server.NewTCPServer(params)
 	if err != nil {
 		log.Fatalf("cannot create server: %s", err)
 	}
 
+	reloader := &reloader{
+		args:     os.Args[1:],
+		cfg:      cfg,
+		server:   tcpServer,
+		logLevel: logLevel,
+	}
+	reload := func() error {
+		notify(notifier, systemd.Reloading)
+		defer notify(notifier, systemd.Ready)
+		return reloader.Reload()
+	}
+
+	// Serve the health checks and admin endpoints
+	if adminListener != nil {
+		handler := admin.NewHandler(admin.HandlerParams{
+			Server:    tcpServer,
+			Queue:     executor,
+			MaxQueued: cfg.Admin.ReadyMaxQueued,
+			Token:     cfg.Admin.Token,
+			Reload:    reload,
+			Logger:    logger,
+		})
+		sideServers = append(sideServers, startHTTPServer("admin", adminListener, handler))
+	}
+
+	// Serve the task requests over HTTP too. Unlike the other side servers it
+	// is drained along with the server rather than closed on upgrades.
+	var gateway *http.Server
+	if gatewayListener != nil {
+		gateway = startHTTPServer("http gateway", gatewayListener, tcpServer.HTTPHandler())
+		defer gateway.Close()
+	}
+
+	// WebSockets are handed to the server as connections, so they are drained with it
+	var webSocketServer *server.WebSocketServer
+	if webSocketListener != nil {
+		webSocketServer, err = server.NewWebSocketServer(server.WebSocketServerParams{
+			Listener:       webSocketListener,
+			Server:         tcpServer,
+			OriginPatterns: cfg.WebSocket.Origins,
+		})
+		if err != nil {
+			log.Fatalf("cannot start websocket server: %s", err)
+		}
+		go func() {
+			if err := webSocketServer.Start(ctx); err != nil {
+				slog.Error("websocket server stopped", "error", err)
+			}
+		}()
+	}
+
+	// The gRPC calls are drained with the server too
+	var grpcServer *grpc.Server
+	if grpcListener != nil {
+		grpcServer = grpc.NewServer()
+		tcpServer.RegisterGRPC(grpcServer)
+		defer grpcServer.Stop()
+		go func() {
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				slog.Error("grpc server stopped", "error", err)
+			}
+		}()
+		slog.Info("serving grpc", "address", grpcListener.Addr().String())
+	}
+
 	// Run the server
-	go server.Start(ctx)
+	go tcpServer.Start(ctx)
+	// Let the previous process know it can stop accepting and drain
+	if err := upgrade.Ready(); err != nil {
+		slog.Error("cannot notify the previous process that we are ready", "error", err)
+	}
+	notify(notifier, systemd.Ready, systemd.Status("accepting connections"))
+	go notifier.RunWatchdog(ctx, func(err error) {
+		slog.Warn("cannot ping the systemd watchdog", "error", err)
+	})
 
-	// Watch for Ctrl+C cancel
-	<-sig
-	// Clean up
+	// Reload on SIGHUP and upgrade on SIGUSR2 until we get Ctrl+C
+	for running := true; running; {
+		select {
+		case <-hup:
+			slog.Info("received SIGHUP, reloading config")
+			_ = reload()
+		case <-usr2:
+			// Hand the listeners to a new copy of the binary, then drain like a normal shutdown
+			slog.Info("received SIGUSR2, starting upgrade")
+			process, err := upgrade.Upgrade(slices.Concat(listeners, sideListeners), notifier.Env(), constant.DefaultUpgradeTimeout)
+			if err != nil {
+				slog.Error("upgrade failed, continuing to serve", "error", err)
+				continue
+			}
+			slog.Info("new process is accepting connections", "pid", process.Pid)
+			// Leave the metrics and health checks to the new process while we drain
+			closeSideServers()
+			// The new process takes over as the main process of the service
+			notify(notifier, systemd.MainPID(process.Pid))
+			running = false
+		case <-sig:
+			running = false
+		}
+	}
+
+	// Drain the in-flight tasks before we exit. A second Ctrl+C kills them straight away.
+	notify(notifier, systemd.Stopping)
+	drainTimeout := tcpServer.DrainTimeout()
+	slog.Info("shutting down, draining in-flight tasks", "drain_timeout", drainTimeout)
+	drainCtx, forceStop := context.WithCancel(context.Background())
+	defer forceStop()
+	if drainTimeout > 0 {
+		var cancelDrain context.CancelFunc
+		drainCtx, cancelDrain = context.WithTimeout(drainCtx, drainTimeout)
+		defer cancelDrain()
+	}
+	go func() {
+		<-sig
+		slog.Warn("received second signal, killing in-flight tasks")
+		forceStop()
+	}()
+	if gateway != nil {
+		go gateway.Shutdown(drainCtx)
+	}
+	if webSocketServer != nil {
+		webSocketServer.Stop()
+	}
+	if grpcServer != nil {
+		go grpcServer.GracefulStop()
+	}
+	if err := tcpServer.Shutdown(drainCtx); err != nil {
+		slog.Warn("shutdown did not finish draining", "error", err)
+	}
 	cancel()
-	server.Stop()
+}
+
+func notify(notifier *systemd.Notifier, states ...string) {
+	if err := notifier.Notify(states...); err != nil {
+		slog.Warn("cannot notify systemd", "error", err)
+	}
+}
+
+func newRateLimiter(cfg config.RateLimitConfig) (ratelimit.RateLimiter, error) {
+	switch cfg.Type {
+	case config.RateLimiterNone:
+		return ratelimit.NewNoopRateLimiter(), nil
+	case config.RateLimiterIP:
+		return ratelimit.NewIPRateLimiter(cfg.Limit, cfg.Interval)
+	default:
+		return nil, fmt.Errorf("unknown rate limiter %q", cfg.Type)
+	}
+}
+
+func newLogger(cfg config.LogConfig, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == config.LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
 }
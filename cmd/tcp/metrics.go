@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// startMetricsServer serves the Prometheus metrics on /metrics until the returned server is closed
+func startMetricsServer(l net.Listener) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return startHTTPServer("metrics", l, mux)
+}
+
+// startHTTPServer serves handler on l in the background until the returned server is closed
+func startHTTPServer(name string, l net.Listener, handler http.Handler) *http.Server {
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(name+" server stopped", "error", err)
+		}
+	}()
+	slog.Info("serving "+name, "address", l.Addr().String())
+	return srv
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Oyal2/tcp-server/internal/config"
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+)
+
+// reloader re-reads the configuration and applies what can be changed without
+// restarting the process
+type reloader struct {
+	mu       sync.Mutex
+	args     []string
+	cfg      *config.Config
+	server   *server.TCPServer
+	logLevel *slog.LevelVar
+}
+
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Load the config the same way we did on start up. If anything is invalid we keep running with the old config.
+	cfg, err := config.Load(os.Args[0], r.args, os.Environ(), os.Stderr)
+	if err != nil {
+		slog.Error("config reload failed, keeping the current config", "error", err)
+		return err
+	}
+
+	// Read the certificate again even if the paths are the same, renewals
+	// usually replace the files in place
+	var certificate *tls.Certificate
+	if cfg.TLS.CertFile != "" {
+		certificate, err = server.LoadCertificate(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			slog.Error("config reload failed, keeping the current config", "error", err)
+			return err
+		}
+	}
+
+	// Keep the counts of the current limiter if only its parameters changed
+	rateLimiter := r.server.RateLimiter()
+	if cfg.RateLimit != r.cfg.RateLimit {
+		ipRateLimiter, ok := rateLimiter.(*ratelimit.IPRateLimiter)
+		if ok && cfg.RateLimit.Type == config.RateLimiterIP {
+			err = ipRateLimiter.Update(cfg.RateLimit.Limit, cfg.RateLimit.Interval)
+		} else {
+			rateLimiter, err = newRateLimiter(cfg.RateLimit)
+		}
+		if err != nil {
+			slog.Error("config reload failed, keeping the current config", "error", err)
+			return err
+		}
+	}
+
+	r.server.Reconfigure(server.TCPServerSettings{
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		MaxFrameSize: cfg.MaxFrameSize,
+		DrainTimeout: cfg.Shutdown.DrainTimeout,
+		RateLimiter:  rateLimiter,
+		Tokens:       cfg.Auth.Tokens,
+		RunAs:        cfg.Policy.RunAs,
+		Certificate:  certificate,
+	})
+	r.logLevel.Set(parseLevel(cfg.Log.Level))
+
+	// Some settings are bound to resources we created on start up
+	if !slices.Equal(cfg.Listen, r.cfg.Listen) {
+		slog.Warn("listen changed, restart the server to apply it", "key", "listen")
+	}
+	if cfg.Executor != r.cfg.Executor {
+		slog.Warn("executor settings changed, restart the server to apply them", "key", "executor")
+	}
+	if cfg.Metrics != r.cfg.Metrics {
+		slog.Warn("metrics settings changed, restart the server to apply them", "key", "metrics")
+	}
+	if cfg.Admin != r.cfg.Admin {
+		slog.Warn("admin settings changed, restart the server to apply them", "key", "admin")
+	}
+	if cfg.HTTP != r.cfg.HTTP {
+		slog.Warn("http settings changed, restart the server to apply them", "key", "http")
+	}
+	if cfg.WebSocket.Listen != r.cfg.WebSocket.Listen || !slices.Equal(cfg.WebSocket.Origins, r.cfg.WebSocket.Origins) {
+		slog.Warn("websocket settings changed, restart the server to apply them", "key", "websocket")
+	}
+	if cfg.GRPC != r.cfg.GRPC {
+		slog.Warn("grpc settings changed, restart the server to apply them", "key", "grpc")
+	}
+	if cfg.Audit != r.cfg.Audit {
+		slog.Warn("audit settings changed, restart the server to apply them", "key", "audit")
+	}
+	if cfg.Tracing != r.cfg.Tracing {
+		slog.Warn("tracing settings changed, restart the server to apply them", "key", "tracing")
+	}
+	if (cfg.TLS.CertFile == "") != (r.cfg.TLS.CertFile == "") {
+		slog.Warn("tls turned on or off, restart the server to apply it", "key", "tls")
+	}
+	if cfg.Log.Format != r.cfg.Log.Format {
+		slog.Warn("log format changed, restart the server to apply it", "key", "log.format")
+	}
+
+	r.cfg = cfg
+	slog.Info("config reloaded")
+	return nil
+}
+
+func parseLevel(level string) slog.Level {
+	var l slog.Level
+	// The level has already been validated by the config loader
+	_ = l.UnmarshalText([]byte(strings.ToLower(level)))
+	return l
+}
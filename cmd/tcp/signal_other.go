@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// upgradeSignals is empty where we can't pass listeners to a new process
+var upgradeSignals []os.Signal
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/config"
+	"github.com/Oyal2/tcp-server/internal/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// startTracing installs the global tracer provider for the configured exporter.
+// The returned func flushes the buffered spans and should be called on exit.
+func startTracing(cfg config.TracingConfig) (func(), error) {
+	exporter, err := newTraceExporter(cfg)
+	if err != nil || exporter == nil {
+		return func() {}, err
+	}
+	provider := tracing.NewProvider(exporter)
+	otel.SetTracerProvider(provider)
+	slog.Info("exporting traces", "exporter", cfg.Exporter)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Warn("cannot flush traces", "error", err)
+		}
+	}, nil
+}
+
+func newTraceExporter(cfg config.TracingConfig) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case config.TracingExporterNone:
+		return nil, nil
+	case config.TracingExporterOTLP:
+		return tracing.NewOTLPExporter(context.Background(), cfg.Endpoint)
+	case config.TracingExporterFile:
+		return tracing.NewFileExporter(cfg.File)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+}
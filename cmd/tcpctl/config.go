@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Oyal2/tcp-server/internal/listener"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	envConfigFile = "TCPCTL_CONFIG"
+	envAddress    = "TCPCTL_ADDRESS"
+	envToken      = "TCPCTL_TOKEN"
+
+	defaultAddress = "127.0.0.1:3000"
+)
+
+// ctlConfig says which server to talk to and how
+type ctlConfig struct {
+	// Address is a listener spec such as tcp://127.0.0.1:3000 or unix:///run/tcp-server.sock
+	Address string `json:"address" yaml:"address" toml:"address"`
+	Token   string `json:"token" yaml:"token" toml:"token"`
+}
+
+// loadConfig reads the config file and the environment. An explicitly named
+// file has to exist, the default one is skipped when it doesn't.
+func loadConfig(path string, environ []string) (*ctlConfig, error) {
+	cfg := &ctlConfig{Address: defaultAddress}
+	env := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+
+	// Apply the config file
+	required := true
+	if path == "" {
+		path = env[envConfigFile]
+	}
+	if path == "" {
+		required = false
+		path = defaultConfigPath()
+	}
+	if path != "" {
+		err := applyConfigFile(cfg, path)
+		if err != nil && (required || !errors.Is(err, fs.ErrNotExist)) {
+			return nil, err
+		}
+	}
+
+	// Apply the environment
+	if v, ok := env[envAddress]; ok {
+		cfg.Address = v
+	}
+	if v, ok := env[envToken]; ok {
+		cfg.Token = v
+	}
+	return cfg, nil
+}
+
+// defaultConfigPath is tcpctl/config.yaml in the user's config directory, e.g. ~/.config
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "tcpctl", "config.yaml")
+}
+
+func applyConfigFile(cfg *ctlConfig, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, cfg)
+	case ".json":
+		err = json.Unmarshal(b, cfg)
+	case ".toml":
+		_, err = toml.Decode(string(b), cfg)
+	default:
+		return fmt.Errorf("unsupported config file extension %q (use .yaml, .yml, .toml or .json)", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// dialAddress turns the configured address into the network and address to dial
+func dialAddress(address string) (string, string, error) {
+	spec, err := listener.ParseSpec(address)
+	if err != nil {
+		return "", "", err
+	}
+	return spec.Network, spec.Address, nil
+}
@@ -0,0 +1,276 @@
+// tcpctl runs tasks on a tcp server from the command line.
+//
+//	tcpctl run --timeout 5s -- /usr/bin/make test
+//	tcpctl submit -- /usr/bin/make release
+//	tcpctl status JOB_ID
+//	tcpctl cancel JOB_ID
+//	tcpctl jobs
+//
+// run prints the task's output as it is written and exits with the task's
+// exit code, 124 if it timed out and 125 if it couldn't be run. Interrupting
+// it kills the task on the server and exits with 130. The other
+// commands exit with 1 on errors. The server address and token are read from
+// the config file, the TCPCTL_* env vars and the flags, in that order.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Oyal2/tcp-server/pkg/client"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// Exit codes of our own, the rest are the task's
+const (
+	exitFailure     = 1
+	exitUsage       = 2
+	exitTimeout     = 124
+	exitError       = 125
+	exitInterrupted = 130
+)
+
+const usage = `usage: tcpctl COMMAND [flags] [--] [ARGS]
+
+Commands:
+  run [--timeout D] -- CMD [ARGS...]     run a task, printing its output as it comes
+  submit [--timeout D] -- CMD [ARGS...]  start a task in the background and print its job id
+  status JOB_ID                          show a job, with its output once it is done
+  cancel JOB_ID                          kill a running job
+  jobs                                   list your jobs
+
+Run "tcpctl COMMAND -h" for the flags of a command.
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Environ(), os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// ctl runs a single command with its output going to stdout and stderr
+type ctl struct {
+	client *client.Client
+	json   bool
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func run(ctx context.Context, args []string, environ []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	name, args := args[0], args[1:]
+
+	// Every command takes the connection flags
+	fs := flag.NewFlagSet("tcpctl "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configFile := fs.String("config", "", "path to a YAML, TOML or JSON config file (env "+envConfigFile+")")
+	address := fs.String("address", "", "server address, e.g. tcp://127.0.0.1:3000 or unix:///run/tcp-server.sock (env "+envAddress+")")
+	token := fs.String("token", "", "token to send with every request (env "+envToken+")")
+	asJSON := fs.Bool("json", false, "print the server's responses as JSON")
+	var timeout *time.Duration
+	switch name {
+	case "run", "submit":
+		timeout = fs.Duration("timeout", 0, "kill the task after this long (0 means no timeout)")
+	case "status", "cancel", "jobs":
+	default:
+		fmt.Fprintf(stderr, "tcpctl: unknown command %q\n\n%s", name, usage)
+		return exitUsage
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return exitUsage
+	}
+
+	cfg, err := loadConfig(*configFile, environ)
+	if err != nil {
+		fmt.Fprintf(stderr, "tcpctl: %v\n", err)
+		return exitUsage
+	}
+	if *address != "" {
+		cfg.Address = *address
+	}
+	if *token != "" {
+		cfg.Token = *token
+	}
+	network, addr, err := dialAddress(cfg.Address)
+	if err != nil {
+		fmt.Fprintf(stderr, "tcpctl: %v\n", err)
+		return exitUsage
+	}
+	c, err := client.New(client.Params{Network: network, Address: addr, Token: cfg.Token, MaxIdleConns: -1})
+	if err != nil {
+		fmt.Fprintf(stderr, "tcpctl: %v\n", err)
+		return exitUsage
+	}
+	defer c.Close()
+	tc := &ctl{client: c, json: *asJSON, stdout: stdout, stderr: stderr}
+
+	switch name {
+	case "run", "submit":
+		if fs.NArg() == 0 {
+			fmt.Fprintf(stderr, "tcpctl %s: missing the command to run\n", name)
+			return exitUsage
+		}
+		request := model.TaskRequest{Command: fs.Args(), Timeout: int(timeout.Milliseconds())}
+		if name == "run" {
+			return tc.run(ctx, request)
+		}
+		return tc.submit(ctx, request)
+	case "jobs":
+		return tc.jobs(ctx)
+	default:
+		if fs.NArg() != 1 {
+			fmt.Fprintf(stderr, "tcpctl %s: expected a single job id\n", name)
+			return exitUsage
+		}
+		if name == "cancel" {
+			return tc.cancel(ctx, fs.Arg(0))
+		}
+		return tc.status(ctx, fs.Arg(0))
+	}
+}
+
+func (c *ctl) run(ctx context.Context, request model.TaskRequest) int {
+	// The output is gathered into the result when it is printed as JSON
+	var output []byte
+	result, err := c.client.StreamKillable(ctx, request, func(stream string, data []byte) {
+		switch {
+		case c.json:
+			output = append(output, data...)
+		case stream == model.StreamStderr:
+			c.stderr.Write(data)
+		default:
+			c.stdout.Write(data)
+		}
+	})
+	result.Output = output
+
+	// Print the result whenever the server sent one
+	var exitErr *client.ExitError
+	var serverErr *client.Error
+	if c.json && (err == nil || errors.As(err, &exitErr) || errors.As(err, &serverErr)) {
+		c.printJSON(result)
+	}
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode
+	case errors.Is(err, client.ErrKilled) && ctx.Err() != nil:
+		fmt.Fprintln(c.stderr, "tcpctl: task killed")
+		return exitInterrupted
+	case errors.Is(err, client.ErrTimeout):
+		fmt.Fprintln(c.stderr, "tcpctl: task timed out")
+		return exitTimeout
+	default:
+		fmt.Fprintf(c.stderr, "tcpctl: %v\n", err)
+		return exitError
+	}
+}
+
+func (c *ctl) submit(ctx context.Context, request model.TaskRequest) int {
+	job, err := c.client.Submit(ctx, request)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		c.printJSON(job)
+	} else {
+		fmt.Fprintln(c.stdout, job.JobID)
+	}
+	return 0
+}
+
+func (c *ctl) status(ctx context.Context, jobID string) int {
+	job, err := c.client.Status(ctx, jobID)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		c.printJSON(job)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "job:\t%s\n", job.JobID)
+	fmt.Fprintf(w, "state:\t%s\n", job.State)
+	fmt.Fprintf(w, "command:\t%s\n", strings.Join(job.Command, " "))
+	fmt.Fprintf(w, "submitted:\t%s\n", time.Unix(job.SubmittedAt, 0).Format(time.RFC3339))
+	if job.Result != nil {
+		fmt.Fprintf(w, "exit code:\t%d\n", job.Result.ExitCode)
+		if job.Result.Error != "" {
+			fmt.Fprintf(w, "error:\t%s\n", job.Result.Error)
+		}
+	}
+	w.Flush()
+	if job.Result != nil && len(job.Result.Output) > 0 {
+		fmt.Fprintf(c.stdout, "\n%s", job.Result.Output)
+	}
+	return 0
+}
+
+func (c *ctl) cancel(ctx context.Context, jobID string) int {
+	job, err := c.client.Cancel(ctx, jobID)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		c.printJSON(job)
+	} else if job.State == model.JobDone {
+		fmt.Fprintf(c.stdout, "job %s had already finished\n", jobID)
+	} else {
+		fmt.Fprintf(c.stdout, "cancelled job %s\n", jobID)
+	}
+	return 0
+}
+
+func (c *ctl) jobs(ctx context.Context) int {
+	jobs, err := c.client.Jobs(ctx)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		c.printJSON(jobs)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tSTATE\tEXIT\tSUBMITTED\tCOMMAND")
+	for _, job := range jobs {
+		exitCode := "-"
+		if job.Result != nil {
+			exitCode = fmt.Sprint(job.Result.ExitCode)
+		}
+		submitted := time.Unix(job.SubmittedAt, 0).Format(time.RFC3339)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", job.JobID, job.State, exitCode, submitted, strings.Join(job.Command, " "))
+	}
+	w.Flush()
+	return 0
+}
+
+func (c *ctl) fail(err error) int {
+	fmt.Fprintf(c.stderr, "tcpctl: %v\n", err)
+	return exitFailure
+}
+
+func (c *ctl) printJSON(v any) {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
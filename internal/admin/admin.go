@@ -0,0 +1,161 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+)
+
+// Queue reports how many tasks are waiting for a free slot
+type Queue interface {
+	Queued() int
+}
+
+type HandlerParams struct {
+	Server *server.TCPServer
+	// Queue is checked by /readyz against MaxQueued, nil skips the check
+	Queue Queue
+	// MaxQueued fails /readyz once more tasks than this are waiting, 0 turns the check off
+	MaxQueued int
+	// Token has to be sent as a bearer token to use the /admin endpoints, empty disables them
+	Token string
+	// Reload reloads the configuration, nil disables /admin/reload
+	Reload func() error
+	Logger *slog.Logger
+}
+
+type handler struct {
+	params HandlerParams
+	logger *slog.Logger
+}
+
+// NewHandler serves the health checks, which anyone can call, and the admin
+// endpoints, which need the token
+func NewHandler(params HandlerParams) http.Handler {
+	h := &handler{params: params, logger: params.Logger}
+	if h.logger == nil {
+		h.logger = slog.Default()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", h.healthz)
+	mux.HandleFunc("GET /readyz", h.readyz)
+	mux.Handle("GET /admin/connections", h.authorized(h.connections))
+	mux.Handle("GET /admin/tasks", h.authorized(h.tasks))
+	mux.Handle("POST /admin/tasks/{id}/kill", h.authorized(h.killTask))
+	mux.Handle("DELETE /admin/ratelimit/{client}", h.authorized(h.resetRateLimit))
+	mux.Handle("POST /admin/ratelimit/clean", h.authorized(h.cleanRateLimit))
+	mux.Handle("POST /admin/reload", h.authorized(h.reload))
+	return mux
+}
+
+func (h *handler) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *handler) readyz(w http.ResponseWriter, r *http.Request) {
+	if err := h.ready(); err != nil {
+		http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+func (h *handler) ready() error {
+	if err := h.params.Server.Ready(); err != nil {
+		return err
+	}
+	if h.params.Queue != nil && h.params.MaxQueued > 0 {
+		if queued := h.params.Queue.Queued(); queued > h.params.MaxQueued {
+			return fmt.Errorf("%d tasks queued, more than %d", queued, h.params.MaxQueued)
+		}
+	}
+	return nil
+}
+
+// authorized only lets requests with the admin token through
+func (h *handler) authorized(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.params.Token == "" {
+			writeError(w, http.StatusForbidden, "admin endpoints are disabled, set admin.token to use them")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.params.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (h *handler) connections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.params.Server.Connections())
+}
+
+func (h *handler) tasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.params.Server.Tasks())
+}
+
+func (h *handler) killTask(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !h.params.Server.KillTask(id) {
+		writeError(w, http.StatusNotFound, "no running task with request id "+id)
+		return
+	}
+	h.logger.Info("admin killed task", "request_id", id, "admin", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) resetRateLimit(w http.ResponseWriter, r *http.Request) {
+	client := r.PathValue("client")
+	resetter, ok := h.params.Server.RateLimiter().(ratelimit.Resetter)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "the rate limiter can't reset clients")
+		return
+	}
+	if !resetter.Reset(client) {
+		writeError(w, http.StatusNotFound, "client "+client+" is not rate limited")
+		return
+	}
+	h.logger.Info("admin reset rate limit", "client", client, "admin", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) cleanRateLimit(w http.ResponseWriter, r *http.Request) {
+	if rateLimiter := h.params.Server.RateLimiter(); rateLimiter != nil {
+		rateLimiter.Clean()
+	}
+	h.logger.Info("admin cleaned rate limiter", "admin", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) reload(w http.ResponseWriter, r *http.Request) {
+	if h.params.Reload == nil {
+		writeError(w, http.StatusNotImplemented, "reloading is not supported")
+		return
+	}
+	h.logger.Info("admin requested a config reload", "admin", r.RemoteAddr)
+	if err := h.params.Reload(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
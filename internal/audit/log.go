@@ -0,0 +1,254 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Sink receives the audit records of the tasks we run
+type Sink interface {
+	Write(record *Record) error
+}
+
+// Log appends hash chained records to a file as JSON lines and rotates it once
+// it gets too big. The chain carries on into the new file, so the rotated
+// files can be verified together.
+//
+// Several processes can share the same file, e.g. while one hands over to
+// another during an upgrade. Each write takes a lock on the file and picks up
+// the chain from whatever was written last.
+type Log struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	// size, seq and lastHash describe the file as we last left it
+	size     int64
+	seq      uint64
+	lastHash string
+}
+
+type LogParams struct {
+	Path string
+	// MaxSize is the size in bytes after which the file is rotated, 0 never rotates
+	MaxSize int64
+	// MaxBackups is how many rotated files to keep, 0 keeps them all
+	MaxBackups int
+}
+
+func NewLog(params LogParams) (*Log, error) {
+	l := &Log{
+		path:       params.Path,
+		maxSize:    params.MaxSize,
+		maxBackups: params.MaxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write chains the record to the previous one and appends it to the file. The
+// record is on disk when Write returns.
+func (l *Log) Write(record *Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return errors.New("audit log is closed")
+	}
+
+	if err := l.lock(); err != nil {
+		return err
+	}
+	defer unlockFile(l.file)
+
+	if l.maxSize > 0 && l.size > 0 && l.size >= l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	record.Seq = l.seq + 1
+	record.Time = record.Time.UTC()
+	record.PrevHash = l.lastHash
+	hash, err := record.computeHash()
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("writing audit record: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("syncing audit log: %w", err)
+	}
+	l.seq = record.Seq
+	l.lastHash = record.Hash
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// open opens the file at path and picks up the chain from its last record
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	l.file = f
+	// An unknown size makes lock read the last record of the file
+	l.size = -1
+	if err := l.lock(); err != nil {
+		return err
+	}
+	unlockFile(l.file)
+	return nil
+}
+
+// lock takes the file lock and makes sure we are appending to the current
+// file with the latest hash, as another process may have written to or
+// rotated it since our last write
+func (l *Log) lock() error {
+	for {
+		if err := lockFile(l.file); err != nil {
+			return fmt.Errorf("locking audit log: %w", err)
+		}
+
+		// Someone else rotated the file, start over with the new one
+		current, err := os.Stat(l.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			unlockFile(l.file)
+			return fmt.Errorf("checking audit log: %w", err)
+		}
+		info, err := l.file.Stat()
+		if err != nil {
+			unlockFile(l.file)
+			return fmt.Errorf("checking audit log: %w", err)
+		}
+		if current == nil || !os.SameFile(current, info) {
+			unlockFile(l.file)
+			f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+			if err != nil {
+				return fmt.Errorf("opening audit log: %w", err)
+			}
+			l.file.Close()
+			l.file = f
+			continue
+		}
+
+		// Someone else appended to the file, carry on from their last record
+		if info.Size() != l.size {
+			last, err := readLastRecord(l.path, info.Size())
+			if err != nil {
+				unlockFile(l.file)
+				return err
+			}
+			if last != nil {
+				l.seq = last.Seq
+				l.lastHash = last.Hash
+			}
+			l.size = info.Size()
+		}
+		return nil
+	}
+}
+
+// rotate moves the current file to path.1, shifting the older ones along, and
+// starts a new file. It is called with the lock held.
+func (l *Log) rotate() error {
+	// Count the backups, the oldest one is overwritten once we keep maxBackups
+	n := 1
+	for fileExists(backupName(l.path, n)) && (l.maxBackups == 0 || n < l.maxBackups) {
+		n++
+	}
+	for i := n - 1; i >= 1; i-- {
+		if err := os.Rename(backupName(l.path, i), backupName(l.path, i+1)); err != nil {
+			return fmt.Errorf("rotating audit log: %w", err)
+		}
+	}
+	if err := os.Rename(l.path, backupName(l.path, 1)); err != nil {
+		return fmt.Errorf("rotating audit log: %w", err)
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	// Hold the lock on the new file before letting go of the old one
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("locking audit log: %w", err)
+	}
+	unlockFile(l.file)
+	l.file.Close()
+	l.file = f
+	l.size = 0
+	return nil
+}
+
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// readLastRecord reads the last line of the file, nil when the file is empty
+func readLastRecord(path string, size int64) (*Record, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading audit log: %w", err)
+	}
+	defer f.Close()
+
+	// Read backwards in growing chunks until we have the whole last line
+	chunk := int64(4096)
+	for {
+		if chunk > size {
+			chunk = size
+		}
+		buf := make([]byte, chunk)
+		if _, err := f.ReadAt(buf, size-chunk); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("reading audit log: %w", err)
+		}
+		buf = bytes.TrimRight(buf, "\n")
+		i := bytes.LastIndexByte(buf, '\n')
+		if i >= 0 || chunk == size {
+			var record Record
+			if err := json.Unmarshal(buf[i+1:], &record); err != nil {
+				return nil, fmt.Errorf("audit log %s ends with a broken record: %w", path, err)
+			}
+			return &record, nil
+		}
+		chunk *= 2
+	}
+}
@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Events recorded for every task. The exec record is written before the
+// command starts and the result record once it is done, both carry the same
+// request id.
+const (
+	EventExec   = "exec"
+	EventResult = "result"
+)
+
+// Record is one line of the audit log
+type Record struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	ConnID    string    `json:"conn_id"`
+	RequestID string    `json:"request_id"`
+	// Client is the ip of a tcp client or uid:N for a unix socket client
+	Client  string   `json:"client"`
+	Command []string `json:"command,omitempty"`
+	// RunAs is the user the request asked to run the task as, empty for the server's default
+	RunAs string `json:"run_as,omitempty"`
+	// EnvKeys are the names, not the values, of the environment the command runs with
+	EnvKeys []string `json:"env_keys,omitempty"`
+	Cwd     string   `json:"cwd,omitempty"`
+
+	DurationMs   float64 `json:"duration_ms,omitempty"`
+	ExitCode     *int    `json:"exit_code,omitempty"`
+	Error        string  `json:"error,omitempty"`
+	OutputSHA256 string  `json:"output_sha256,omitempty"`
+
+	// PrevHash is the hash of the record before this one, empty for the first record
+	PrevHash string `json:"prev_hash"`
+	// Hash is the sha256 of this record's JSON without the hash field
+	Hash string `json:"hash"`
+}
+
+// computeHash hashes the record as it is written to the log, minus the hash itself
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// OutputHash returns the hex sha256 of a task's output
+func OutputHash(output string) string {
+	sum := sha256.Sum256([]byte(output))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Verifier checks that records are unchanged and that none are missing. Feed
+// it the rotated files oldest first and the chain is followed from one file
+// into the next.
+type Verifier struct {
+	// Records is how many records have been verified so far
+	Records int
+	// Seq and Hash are those of the last verified record
+	Seq  uint64
+	Hash string
+}
+
+// VerifyError points at the record that broke the chain
+type VerifyError struct {
+	Name string
+	Line int
+	Err  error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.Name, e.Line, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// Verify reads the records from r, name is only used in errors. The first
+// record ever verified is trusted as the start of the chain unless it has
+// sequence number 1, in which case it must not point at a previous record.
+func (v *Verifier) Verify(name string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if err := v.verifyRecord(scanner.Bytes()); err != nil {
+			return &VerifyError{Name: name, Line: line, Err: err}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return &VerifyError{Name: name, Line: line + 1, Err: err}
+	}
+	return nil
+}
+
+func (v *Verifier) verifyRecord(b []byte) error {
+	var record Record
+	if err := json.Unmarshal(b, &record); err != nil {
+		return fmt.Errorf("invalid record: %w", err)
+	}
+
+	hash, err := record.computeHash()
+	if err != nil {
+		return err
+	}
+	if hash != record.Hash {
+		return fmt.Errorf("record %d has been modified: hash is %s, expected %s", record.Seq, record.Hash, hash)
+	}
+
+	switch {
+	case v.Records == 0 && record.Seq == 1 && record.PrevHash != "":
+		return fmt.Errorf("record 1 points at a previous record")
+	case v.Records > 0 && record.Seq != v.Seq+1:
+		return fmt.Errorf("expected record %d, got %d", v.Seq+1, record.Seq)
+	case v.Records > 0 && record.PrevHash != v.Hash:
+		return fmt.Errorf("record %d does not follow record %d: prev_hash is %s, expected %s", record.Seq, v.Seq, record.PrevHash, v.Hash)
+	}
+
+	v.Records++
+	v.Seq = record.Seq
+	v.Hash = record.Hash
+	return nil
+}
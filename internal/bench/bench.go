@@ -0,0 +1,158 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/pkg/client"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// Error types the report breaks failures down by, besides the error codes the server sends
+const (
+	ErrorNonZeroExit = "non_zero_exit"
+	ErrorConnection  = "connection"
+)
+
+type Params struct {
+	// Client sends the requests. Give it as many idle connections as Connections and no retries,
+	// so every connection stays open and rate limit rejections are counted.
+	Client *client.Client
+	// Connections is how many requests are in flight at once
+	Connections int
+	// Requests is how many requests are sent in total
+	Requests int
+	Request  model.TaskRequest
+}
+
+// Report sums up a run, it is meant to be compared across versions
+type Report struct {
+	StartedAt   time.Time `json:"started_at"`
+	Command     []string  `json:"command"`
+	Connections int       `json:"connections"`
+	Requests    int       `json:"requests"`
+	Succeeded   int       `json:"succeeded"`
+	Failed      int       `json:"failed"`
+	// RateLimited is the number of requests the server turned away, they are also in Errors
+	RateLimited int            `json:"rate_limited"`
+	Errors      map[string]int `json:"errors"`
+	DurationMs  float64        `json:"duration_ms"`
+	// Throughput is requests answered per second, failed ones included
+	Throughput float64 `json:"throughput_rps"`
+	// Latency is the time from sending a request to reading its result, failed ones included
+	Latency Latency `json:"latency_ms"`
+}
+
+type Latency struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// Run sends the requests and reports how they went. It stops early when ctx is cancelled.
+func Run(ctx context.Context, params Params) *Report {
+	report := &Report{
+		StartedAt:   time.Now(),
+		Command:     params.Request.Command,
+		Connections: params.Connections,
+		Errors:      map[string]int{},
+	}
+
+	// Every worker takes requests until they are all sent
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, params.Requests)
+		remaining atomic.Int64
+		wg        sync.WaitGroup
+	)
+	remaining.Store(int64(params.Requests))
+	for i := 0; i < params.Connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil && remaining.Add(-1) >= 0 {
+				start := time.Now()
+				_, err := params.Client.Run(ctx, params.Request)
+				latency := time.Since(start)
+				if ctx.Err() != nil {
+					return
+				}
+
+				mu.Lock()
+				latencies = append(latencies, latency)
+				if err == nil {
+					report.Succeeded++
+				} else {
+					report.Failed++
+					report.Errors[errorType(err)]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(report.StartedAt)
+	report.Requests = len(latencies)
+	report.RateLimited = report.Errors[constant.TaskResultRateLimitedError]
+	report.DurationMs = milliseconds(elapsed)
+	if elapsed > 0 {
+		report.Throughput = float64(report.Requests) / elapsed.Seconds()
+	}
+	report.Latency = summarize(latencies)
+	return report
+}
+
+// errorType sorts a failed request by what went wrong
+func errorType(err error) string {
+	var exitErr *client.ExitError
+	var serverErr *client.Error
+	switch {
+	case errors.As(err, &exitErr):
+		return ErrorNonZeroExit
+	case errors.As(err, &serverErr):
+		return serverErr.Code
+	default:
+		return ErrorConnection
+	}
+}
+
+func summarize(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+	slices.Sort(latencies)
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	return Latency{
+		Min:  milliseconds(latencies[0]),
+		Mean: milliseconds(total / time.Duration(len(latencies))),
+		P50:  milliseconds(percentile(latencies, 50)),
+		P90:  milliseconds(percentile(latencies, 90)),
+		P95:  milliseconds(percentile(latencies, 95)),
+		P99:  milliseconds(percentile(latencies, 99)),
+		Max:  milliseconds(latencies[len(latencies)-1]),
+	}
+}
+
+// percentile picks the nearest rank from sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
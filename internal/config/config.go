@@ -0,0 +1,467 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/listener"
+)
+
+// Rate limiter types that can be selected with rate_limit.type
+const (
+	RateLimiterIP   = "ip"
+	RateLimiterNone = "none"
+)
+
+// Trace exporters that can be selected with tracing.exporter
+const (
+	TracingExporterNone = "none"
+	TracingExporterOTLP = "otlp"
+	TracingExporterFile = "file"
+)
+
+// Log formats that can be selected with log.format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+type Config struct {
+	Listen       []string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// MaxFrameSize is the largest request in bytes, in either framing
+	MaxFrameSize int
+	RateLimit    RateLimitConfig
+	Executor     ExecutorConfig
+	Log          LogConfig
+	TLS          TLSConfig
+	Shutdown     ShutdownConfig
+	Metrics      MetricsConfig
+	Tracing      TracingConfig
+	Audit        AuditConfig
+	Admin        AdminConfig
+	HTTP         HTTPConfig
+	WebSocket    WebSocketConfig
+	GRPC         GRPCConfig
+	Auth         AuthConfig
+	Policy       PolicyConfig
+}
+
+type RateLimitConfig struct {
+	Type     string
+	Limit    int
+	Interval time.Duration
+}
+
+type ExecutorConfig struct {
+	MaxConcurrent int
+	// RunAs is the user, or user:group, tasks run as unless they ask for another, empty runs them as the server's user
+	RunAs string
+	// AllowRoot lets tasks run as root, including as the server itself when it runs as root
+	AllowRoot bool
+}
+
+type ShutdownConfig struct {
+	DrainTimeout time.Duration
+}
+
+type MetricsConfig struct {
+	// Listen is the address of the HTTP listener serving /metrics, empty disables it
+	Listen string
+}
+
+type TracingConfig struct {
+	Exporter string
+	// Endpoint is the OTLP/HTTP collector URL, empty uses the OTEL_EXPORTER_OTLP_* env vars
+	Endpoint string
+	// File is where the file exporter writes spans
+	File string
+}
+
+type AdminConfig struct {
+	// Listen is the address of the HTTP listener serving the health checks and admin endpoints, empty disables it
+	Listen string
+	// Token protects the /admin endpoints, empty disables them
+	Token string
+	// ReadyMaxQueued fails /readyz once more tasks than this are queued, 0 turns the check off
+	ReadyMaxQueued int
+}
+
+type HTTPConfig struct {
+	// Listen is the address of the HTTP gateway serving the task and job requests, empty disables it
+	Listen string
+}
+
+type WebSocketConfig struct {
+	// Listen is the address of the HTTP listener upgrading to WebSockets on /v1/ws, empty disables it
+	Listen string
+	// Origins are the hosts besides the server's own that browsers may open a WebSocket from
+	Origins []string
+}
+
+type GRPCConfig struct {
+	// Listen is the address of the gRPC listener serving the Executor service, empty disables it
+	Listen string
+}
+
+type AuthConfig struct {
+	// Tokens are the credentials a task request has to carry one of, empty lets every request in
+	Tokens []string
+}
+
+type PolicyConfig struct {
+	// RunAs are the run_as values a request may ask for, empty refuses every request with one
+	RunAs []string
+}
+
+type AuditConfig struct {
+	// File is where the audit log is written, empty disables it
+	File       string
+	MaxSizeMB  int
+	MaxBackups int
+	// FailClosed refuses to run a task when its audit record can't be written
+	FailClosed bool
+}
+
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM files, task connections are plain text when they are empty
+	CertFile string
+	KeyFile  string
+}
+
+type LogConfig struct {
+	Level  string
+	Format string
+}
+
+// Default returns the configuration the server runs with when nothing else is set
+func Default() *Config {
+	return &Config{
+		Listen:       []string{constant.DefaultListenAddress},
+		ReadTimeout:  constant.DefaultReadTimeout,
+		WriteTimeout: constant.DefaultWriteTimeout,
+		MaxFrameSize: constant.DefaultMaxFrameSize,
+		RateLimit: RateLimitConfig{
+			Type:     RateLimiterIP,
+			Limit:    constant.DefaultRateLimit,
+			Interval: constant.DefaultRateInterval,
+		},
+		Tracing: TracingConfig{
+			Exporter: TracingExporterNone,
+		},
+		Audit: AuditConfig{
+			MaxSizeMB:  constant.DefaultAuditMaxSizeMB,
+			MaxBackups: constant.DefaultAuditMaxBackups,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: LogFormatText,
+		},
+		Shutdown: ShutdownConfig{
+			DrainTimeout: constant.DefaultDrainTimeout,
+		},
+	}
+}
+
+// Validate checks that every value is usable and reports the first bad key
+func (c *Config) Validate() error {
+	if len(c.Listen) == 0 {
+		return &Error{Key: "listen", Err: fmt.Errorf("must not be empty")}
+	}
+	for _, spec := range c.Listen {
+		if _, err := listener.ParseSpec(spec); err != nil {
+			return &Error{Key: "listen", Err: err}
+		}
+	}
+	if c.ReadTimeout <= 0 {
+		return &Error{Key: "read_timeout", Err: fmt.Errorf("must be greater than 0, got %s", c.ReadTimeout)}
+	}
+	if c.WriteTimeout <= 0 {
+		return &Error{Key: "write_timeout", Err: fmt.Errorf("must be greater than 0, got %s", c.WriteTimeout)}
+	}
+	if c.MaxFrameSize <= 0 {
+		return &Error{Key: "max_frame_size", Err: fmt.Errorf("must be greater than 0, got %d", c.MaxFrameSize)}
+	}
+
+	switch c.RateLimit.Type {
+	case RateLimiterIP:
+		if c.RateLimit.Limit < 1 {
+			return &Error{Key: "rate_limit.limit", Err: fmt.Errorf("must be at least 1, got %d", c.RateLimit.Limit)}
+		}
+		if c.RateLimit.Interval <= 0 {
+			return &Error{Key: "rate_limit.interval", Err: fmt.Errorf("must be greater than 0, got %s", c.RateLimit.Interval)}
+		}
+	case RateLimiterNone:
+	default:
+		return &Error{Key: "rate_limit.type", Err: fmt.Errorf("must be %q or %q, got %q", RateLimiterIP, RateLimiterNone, c.RateLimit.Type)}
+	}
+
+	if c.Executor.MaxConcurrent < 0 {
+		return &Error{Key: "executor.max_concurrent", Err: fmt.Errorf("must not be negative, got %d", c.Executor.MaxConcurrent)}
+	}
+	if c.Executor.RunAs != "" {
+		if err := validateRunAs(c.Executor.RunAs); err != nil {
+			return &Error{Key: "executor.run_as", Err: err}
+		}
+	}
+	for _, runAs := range c.Policy.RunAs {
+		if err := validateRunAs(runAs); err != nil {
+			return &Error{Key: "policy.run_as", Err: err}
+		}
+	}
+
+	if c.Shutdown.DrainTimeout < 0 {
+		return &Error{Key: "shutdown.drain_timeout", Err: fmt.Errorf("must not be negative, got %s", c.Shutdown.DrainTimeout)}
+	}
+
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			return &Error{Key: "metrics.listen", Err: err}
+		}
+	}
+
+	switch c.Tracing.Exporter {
+	case TracingExporterNone, TracingExporterOTLP:
+	case TracingExporterFile:
+		if c.Tracing.File == "" {
+			return &Error{Key: "tracing.file", Err: fmt.Errorf("must be set when tracing.exporter is %q", TracingExporterFile)}
+		}
+	default:
+		return &Error{Key: "tracing.exporter", Err: fmt.Errorf("must be %q, %q or %q, got %q", TracingExporterNone, TracingExporterOTLP, TracingExporterFile, c.Tracing.Exporter)}
+	}
+
+	if c.Admin.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			return &Error{Key: "admin.listen", Err: err}
+		}
+	}
+	if c.Admin.ReadyMaxQueued < 0 {
+		return &Error{Key: "admin.ready_max_queued", Err: fmt.Errorf("must not be negative, got %d", c.Admin.ReadyMaxQueued)}
+	}
+
+	if c.HTTP.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.Listen); err != nil {
+			return &Error{Key: "http.listen", Err: err}
+		}
+	}
+	if c.WebSocket.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.WebSocket.Listen); err != nil {
+			return &Error{Key: "websocket.listen", Err: err}
+		}
+	}
+	if c.GRPC.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.GRPC.Listen); err != nil {
+			return &Error{Key: "grpc.listen", Err: err}
+		}
+	}
+
+	if c.Audit.MaxSizeMB < 0 {
+		return &Error{Key: "audit.max_size_mb", Err: fmt.Errorf("must not be negative, got %d", c.Audit.MaxSizeMB)}
+	}
+	if c.Audit.MaxBackups < 0 {
+		return &Error{Key: "audit.max_backups", Err: fmt.Errorf("must not be negative, got %d", c.Audit.MaxBackups)}
+	}
+	if c.Audit.FailClosed && c.Audit.File == "" {
+		return &Error{Key: "audit.fail_closed", Err: fmt.Errorf("needs audit.file to be set")}
+	}
+
+	if c.TLS.CertFile != "" && c.TLS.KeyFile == "" {
+		return &Error{Key: "tls.key_file", Err: fmt.Errorf("must be set when tls.cert_file is")}
+	}
+	if c.TLS.KeyFile != "" && c.TLS.CertFile == "" {
+		return &Error{Key: "tls.cert_file", Err: fmt.Errorf("must be set when tls.key_file is")}
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		return &Error{Key: "log.level", Err: fmt.Errorf("must be one of debug, info, warn or error, got %q", c.Log.Level)}
+	}
+	switch c.Log.Format {
+	case LogFormatText, LogFormatJSON:
+	default:
+		return &Error{Key: "log.format", Err: fmt.Errorf("must be %q or %q, got %q", LogFormatText, LogFormatJSON, c.Log.Format)}
+	}
+
+	return nil
+}
+
+// validateRunAs checks that a run_as is a user or user:group. Whether they
+// exist is only known when a task runs.
+func validateRunAs(runAs string) error {
+	user, group, withGroup := strings.Cut(runAs, ":")
+	if user == "" || withGroup && (group == "" || strings.Contains(group, ":")) {
+		return fmt.Errorf("must be a user or user:group, got %q", runAs)
+	}
+	return nil
+}
+
+// option describes a single configuration key. Every key can be set from the
+// config file, from a TCP_SERVER_* environment variable and from a flag.
+type option struct {
+	key   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var options = []option{
+	{"listen", "comma separated listeners for task requests, e.g. tcp://127.0.0.1:3000,unix:///run/tcp-server.sock", func(c *Config, v string) error {
+		c.Listen = nil
+		for _, spec := range strings.Split(v, ",") {
+			if spec = strings.TrimSpace(spec); spec != "" {
+				c.Listen = append(c.Listen, spec)
+			}
+		}
+		return nil
+	}},
+	{"read_timeout", "how long to wait for a request before closing the connection", durationSetter(func(c *Config) *time.Duration { return &c.ReadTimeout })},
+	{"write_timeout", "how long to wait when writing a response", durationSetter(func(c *Config) *time.Duration { return &c.WriteTimeout })},
+	{"max_frame_size", "largest request in bytes, bigger ones are answered with frame_too_large", intSetter(func(c *Config) *int { return &c.MaxFrameSize })},
+	{"rate_limit.type", "rate limiter to use (ip or none)", func(c *Config, v string) error {
+		c.RateLimit.Type = v
+		return nil
+	}},
+	{"rate_limit.limit", "number of connections an ip may open per interval", intSetter(func(c *Config) *int { return &c.RateLimit.Limit })},
+	{"rate_limit.interval", "window in which rate_limit.limit applies", durationSetter(func(c *Config) *time.Duration { return &c.RateLimit.Interval })},
+	{"executor.max_concurrent", "maximum number of tasks running at once (0 is unlimited)", intSetter(func(c *Config) *int { return &c.Executor.MaxConcurrent })},
+	{"executor.run_as", "user, or user:group, tasks run as unless they ask for another, e.g. nobody (empty runs them as the server's user)", func(c *Config, v string) error {
+		c.Executor.RunAs = v
+		return nil
+	}},
+	{"executor.allow_root", "let tasks run as root, without it tasks are refused when the server runs as root and executor.run_as is empty", boolSetter(func(c *Config) *bool { return &c.Executor.AllowRoot })},
+	{"shutdown.drain_timeout", "how long to wait for in-flight tasks on shutdown before killing them (0 waits forever)", durationSetter(func(c *Config) *time.Duration { return &c.Shutdown.DrainTimeout })},
+	{"metrics.listen", "address of the HTTP listener serving Prometheus metrics on /metrics (empty disables it)", func(c *Config, v string) error {
+		c.Metrics.Listen = v
+		return nil
+	}},
+	{"tracing.exporter", "where to send trace spans (none, otlp or file)", func(c *Config, v string) error {
+		c.Tracing.Exporter = v
+		return nil
+	}},
+	{"tracing.endpoint", "OTLP/HTTP collector URL, e.g. http://localhost:4318 (empty uses the OTEL_EXPORTER_OTLP_* env vars)", func(c *Config, v string) error {
+		c.Tracing.Endpoint = v
+		return nil
+	}},
+	{"tracing.file", "file the file exporter appends spans to as JSON lines", func(c *Config, v string) error {
+		c.Tracing.File = v
+		return nil
+	}},
+	{"admin.listen", "address of the HTTP listener serving /healthz, /readyz and the /admin endpoints (empty disables it)", func(c *Config, v string) error {
+		c.Admin.Listen = v
+		return nil
+	}},
+	{"admin.token", "bearer token needed to use the /admin endpoints (empty disables them)", func(c *Config, v string) error {
+		c.Admin.Token = v
+		return nil
+	}},
+	{"admin.ready_max_queued", "fail /readyz once more tasks than this are waiting for a slot (0 turns the check off)", intSetter(func(c *Config) *int { return &c.Admin.ReadyMaxQueued })},
+	{"http.listen", "address of the HTTP gateway serving /v1/tasks and /v1/jobs (empty disables it)", func(c *Config, v string) error {
+		c.HTTP.Listen = v
+		return nil
+	}},
+	{"websocket.listen", "address of the HTTP listener upgrading to WebSockets on /v1/ws (empty disables it)", func(c *Config, v string) error {
+		c.WebSocket.Listen = v
+		return nil
+	}},
+	{"websocket.origins", "comma separated hosts besides the server's own that browsers may open a WebSocket from, e.g. dashboard.example.com", func(c *Config, v string) error {
+		c.WebSocket.Origins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.WebSocket.Origins = append(c.WebSocket.Origins, origin)
+			}
+		}
+		return nil
+	}},
+	{"grpc.listen", "address of the gRPC listener serving the Executor service (empty disables it)", func(c *Config, v string) error {
+		c.GRPC.Listen = v
+		return nil
+	}},
+	{"auth.tokens", "comma separated tokens a task request has to carry one of (empty lets every request in)", func(c *Config, v string) error {
+		c.Auth.Tokens = nil
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				c.Auth.Tokens = append(c.Auth.Tokens, token)
+			}
+		}
+		return nil
+	}},
+	{"policy.run_as", "comma separated run_as values a request may ask for, e.g. nobody,deploy:www-data (empty refuses every request with one)", func(c *Config, v string) error {
+		c.Policy.RunAs = nil
+		for _, runAs := range strings.Split(v, ",") {
+			if runAs = strings.TrimSpace(runAs); runAs != "" {
+				c.Policy.RunAs = append(c.Policy.RunAs, runAs)
+			}
+		}
+		return nil
+	}},
+	{"audit.file", "file the audit log of executed commands is appended to (empty disables it)", func(c *Config, v string) error {
+		c.Audit.File = v
+		return nil
+	}},
+	{"audit.max_size_mb", "size in megabytes after which the audit log is rotated (0 never rotates)", intSetter(func(c *Config) *int { return &c.Audit.MaxSizeMB })},
+	{"audit.max_backups", "number of rotated audit logs to keep (0 keeps them all)", intSetter(func(c *Config) *int { return &c.Audit.MaxBackups })},
+	{"audit.fail_closed", "refuse to run a task when its audit record can't be written", boolSetter(func(c *Config) *bool { return &c.Audit.FailClosed })},
+	{"tls.cert_file", "PEM certificate task connections are served with over TLS, read again on every reload (empty serves plain text)", func(c *Config, v string) error {
+		c.TLS.CertFile = v
+		return nil
+	}},
+	{"tls.key_file", "PEM private key of tls.cert_file", func(c *Config, v string) error {
+		c.TLS.KeyFile = v
+		return nil
+	}},
+	{"log.level", "minimum level to log (debug, info, warn or error)", func(c *Config, v string) error {
+		c.Log.Level = v
+		return nil
+	}},
+	{"log.format", "log output format (text or json)", func(c *Config, v string) error {
+		c.Log.Format = v
+		return nil
+	}},
+}
+
+func lookupOption(key string) (option, bool) {
+	for _, opt := range options {
+		if opt.key == key {
+			return opt, true
+		}
+	}
+	return option{}, false
+}
+
+func intSetter(field func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", v)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func boolSetter(field func(c *Config) *bool) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", v)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func durationSetter(field func(c *Config) *time.Duration) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%q is not a duration (e.g. 30s, 1m)", v)
+		}
+		*field(c) = d
+		return nil
+	}
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix is prepended to every key when reading environment variables
+	EnvPrefix = "TCP_SERVER_"
+	// EnvConfigFile names the config file when -config is not given
+	EnvConfigFile = EnvPrefix + "CONFIG"
+)
+
+// Error points at the configuration key that could not be applied
+type Error struct {
+	Key    string
+	Source string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("config: invalid %s: %v", e.Key, e.Err)
+	}
+	return fmt.Sprintf("config: invalid %s (from %s): %v", e.Key, e.Source, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// EnvName returns the environment variable that sets the given key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// FlagName returns the command line flag that sets the given key
+func FlagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+// Load builds the configuration from the defaults, the config file, the
+// environment and the command line flags. Later sources take precedence over
+// earlier ones, so a flag always wins over an env var which wins over the file.
+func Load(name string, args []string, environ []string, output io.Writer) (*Config, error) {
+	cfg := Default()
+
+	// Register a flag for every option, but only record the values for now so
+	// that they can be applied after the file and the environment.
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	configFile := fs.String("config", "", "path to a YAML, TOML or JSON config file (env "+EnvConfigFile+")")
+	flagValues := map[string]string{}
+	for _, opt := range options {
+		key := opt.key
+		fs.Func(FlagName(key), fmt.Sprintf("%s (env %s)", opt.usage, EnvName(key)), func(v string) error {
+			flagValues[key] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("config: unexpected argument %q", fs.Arg(0))
+	}
+
+	env := envMap(environ)
+
+	// Apply the config file
+	path := *configFile
+	if path == "" {
+		path = env[EnvConfigFile]
+	}
+	if path != "" {
+		if err := applyFile(cfg, path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Apply the environment
+	for _, opt := range options {
+		envName := EnvName(opt.key)
+		if v, ok := env[envName]; ok {
+			if err := opt.set(cfg, v); err != nil {
+				return nil, &Error{Key: opt.key, Source: "env " + envName, Err: err}
+			}
+		}
+	}
+
+	// Apply the flags
+	for _, opt := range options {
+		if v, ok := flagValues[opt.key]; ok {
+			if err := opt.set(cfg, v); err != nil {
+				return nil, &Error{Key: opt.key, Source: "flag -" + FlagName(opt.key), Err: err}
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadFile reads a config file on top of the defaults without looking at the
+// environment or flags
+func LoadFile(path string) (*Config, error) {
+	cfg := Default()
+	if err := applyFile(cfg, path); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func applyFile(cfg *Config, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: reading %s: %w", path, err)
+	}
+
+	// Decode the file into a generic tree so every key goes through the same
+	// setters as the env vars and flags
+	tree := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &tree)
+	case ".json":
+		err = json.Unmarshal(b, &tree)
+	case ".toml":
+		_, err = toml.Decode(string(b), &tree)
+	default:
+		return fmt.Errorf("config: unsupported config file extension %q (use .yaml, .yml, .toml or .json)", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config: parsing %s: %w", path, err)
+	}
+
+	values := map[string]any{}
+	flatten("", tree, values)
+
+	// Sort the keys so the reported error is stable
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	source := "file " + path
+	for _, key := range keys {
+		opt, ok := lookupOption(key)
+		if !ok {
+			return &Error{Key: key, Source: source, Err: fmt.Errorf("unknown key")}
+		}
+		v, err := scalar(values[key])
+		if err != nil {
+			return &Error{Key: key, Source: source, Err: err}
+		}
+		if err := opt.set(cfg, v); err != nil {
+			return &Error{Key: key, Source: source, Err: err}
+		}
+	}
+	return nil
+}
+
+// flatten turns nested tables into dotted keys, e.g. rate_limit.limit
+func flatten(prefix string, tree map[string]any, out map[string]any) {
+	for k, v := range tree {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if sub, ok := v.(map[string]any); ok {
+			flatten(key, sub, out)
+			continue
+		}
+		out[key] = v
+	}
+}
+
+func scalar(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", fmt.Errorf("missing value")
+	case string:
+		return v, nil
+	case []any:
+		// Lists are passed to the setter the same way as from an env var or flag
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := scalar(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", fmt.Errorf("expected a single value")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+func envMap(environ []string) map[string]string {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, EnvPrefix) {
+			env[k] = v
+		}
+	}
+	return env
+}
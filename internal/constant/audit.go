@@ -0,0 +1,6 @@
+package constant
+
+const (
+	DefaultAuditMaxSizeMB  = 100
+	DefaultAuditMaxBackups = 10
+)
@@ -0,0 +1,12 @@
+package constant
+
+import "time"
+
+const (
+	DefaultClientDialTimeout   = time.Second * 10
+	DefaultClientMaxIdleConns  = 2
+	DefaultClientPollInterval  = time.Millisecond * 500
+	DefaultRetryMaxAttempts    = 5
+	DefaultRetryInitialBackoff = time.Millisecond * 100
+	DefaultRetryMaxBackoff     = time.Second * 5
+)
@@ -1,6 +1,19 @@
 package constant
 
 const (
-	TaskResultCommandNilError = "requested command is nil."
-	TaskResultTimeoutError    = "timeout exceeded"
+	TaskResultCommandNilError     = "requested command is nil."
+	TaskResultTimeoutError        = "timeout exceeded"
+	TaskResultShuttingDownError   = "shutting_down"
+	TaskResultAuditError          = "audit_failed"
+	TaskResultKilledError         = "killed"
+	TaskResultRateLimitedError    = "rate_limited"
+	TaskResultInvalidRequestError = "invalid_request"
+	TaskResultUnauthorizedError   = "unauthorized"
+	TaskResultFrameTooLargeError  = "frame_too_large"
+	TaskResultParseError          = "parse_error"
+	TaskResultForbiddenError      = "forbidden"
+	TaskResultRootNotAllowedError = "root_not_allowed"
+	UnsupportedVersionError       = "unsupported_version"
+	JobNotFoundError              = "job_not_found"
+	JobLimitError                 = "too_many_jobs"
 )
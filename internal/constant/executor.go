@@ -0,0 +1,7 @@
+package constant
+
+import "time"
+
+const (
+	DefaultWaitDelay = time.Second * 1
+)
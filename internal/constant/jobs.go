@@ -0,0 +1,8 @@
+package constant
+
+import "time"
+
+const (
+	DefaultJobRetention     = 10 * time.Minute
+	DefaultMaxJobsPerClient = 100
+)
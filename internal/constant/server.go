@@ -3,6 +3,10 @@ package constant
 import "time"
 
 const (
-	DefaultReadTimeout  = time.Second * 30
-	DefaultWriteTimeout = time.Second * 30
+	DefaultListenAddress  = ":3000"
+	DefaultReadTimeout    = time.Second * 30
+	DefaultWriteTimeout   = time.Second * 30
+	DefaultDrainTimeout   = time.Second * 30
+	DefaultUpgradeTimeout = time.Second * 30
+	DefaultMaxFrameSize   = 1 << 20
 )
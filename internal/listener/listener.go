@@ -0,0 +1,178 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Spec describes a single address to listen on, e.g.
+//
+//	tcp://127.0.0.1:3000
+//	tcp://[::1]:3000
+//	unix:///run/tcp-server.sock?mode=0660&owner=tcp&group=tcp
+//	unix://@tcp-server (abstract socket, linux only)
+//
+// A plain host:port without a scheme is treated as tcp.
+type Spec struct {
+	Network string
+	Address string
+	// Mode, Owner and Group are applied to unix socket files after they are created
+	Mode  fs.FileMode
+	Owner string
+	Group string
+}
+
+func ParseSpec(s string) (Spec, error) {
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		// No scheme, so this is a host:port like ":3000"
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return Spec{}, fmt.Errorf("invalid listener %q: %w", s, err)
+		}
+		return Spec{Network: "tcp", Address: s}, nil
+	}
+
+	address, rawQuery, _ := strings.Cut(rest, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return Spec{}, fmt.Errorf("invalid listener %q: %w", s, err)
+	}
+
+	spec := Spec{Network: scheme, Address: address}
+	switch scheme {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return Spec{}, fmt.Errorf("invalid listener %q: %w", s, err)
+		}
+		if len(query) > 0 {
+			return Spec{}, fmt.Errorf("invalid listener %q: tcp listeners take no options", s)
+		}
+	case "unix":
+		if address == "" || address == "@" {
+			return Spec{}, fmt.Errorf("invalid listener %q: missing socket path", s)
+		}
+		for key := range query {
+			switch key {
+			case "mode":
+				mode, err := strconv.ParseUint(query.Get(key), 8, 32)
+				if err != nil {
+					return Spec{}, fmt.Errorf("invalid listener %q: mode must be octal, e.g. 0660", s)
+				}
+				spec.Mode = fs.FileMode(mode)
+			case "owner":
+				spec.Owner = query.Get(key)
+			case "group":
+				spec.Group = query.Get(key)
+			default:
+				return Spec{}, fmt.Errorf("invalid listener %q: unknown option %q", s, key)
+			}
+		}
+		if spec.Abstract() && (spec.Mode != 0 || spec.Owner != "" || spec.Group != "") {
+			return Spec{}, fmt.Errorf("invalid listener %q: abstract sockets have no file to set mode or owner on", s)
+		}
+	default:
+		return Spec{}, fmt.Errorf("invalid listener %q: unsupported scheme %q", s, scheme)
+	}
+	return spec, nil
+}
+
+// Abstract reports whether the spec is a linux abstract unix socket
+func (s Spec) Abstract() bool {
+	return s.Network == "unix" && strings.HasPrefix(s.Address, "@")
+}
+
+func (s Spec) String() string {
+	return s.Network + "://" + s.Address
+}
+
+// Listen opens the listener described by the spec
+func Listen(spec Spec) (net.Listener, error) {
+	if spec.Network != "unix" || spec.Abstract() {
+		return net.Listen(spec.Network, spec.Address)
+	}
+
+	// Remove a socket left behind by a previous run, but never anything that is not a socket
+	if info, err := os.Lstat(spec.Address); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", spec.Address)
+		}
+		if err := os.Remove(spec.Address); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", spec.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyFileOptions(spec); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func applyFileOptions(spec Spec) error {
+	if spec.Mode != 0 {
+		if err := os.Chmod(spec.Address, spec.Mode); err != nil {
+			return fmt.Errorf("setting mode of %s: %w", spec.Address, err)
+		}
+	}
+	if spec.Owner == "" && spec.Group == "" {
+		return nil
+	}
+
+	// -1 leaves the uid or gid unchanged
+	uid, gid := -1, -1
+	if spec.Owner != "" {
+		id, err := lookupID(spec.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("looking up owner of %s: %w", spec.Address, err)
+		}
+		uid = id
+	}
+	if spec.Group != "" {
+		id, err := lookupID(spec.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("looking up group of %s: %w", spec.Address, err)
+		}
+		gid = id
+	}
+	if err := os.Chown(spec.Address, uid, gid); err != nil {
+		return fmt.Errorf("setting owner of %s: %w", spec.Address, err)
+	}
+	return nil
+}
+
+// lookupID accepts either a numeric id or a name to look up
+func lookupID(nameOrID string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
@@ -0,0 +1,46 @@
+package listener
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// Peer identifies the client on the other end of a connection
+type Peer struct {
+	// IP is set for tcp connections
+	IP string
+	// UID, GID and PID are set for unix socket connections
+	UID int
+	GID int
+	PID int
+	// Unix is true when the peer was identified with its unix credentials
+	Unix bool
+}
+
+// Identity is the key we use to rate limit and log the client. For tcp it is
+// the ip without the port so a client can't get around limits by opening
+// connections from different ports. For unix sockets it is the peer's uid.
+func (p Peer) Identity() string {
+	if p.Unix {
+		return fmt.Sprintf("uid:%d", p.UID)
+	}
+	return p.IP
+}
+
+// PeerOf works out who is on the other end of the connection
+func PeerOf(conn net.Conn) (Peer, error) {
+	// The credentials belong to the socket under the TLS session
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		return unixPeer(unixConn)
+	}
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return Peer{}, err
+	}
+	return Peer{IP: ip}, nil
+}
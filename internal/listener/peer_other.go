@@ -0,0 +1,12 @@
+//go:build !linux
+
+package listener
+
+import (
+	"errors"
+	"net"
+)
+
+func unixPeer(conn *net.UnixConn) (Peer, error) {
+	return Peer{}, errors.New("peer credentials are only supported on linux")
+}
@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx carrying the logger, so code further down
+// the call chain logs with the same connection and request attributes
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger stored in ctx, or fallback when there is none.
+// A nil fallback means the default logger.
+func FromContext(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return slog.Default()
+}
+
+// NewID returns a random id to tell connections and requests apart in the logs
+func NewID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/hex"
+	"hash"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/audit"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// requestInfo says who sent a request, it goes into the audit records
+type requestInfo struct {
+	connID    string
+	requestID string
+	client    string
+}
+
+// auditExec records a task before it runs. It reports false when the task
+// must not run because the record couldn't be written and we fail closed.
+func (s *TCPServer) auditExec(info requestInfo, request *model.TaskRequest) bool {
+	if s.audit == nil {
+		return true
+	}
+	cwd, _ := os.Getwd()
+	err := s.audit.Write(&audit.Record{
+		Time:      time.Now(),
+		Event:     audit.EventExec,
+		ConnID:    info.connID,
+		RequestID: info.requestID,
+		Client:    info.client,
+		Command:   request.Command,
+		RunAs:     request.RunAs,
+		EnvKeys:   envKeys(os.Environ()),
+		Cwd:       cwd,
+	})
+	if err != nil {
+		s.logger.Error("cannot write audit record", "request_id", info.requestID, "fail_closed", s.auditFailClosed, "error", err)
+		auditErrors.Inc()
+		return !s.auditFailClosed
+	}
+	return true
+}
+
+// auditResult records how a task went once it is done. streamed has hashed
+// the output that was sent as it was written, nil hashes the result's output.
+func (s *TCPServer) auditResult(info requestInfo, result *model.TaskResult, streamed hash.Hash) {
+	if s.audit == nil {
+		return
+	}
+	outputHash := audit.OutputHash(string(result.Output))
+	if streamed != nil {
+		outputHash = hex.EncodeToString(streamed.Sum(nil))
+	}
+	exitCode := result.ExitCode
+	err := s.audit.Write(&audit.Record{
+		Time:         time.Now(),
+		Event:        audit.EventResult,
+		ConnID:       info.connID,
+		RequestID:    info.requestID,
+		Client:       info.client,
+		DurationMs:   result.DurationMs,
+		ExitCode:     &exitCode,
+		Error:        result.Error,
+		OutputSHA256: outputHash,
+	})
+	if err != nil {
+		s.logger.Error("cannot write audit record", "request_id", info.requestID, "error", err)
+		auditErrors.Inc()
+	}
+}
+
+// envKeys returns the sorted names of the variables in environ
+func envKeys(environ []string) []string {
+	keys := make([]string, 0, len(environ))
+	for _, kv := range environ {
+		if k, _, ok := strings.Cut(kv, "="); ok && k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// drainState keeps count of the in-flight tasks and open connections so we can
+// shut down without cutting off a task half way through
+type drainState struct {
+	mu       sync.Mutex
+	draining bool
+	// closing is set once the drain is over and connections should stop reading
+	closing  bool
+	inflight int
+	conns    map[net.Conn]struct{}
+	// idle is closed once we are draining and there are no tasks left
+	idle chan struct{}
+}
+
+func newDrainState() *drainState {
+	return &drainState{
+		conns: make(map[net.Conn]struct{}),
+		idle:  make(chan struct{}),
+	}
+}
+
+func (d *drainState) addConn(conn net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns[conn] = struct{}{}
+}
+
+func (d *drainState) removeConn(conn net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.conns, conn)
+}
+
+// beginTask reports whether a new task may start, which is false once we are draining
+func (d *drainState) beginTask() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.inflight++
+	return true
+}
+
+func (d *drainState) endTask() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inflight--
+	if d.draining && d.inflight == 0 {
+		close(d.idle)
+	}
+}
+
+func (d *drainState) isDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// start flips us into draining and returns a channel that is closed once the last task is done
+func (d *drainState) start() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		d.draining = true
+		if d.inflight == 0 {
+			close(d.idle)
+		}
+	}
+	return d.idle
+}
+
+// setReadDeadline arms the read deadline of a connection unless we are closing
+// connections, in which case it reports false and the connection should end
+func (d *drainState) setReadDeadline(conn net.Conn, timeout time.Duration) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closing {
+		return false, nil
+	}
+	return true, conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// clearReadDeadline lets a connection wait for its client as long as it takes,
+// unless we are closing connections
+func (d *drainState) clearReadDeadline(conn net.Conn) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closing {
+		return nil
+	}
+	return conn.SetReadDeadline(time.Time{})
+}
+
+// wakeConns makes every connection blocked on a read return straight away
+func (d *drainState) wakeConns() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closing = true
+	for conn := range d.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Shutdown stops accepting connections and waits for the in-flight tasks to
+// finish and send their results. Requests that come in while we wait get a
+// shutting_down error. If ctx is done first the remaining tasks are killed.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	// Stop accepting new connections
+	closeListeners(s.listeners)
+	idle := s.drain.start()
+
+	// Wait for the in-flight tasks to finish, or kill them when we run out of time
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.logger.Warn("drain deadline exceeded, killing in-flight tasks", "error", err)
+		s.cancelTasks()
+	}
+
+	// Nothing is running anymore, so close the connections that are waiting for a request
+	s.drain.wakeConns()
+	s.wg.Wait()
+	s.cancelTasks()
+	return err
+}
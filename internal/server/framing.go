@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Oyal2/tcp-server/pkg/codec"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// errFrameTooLarge is returned when a request is bigger than the max frame size
+var errFrameTooLarge = errors.New("frame too large")
+
+// clientConn reads requests from and writes responses to a client in the
+// framing and codec it negotiated. Messages are newline delimited JSON until
+// the client asks for something else.
+type clientConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// lengthPrefixed and codec are only changed by the connection's own goroutine between requests
+	lengthPrefixed bool
+	codec          codec.Codec
+	// writeMu keeps frames whole when output is streamed from several goroutines
+	writeMu sync.Mutex
+	// compressor gzips what is written once the client asked for it
+	compressor *gzip.Writer
+	// carried is where an interactive session's reader leaves the frame it read
+	// after the session, the next request
+	carried chan carriedFrame
+}
+
+type carriedFrame struct {
+	b   []byte
+	err error
+}
+
+func newClientConn(conn net.Conn) *clientConn {
+	jsonCodec, _ := codec.Get(codec.JSON)
+	return &clientConn{Conn: conn, reader: bufio.NewReader(conn), codec: jsonCodec}
+}
+
+// setFraming switches the framing of the following messages
+func (c *clientConn) setFraming(framing string) {
+	c.lengthPrefixed = framing == model.FramingLengthPrefixed
+}
+
+// readFrame returns the next request, or errFrameTooLarge when it is over maxSize bytes
+func (c *clientConn) readFrame(maxSize int) ([]byte, error) {
+	if c.lengthPrefixed {
+		var header [4]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if uint64(size) > uint64(maxSize) {
+			return nil, errFrameTooLarge
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	// Read up to the newline. Like bufio.Scanner we hand over what was read
+	// before an error, so a request cut short still gets an answer.
+	var line []byte
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxSize+1 {
+			return nil, errFrameTooLarge
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && len(line) == 0 {
+			return nil, err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		return bytes.TrimSuffix(line, []byte("\r")), nil
+	}
+}
+
+// nextFrame returns the next request, which an interactive session may have read already
+func (c *clientConn) nextFrame(maxSize int) ([]byte, error) {
+	if c.carried != nil {
+		frame := <-c.carried
+		c.carried = nil
+		return frame.b, frame.err
+	}
+	return c.readFrame(maxSize)
+}
+
+// compress gzips everything written from now on. The gzip header goes out
+// straight away so the client can set up its reader before the next request.
+func (c *clientConn) compress() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.compressor = gzip.NewWriter(compressedWriter{c.Conn})
+	return c.compressor.Flush()
+}
+
+// send writes b out, compressed if the client asked for it. The lock must be held.
+func (c *clientConn) send(b []byte) error {
+	if c.compressor == nil {
+		_, err := c.Write(b)
+		return err
+	}
+	if _, err := c.compressor.Write(b); err != nil {
+		return err
+	}
+	compressionInput.Add(float64(len(b)))
+	// Flush so the message doesn't wait for more to compress
+	return c.compressor.Flush()
+}
+
+// compressedWriter counts the bytes the compressor sends
+type compressedWriter struct {
+	io.Writer
+}
+
+func (w compressedWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	compressionOutput.Add(float64(n))
+	return n, err
+}
+
+// writeText sends an error that isn't JSON. Line framing sends it as it is,
+// without a newline, as it always has.
+func (c *clientConn) writeText(text string) error {
+	if c.lengthPrefixed {
+		return c.writeFrame([]byte(text))
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.send([]byte(text))
+}
+
+// writeFrame sends a single message
+func (c *clientConn) writeFrame(b []byte) error {
+	var frame []byte
+	if c.lengthPrefixed {
+		frame = binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(b)), uint32(len(b)))
+		frame = append(frame, b...)
+	} else {
+		frame = append(b, '\n')
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.send(frame)
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/listener"
+	"github.com/Oyal2/tcp-server/internal/logging"
+	"github.com/Oyal2/tcp-server/pkg/codec"
+	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// HTTPHandler serves the task and job requests over HTTP with JSON bodies.
+// Requests go through the same auth, rate limiter, audit log and drain as the
+// ones on the TCP listeners, only the rate limiter is asked for every request
+// rather than every connection.
+//
+//	POST   /v1/tasks      runs a task and answers with its result
+//	POST   /v1/jobs       submits a job and answers 202 with its status
+//	GET    /v1/jobs       lists the client's jobs
+//	GET    /v1/jobs/{id}  returns the status of a job
+//	DELETE /v1/jobs/{id}  cancels a job
+func (s *TCPServer) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/tasks", s.httpRun)
+	mux.HandleFunc("POST /v1/jobs", s.httpSubmit)
+	mux.HandleFunc("GET /v1/jobs", s.httpJobs)
+	mux.HandleFunc("GET /v1/jobs/{id}", s.httpJob)
+	mux.HandleFunc("DELETE /v1/jobs/{id}", s.httpJob)
+	return mux
+}
+
+// httpRun runs the task and answers with its result. With an Accept of
+// text/event-stream, or stream set in the body, the output is sent as it
+// comes as server-sent events or newline delimited JSON, with the result last.
+func (s *TCPServer) httpRun(w http.ResponseWriter, r *http.Request) {
+	ctx, info, request, ok := s.httpRequest(w, r, model.RequestRun)
+	if !ok {
+		return
+	}
+
+	// Refuse new work once we are shutting down
+	if !s.drain.beginTask() {
+		logging.FromContext(ctx, s.logger).Info("refusing request while shutting down", "outcome", outcomeShuttingDown)
+		requestsTotal.WithLabelValues(outcomeShuttingDown).Inc()
+		s.writeHTTP(ctx, w, http.StatusServiceUnavailable, refused(request, constant.TaskResultShuttingDownError))
+		return
+	}
+	defer s.drain.endTask()
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if !sse && !request.Stream {
+		result := encodeResult(jsonCodec(), request, s.execute(ctx, info, request, nil, nil))
+		s.writeHTTP(ctx, w, httpStatus(result.Error), result)
+		return
+	}
+
+	// The status goes out before the task starts, errors after that are in the result
+	request.Stream = true
+	stream := &httpStream{w: w, rc: http.NewResponseController(w), sse: sse, writeTimeout: s.WriteTimeout()}
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	var output executor.OutputFunc = func(name string, data []byte) {
+		frame := &model.OutputFrame{Type: model.MessageOutput, Stream: name}
+		frame.Data, frame.Encoding = encodeOutput(jsonCodec(), request, data)
+		stream.send(ctx, s, model.MessageOutput, frame)
+	}
+	result := encodeResult(jsonCodec(), request, s.execute(ctx, info, request, output, nil))
+	result.Type = model.MessageResult
+	stream.send(ctx, s, model.MessageResult, result)
+}
+
+// httpSubmit starts a job and answers with where to ask about it
+func (s *TCPServer) httpSubmit(w http.ResponseWriter, r *http.Request) {
+	ctx, info, request, ok := s.httpRequest(w, r, model.RequestSubmit)
+	if !ok {
+		return
+	}
+	status := s.submit(ctx, info, request)
+	if status.Error != "" {
+		s.writeHTTP(ctx, w, httpStatus(status.Error), status)
+		return
+	}
+	w.Header().Set("Location", "/v1/jobs/"+status.JobID)
+	s.writeHTTP(ctx, w, http.StatusAccepted, status)
+}
+
+// httpJobs lists the client's jobs
+func (s *TCPServer) httpJobs(w http.ResponseWriter, r *http.Request) {
+	ctx, info, request, ok := s.httpRequest(w, r, model.RequestJobs)
+	if !ok {
+		return
+	}
+	s.writeHTTP(ctx, w, http.StatusOK, s.listJobs(info, request, jsonCodec()))
+}
+
+// httpJob returns the status of a job, or cancels it for DELETE
+func (s *TCPServer) httpJob(w http.ResponseWriter, r *http.Request) {
+	requestType := model.RequestStatus
+	if r.Method == http.MethodDelete {
+		requestType = model.RequestCancel
+	}
+	ctx, info, request, ok := s.httpRequest(w, r, requestType)
+	if !ok {
+		return
+	}
+	status := s.jobStatus(ctx, info, request)
+	status.Result = encodeResult(jsonCodec(), request, status.Result)
+	s.writeHTTP(ctx, w, httpStatus(status.Error), status)
+}
+
+// httpRequest identifies and rate limits the client, reads the request and
+// checks its credentials. It reports false when the request has already been
+// answered.
+func (s *TCPServer) httpRequest(w http.ResponseWriter, r *http.Request, requestType string) (context.Context, requestInfo, *model.TaskRequest, bool) {
+	info := requestInfo{requestID: logging.NewID()}
+	logger := s.logger.With("transport", "http", "request_id", info.requestID)
+	ctx := logging.NewContext(r.Context(), logger)
+
+	// Identify the client by its ip without the port, like tcp connections
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		logger.Warn("cannot identify client", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, info, nil, false
+	}
+	peer := listener.Peer{IP: ip}
+	info.client = peer.Identity()
+	logger = logger.With(peerAttrs(peer)...)
+	ctx = logging.NewContext(ctx, logger)
+
+	if !s.allow(ctx, info.client) {
+		logger.Warn("rate limit exceeded", "outcome", outcomeRateLimited)
+		requestsTotal.WithLabelValues(outcomeRateLimited).Inc()
+		s.writeHTTP(ctx, w, http.StatusTooManyRequests, &model.TaskResult{ExitCode: -1, Error: constant.TaskResultRateLimitedError})
+		return nil, info, nil, false
+	}
+
+	// Only the task requests have a body, the job id of the others is in the path
+	request := &model.TaskRequest{}
+	if r.Method == http.MethodPost {
+		b, err := readBody(w, r, s.MaxFrameSize())
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logger.Warn("request too large", "outcome", outcomeFrameTooLarge, "max_frame_size", s.MaxFrameSize())
+			requestsTotal.WithLabelValues(outcomeFrameTooLarge).Inc()
+			s.writeHTTP(ctx, w, http.StatusRequestEntityTooLarge, &model.TaskResult{ExitCode: -1, Error: constant.TaskResultFrameTooLargeError})
+			return nil, info, nil, false
+		}
+		if err == nil {
+			request, err = parseRequest(ctx, jsonCodec(), b)
+		}
+		if err != nil {
+			logger.Warn("cannot parse request", "outcome", outcomeParseError, "error", err)
+			requestsTotal.WithLabelValues(outcomeParseError).Inc()
+			http.Error(w, fmt.Sprintf("Error parsing request: %v", err), http.StatusBadRequest)
+			return nil, info, nil, false
+		}
+	} else {
+		request.JobID = r.PathValue("id")
+		request.OutputEncoding = r.URL.Query().Get("output_encoding")
+	}
+	request.Type = requestType
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		request.Token = token
+	}
+	if request.TraceParent == "" {
+		request.TraceParent = r.Header.Get("traceparent")
+	}
+	logger = logger.With("command", request.Command)
+	ctx = logging.NewContext(ctx, logger)
+
+	// Only let in requests with valid credentials
+	if !s.authorized(request.Token) {
+		logger.Warn("refusing request with invalid token", "outcome", outcomeUnauthorized)
+		requestsTotal.WithLabelValues(outcomeUnauthorized).Inc()
+		s.writeHTTP(ctx, w, http.StatusUnauthorized, refused(request, constant.TaskResultUnauthorizedError))
+		return nil, info, nil, false
+	}
+
+	// Only run tasks as the users the policy allows
+	if !s.permitted(request) {
+		logger.Warn("refusing request to run as another user", "run_as", request.RunAs, "outcome", outcomeForbidden)
+		requestsTotal.WithLabelValues(outcomeForbidden).Inc()
+		s.writeHTTP(ctx, w, http.StatusForbidden, refused(request, constant.TaskResultForbiddenError))
+		return nil, info, nil, false
+	}
+
+	// Tasks and jobs need something to run, a status or cancel has its job id instead
+	if missingCommand(request) {
+		logger.Warn("refusing request without a command", "outcome", outcomeInvalidRequest)
+		requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+		s.writeHTTP(ctx, w, http.StatusBadRequest, refused(request, constant.TaskResultCommandNilError))
+		return nil, info, nil, false
+	}
+
+	if request.OutputEncoding != "" && request.OutputEncoding != model.OutputEncodingBase64 {
+		logger.Warn("unknown output encoding", "output_encoding", request.OutputEncoding, "outcome", outcomeInvalidRequest)
+		requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+		s.writeHTTP(ctx, w, http.StatusBadRequest, refused(request, constant.TaskResultInvalidRequestError))
+		return nil, info, nil, false
+	}
+
+	// A request can't be typed into, interactive tasks and stdin need a connection or a WebSocket
+	if request.Interactive || request.Stdin {
+		logger.Warn("cannot give task the connection", "interactive", request.Interactive, "stdin", request.Stdin, "outcome", outcomeInvalidRequest)
+		requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+		s.writeHTTP(ctx, w, http.StatusBadRequest, refused(request, constant.TaskResultInvalidRequestError))
+		return nil, info, nil, false
+	}
+
+	// Tasks outlive the HTTP request like they outlive a TCP connection, only the logger is kept
+	return logging.NewContext(s.tasksCtx, logger), info, request, true
+}
+
+// readBody reads the request body, failing with a MaxBytesError over maxSize bytes
+func readBody(w http.ResponseWriter, r *http.Request, maxSize int) ([]byte, error) {
+	return io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxSize)))
+}
+
+// httpStatus is the status code a response with the error code goes out with.
+// Tasks that ran answer 200 whatever their exit code, the result tells how they went.
+func httpStatus(code string) int {
+	switch code {
+	case constant.TaskResultRateLimitedError, constant.JobLimitError:
+		return http.StatusTooManyRequests
+	case constant.TaskResultUnauthorizedError:
+		return http.StatusUnauthorized
+	case constant.TaskResultForbiddenError, constant.TaskResultRootNotAllowedError:
+		return http.StatusForbidden
+	case constant.TaskResultInvalidRequestError, constant.TaskResultCommandNilError:
+		return http.StatusBadRequest
+	case constant.TaskResultFrameTooLargeError:
+		return http.StatusRequestEntityTooLarge
+	case constant.JobNotFoundError:
+		return http.StatusNotFound
+	case constant.TaskResultShuttingDownError, constant.TaskResultAuditError:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusOK
+	}
+}
+
+// writeHTTP sends a message as the JSON body of the response
+func (s *TCPServer) writeHTTP(ctx context.Context, w http.ResponseWriter, status int, message any) {
+	logger := logging.FromContext(ctx, s.logger)
+	response, err := json.Marshal(message)
+	if err != nil {
+		logger.Error("cannot marshal response", "error", err)
+		http.Error(w, fmt.Sprintf("Error marshaling response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	stream := &httpStream{w: w, rc: http.NewResponseController(w), writeTimeout: s.WriteTimeout()}
+	stream.write(ctx, s, append(response, '\n'))
+}
+
+// httpStream sends the messages of a streamed task as server-sent events or
+// newline delimited JSON, flushing each one so it isn't held back
+type httpStream struct {
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	sse          bool
+	writeTimeout time.Duration
+	mu           sync.Mutex
+}
+
+func (h *httpStream) send(ctx context.Context, s *TCPServer, event string, message any) {
+	logger := logging.FromContext(ctx, s.logger)
+	response, err := json.Marshal(message)
+	if err != nil {
+		logger.Error("cannot marshal response", "error", err)
+		return
+	}
+
+	if h.sse {
+		response = fmt.Appendf(nil, "event: %s\ndata: %s\n\n", event, response)
+	} else {
+		response = append(response, '\n')
+	}
+	h.write(ctx, s, response)
+}
+
+// write sends b within the write timeout. The deadline is lifted again
+// afterwards so it doesn't cut off the next request on the connection.
+func (h *httpStream) write(ctx context.Context, s *TCPServer, b []byte) {
+	logger := logging.FromContext(ctx, s.logger)
+	// Output can come from several goroutines, keep the messages whole
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.rc.SetWriteDeadline(time.Now().Add(h.writeTimeout)); err == nil {
+		defer h.rc.SetWriteDeadline(time.Time{})
+	} else if !errors.Is(err, http.ErrNotSupported) {
+		logger.Error("cannot set write deadline", "error", err)
+		return
+	}
+	_, err := h.w.Write(b)
+	if err == nil {
+		err = h.rc.Flush()
+	}
+	if err != nil {
+		logger.Warn("cannot send response", "error", err)
+	}
+}
+
+// jsonCodec is the codec of every HTTP body
+func jsonCodec() codec.Codec {
+	c, _ := codec.Get(codec.JSON)
+	return c
+}
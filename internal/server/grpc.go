@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/listener"
+	"github.com/Oyal2/tcp-server/internal/logging"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// RegisterGRPC adds the Executor service to r. Calls go through the same auth,
+// rate limiter, audit log and drain as the requests on the TCP listeners, only
+// the rate limiter is asked for every call rather than every connection.
+// Requests that are turned down fail with the status code for their error,
+// tasks that ran return their result whatever their exit code.
+func (s *TCPServer) RegisterGRPC(r grpc.ServiceRegistrar) {
+	pb.RegisterExecutorServer(r, &grpcService{server: s})
+}
+
+type grpcService struct {
+	pb.UnimplementedExecutorServer
+	server *TCPServer
+}
+
+// Execute runs the task. The task is killed when the call is cancelled.
+func (g *grpcService) Execute(ctx context.Context, in *pb.TaskRequest) (*pb.TaskResult, error) {
+	s := g.server
+	request := taskRequestFromPB(in, model.RequestRun)
+	taskCtx, info, err := s.grpcRequest(ctx, in, request)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.beginGRPCTask(taskCtx); err != nil {
+		return nil, err
+	}
+	defer s.drain.endTask()
+
+	taskCtx, cancel := killWhen(taskCtx, ctx.Done())
+	defer cancel(nil)
+	result := s.execute(taskCtx, info, request, nil, nil)
+	if err := grpcError(result.Error); err != nil {
+		return nil, err
+	}
+	return taskResultToPB(result), nil
+}
+
+// ExecuteStream runs the task and sends its output as it is written, followed
+// by the result. The task is killed when the call is cancelled.
+func (g *grpcService) ExecuteStream(in *pb.TaskRequest, stream pb.Executor_ExecuteStreamServer) error {
+	s := g.server
+	request := taskRequestFromPB(in, model.RequestRun)
+	request.Stream = true
+	taskCtx, info, err := s.grpcRequest(stream.Context(), in, request)
+	if err != nil {
+		return err
+	}
+	if err := s.beginGRPCTask(taskCtx); err != nil {
+		return err
+	}
+	defer s.drain.endTask()
+
+	taskCtx, cancel := killWhen(taskCtx, stream.Context().Done())
+	defer cancel(nil)
+	// Output can come from several goroutines and Send isn't safe to call at once
+	var mu sync.Mutex
+	send := func(response *pb.ExecuteStreamResponse) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := stream.Send(response); err != nil {
+			logging.FromContext(taskCtx, s.logger).Warn("cannot send response", "error", err)
+		}
+	}
+	result := s.execute(taskCtx, info, request, func(name string, data []byte) {
+		send(&pb.ExecuteStreamResponse{Message: &pb.ExecuteStreamResponse_Output{
+			Output: &pb.OutputFrame{Stream: name, Data: data},
+		}})
+	}, nil)
+	if err := grpcError(result.Error); err != nil {
+		return err
+	}
+	send(&pb.ExecuteStreamResponse{Message: &pb.ExecuteStreamResponse_Result{Result: taskResultToPB(result)}})
+	return nil
+}
+
+// Submit starts the task as a job, which carries on when the call is over
+func (g *grpcService) Submit(ctx context.Context, in *pb.TaskRequest) (*pb.Job, error) {
+	s := g.server
+	request := taskRequestFromPB(in, model.RequestSubmit)
+	taskCtx, info, err := s.grpcRequest(ctx, in, request)
+	if err != nil {
+		return nil, err
+	}
+	job := s.submit(taskCtx, info, request)
+	if err := grpcError(job.Error); err != nil {
+		return nil, err
+	}
+	return jobToPB(job), nil
+}
+
+func (g *grpcService) Get(ctx context.Context, in *pb.JobRequest) (*pb.Job, error) {
+	return g.server.grpcJob(ctx, in, model.RequestStatus)
+}
+
+func (g *grpcService) Cancel(ctx context.Context, in *pb.JobRequest) (*pb.Job, error) {
+	return g.server.grpcJob(ctx, in, model.RequestCancel)
+}
+
+// grpcJob answers a status or cancel request for one of the client's jobs
+func (s *TCPServer) grpcJob(ctx context.Context, in *pb.JobRequest, requestType string) (*pb.Job, error) {
+	request := &model.TaskRequest{Type: requestType, JobID: in.GetJobId()}
+	ctx, info, err := s.grpcRequest(ctx, in, request)
+	if err != nil {
+		return nil, err
+	}
+	job := s.jobStatus(ctx, info, request)
+	if err := grpcError(job.Error); err != nil {
+		return nil, err
+	}
+	return jobToPB(job), nil
+}
+
+// grpcRequest identifies and rate limits the client, checks the size of the
+// request and its credentials. The returned context is the one tasks run under.
+func (s *TCPServer) grpcRequest(ctx context.Context, in proto.Message, request *model.TaskRequest) (context.Context, requestInfo, error) {
+	info := requestInfo{requestID: logging.NewID()}
+	logger := s.logger.With("transport", "grpc", "request_id", info.requestID)
+
+	// Identify the client by its ip without the port, like tcp connections
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		logger.Warn("cannot identify client")
+		return nil, info, status.Error(codes.Internal, "cannot identify client")
+	}
+	ip, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		logger.Warn("cannot identify client", "error", err)
+		return nil, info, status.Error(codes.Internal, "cannot identify client")
+	}
+	client := listener.Peer{IP: ip}
+	info.client = client.Identity()
+	logger = logger.With(peerAttrs(client)...)
+	ctx = logging.NewContext(ctx, logger)
+
+	if !s.allow(ctx, info.client) {
+		logger.Warn("rate limit exceeded", "outcome", outcomeRateLimited)
+		requestsTotal.WithLabelValues(outcomeRateLimited).Inc()
+		return nil, info, grpcError(constant.TaskResultRateLimitedError)
+	}
+	if proto.Size(in) > s.MaxFrameSize() {
+		logger.Warn("request too large", "outcome", outcomeFrameTooLarge, "max_frame_size", s.MaxFrameSize())
+		requestsTotal.WithLabelValues(outcomeFrameTooLarge).Inc()
+		return nil, info, grpcError(constant.TaskResultFrameTooLargeError)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(value, "Bearer "); ok {
+			request.Token = token
+		}
+	}
+	if traceParent := md.Get("traceparent"); request.TraceParent == "" && len(traceParent) > 0 {
+		request.TraceParent = traceParent[0]
+	}
+	logger = logger.With("command", request.Command)
+
+	// Only let in requests with valid credentials
+	if !s.authorized(request.Token) {
+		logger.Warn("refusing request with invalid token", "outcome", outcomeUnauthorized)
+		requestsTotal.WithLabelValues(outcomeUnauthorized).Inc()
+		return nil, info, grpcError(constant.TaskResultUnauthorizedError)
+	}
+
+	// Only run tasks as the users the policy allows
+	if !s.permitted(request) {
+		logger.Warn("refusing request to run as another user", "run_as", request.RunAs, "outcome", outcomeForbidden)
+		requestsTotal.WithLabelValues(outcomeForbidden).Inc()
+		return nil, info, grpcError(constant.TaskResultForbiddenError)
+	}
+
+	// Tasks and jobs need something to run, a status or cancel has its job id instead
+	if missingCommand(request) {
+		logger.Warn("refusing request without a command", "outcome", outcomeInvalidRequest)
+		requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+		return nil, info, grpcError(constant.TaskResultCommandNilError)
+	}
+
+	// Tasks outlive the call like they outlive a TCP connection, unless the call kills them
+	return logging.NewContext(s.tasksCtx, logger), info, nil
+}
+
+// beginGRPCTask lets a task in unless we are shutting down
+func (s *TCPServer) beginGRPCTask(ctx context.Context) error {
+	if !s.drain.beginTask() {
+		logging.FromContext(ctx, s.logger).Info("refusing request while shutting down", "outcome", outcomeShuttingDown)
+		requestsTotal.WithLabelValues(outcomeShuttingDown).Inc()
+		return grpcError(constant.TaskResultShuttingDownError)
+	}
+	return nil
+}
+
+// grpcError is the status a call fails with for the error code, nil for the
+// errors of tasks that ran, which are in their result
+func grpcError(code string) error {
+	var c codes.Code
+	switch code {
+	case constant.TaskResultRateLimitedError, constant.JobLimitError, constant.TaskResultFrameTooLargeError:
+		c = codes.ResourceExhausted
+	case constant.TaskResultUnauthorizedError:
+		c = codes.Unauthenticated
+	case constant.TaskResultForbiddenError, constant.TaskResultRootNotAllowedError:
+		c = codes.PermissionDenied
+	case constant.TaskResultInvalidRequestError, constant.TaskResultCommandNilError:
+		c = codes.InvalidArgument
+	case constant.JobNotFoundError:
+		c = codes.NotFound
+	case constant.TaskResultShuttingDownError, constant.TaskResultAuditError:
+		c = codes.Unavailable
+	default:
+		return nil
+	}
+	return status.Error(c, code)
+}
+
+func taskRequestFromPB(in *pb.TaskRequest, requestType string) *model.TaskRequest {
+	return &model.TaskRequest{
+		Type:        requestType,
+		Command:     in.GetCommand(),
+		Timeout:     int(in.GetTimeout()),
+		TraceParent: in.GetTraceparent(),
+		RunAs:       in.GetRunAs(),
+	}
+}
+
+func taskResultToPB(result *model.TaskResult) *pb.TaskResult {
+	if result == nil {
+		return nil
+	}
+	return &pb.TaskResult{
+		Command:    result.Command,
+		ExecutedAt: result.ExecutedAt,
+		DurationMs: result.DurationMs,
+		ExitCode:   int32(result.ExitCode),
+		Output:     result.Output,
+		Error:      result.Error,
+	}
+}
+
+func jobToPB(job *model.JobStatus) *pb.Job {
+	return &pb.Job{
+		JobId:       job.JobID,
+		State:       job.State,
+		Command:     job.Command,
+		SubmittedAt: job.SubmittedAt,
+		Result:      taskResultToPB(job.Result),
+	}
+}
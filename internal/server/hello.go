@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"slices"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/logging"
+	"github.com/Oyal2/tcp-server/pkg/codec"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// protocolVersions are the protocol versions the server speaks
+var protocolVersions = []int{model.ProtocolVersion}
+
+// handleHello answers a hello with the newest version both sides speak and
+// the features it asked for that the server supports. A framing, codec or
+// compression in the hello is switched to once the answer went out, like with
+// a framing request.
+func (s *TCPServer) handleHello(ctx context.Context, conn *clientConn, request *model.TaskRequest) {
+	logger := logging.FromContext(ctx, s.logger)
+	hello := &model.Hello{Type: model.MessageHello, Features: []string{}}
+
+	for _, v := range request.Versions {
+		if slices.Contains(protocolVersions, v) && v > hello.Version {
+			hello.Version = v
+		}
+	}
+	if hello.Version == 0 {
+		logger.Warn("no common protocol version", "versions", request.Versions, "outcome", outcomeUnsupported)
+		requestsTotal.WithLabelValues(outcomeUnsupported).Inc()
+		hello.Versions = protocolVersions
+		hello.Error = constant.UnsupportedVersionError
+		s.writeMessage(ctx, conn, hello)
+		return
+	}
+
+	switch request.Framing {
+	case "", model.FramingLine, model.FramingLengthPrefixed:
+	default:
+		logger.Warn("unknown framing", "framing", request.Framing, "outcome", outcomeInvalidRequest)
+		requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+		hello.Error = constant.TaskResultInvalidRequestError
+		s.writeMessage(ctx, conn, hello)
+		return
+	}
+
+	// Unknown features are left out so the client knows to do without them
+	supported := s.features()
+	for _, feature := range request.Features {
+		if slices.Contains(supported, feature) && !slices.Contains(hello.Features, feature) {
+			hello.Features = append(hello.Features, feature)
+		}
+	}
+
+	framing := model.FramingLine
+	if conn.lengthPrefixed {
+		framing = model.FramingLengthPrefixed
+	}
+	if request.Framing != "" {
+		framing = request.Framing
+	}
+
+	// An unknown codec keeps the current one, the answer tells the client which it got
+	c := conn.codec
+	if requested, ok := codec.Get(request.Codec); ok {
+		c = requested
+	}
+	if c.Binary() && framing != model.FramingLengthPrefixed {
+		logger.Warn("binary codec needs length prefixed frames", "codec", c.Name(), "outcome", outcomeInvalidRequest)
+		requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+		hello.Error = constant.TaskResultInvalidRequestError
+		s.writeMessage(ctx, conn, hello)
+		return
+	}
+
+	// Compression can't be turned off again, an unknown one is left off
+	compress := conn.compressor == nil && request.Compression == model.CompressionGzip
+	if compress || conn.compressor != nil {
+		hello.Compression = model.CompressionGzip
+	}
+
+	hello.Framing = framing
+	hello.Codec = c.Name()
+	hello.MaxFrameSize = s.MaxFrameSize()
+	s.writeMessage(ctx, conn, hello)
+	conn.setFraming(framing)
+	conn.codec = c
+	if compress {
+		if err := conn.compress(); err != nil {
+			logger.Warn("cannot start compressing", "error", err)
+		}
+	}
+	logger.Debug("hello", "version", hello.Version, "features", hello.Features, "framing", framing, "codec", c.Name(), "compression", hello.Compression)
+}
+
+// features returns the features the server supports right now
+func (s *TCPServer) features() []string {
+	features := []string{model.FeatureStreaming, model.FeatureJobs, model.FeatureFraming, model.FeatureCompression}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.tokens) > 0 {
+		features = append(features, model.FeatureAuth)
+	}
+	if s.interactive() {
+		features = append(features, model.FeatureInteractive)
+	}
+	if s.feedsStdin() {
+		features = append(features, model.FeatureStdin)
+	}
+	return features
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/logging"
+	"github.com/Oyal2/tcp-server/pkg/codec"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+type job struct {
+	client string
+	status model.JobStatus
+	cancel context.CancelCauseFunc
+	// doneAt is when the task finished, finished jobs are forgotten after the retention
+	doneAt time.Time
+}
+
+// jobStore keeps the submitted jobs so their owner can ask about them later
+type jobStore struct {
+	mu           sync.Mutex
+	jobs         map[string]*job
+	retention    time.Duration
+	maxPerClient int
+}
+
+func newJobStore(retention time.Duration, maxPerClient int) *jobStore {
+	if retention <= 0 {
+		retention = constant.DefaultJobRetention
+	}
+	if maxPerClient <= 0 {
+		maxPerClient = constant.DefaultMaxJobsPerClient
+	}
+	return &jobStore{
+		jobs:         make(map[string]*job),
+		retention:    retention,
+		maxPerClient: maxPerClient,
+	}
+}
+
+// add stores a running job. It reports false when the client already has too many running.
+func (js *jobStore) add(client string, status model.JobStatus, cancel context.CancelCauseFunc) bool {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.purge()
+	running := 0
+	for _, j := range js.jobs {
+		if j.client == client && j.status.State == model.JobRunning {
+			running++
+		}
+	}
+	if running >= js.maxPerClient {
+		return false
+	}
+	js.jobs[status.JobID] = &job{client: client, status: status, cancel: cancel}
+	return true
+}
+
+func (js *jobStore) finish(id string, result *model.TaskResult) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if j, ok := js.jobs[id]; ok {
+		j.status.State = model.JobDone
+		j.status.Result = result
+		j.doneAt = time.Now()
+	}
+}
+
+// get returns the client's job, other clients' jobs are never found
+func (js *jobStore) get(client, id string) (model.JobStatus, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.purge()
+	j, ok := js.jobs[id]
+	if !ok || j.client != client {
+		return model.JobStatus{}, false
+	}
+	return j.status, true
+}
+
+// kill cancels the client's job if it is still running
+func (js *jobStore) kill(client, id string) (model.JobStatus, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	j, ok := js.jobs[id]
+	if !ok || j.client != client {
+		return model.JobStatus{}, false
+	}
+	if j.status.State == model.JobRunning {
+		j.cancel(errTaskKilled)
+	}
+	return j.status, true
+}
+
+// list returns the client's jobs, oldest first
+func (js *jobStore) list(client string) []model.JobStatus {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.purge()
+	jobs := []model.JobStatus{}
+	for _, j := range js.jobs {
+		if j.client == client {
+			jobs = append(jobs, j.status)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].SubmittedAt < jobs[j].SubmittedAt })
+	return jobs
+}
+
+// purge forgets the jobs that finished longer than the retention ago. The lock must be held.
+func (js *jobStore) purge() {
+	for id, j := range js.jobs {
+		if j.status.State == model.JobDone && time.Since(j.doneAt) > js.retention {
+			delete(js.jobs, id)
+		}
+	}
+}
+
+// handleSubmit starts the task in the background and answers with its job id
+// straight away. It reports false when the connection should be closed.
+func (s *TCPServer) handleSubmit(ctx context.Context, conn *clientConn, info requestInfo, request *model.TaskRequest) bool {
+	status := s.submit(ctx, info, request)
+	s.writeMessage(ctx, conn, status)
+	return status.Error != constant.TaskResultShuttingDownError
+}
+
+// submit starts the task in the background and returns its job, or a status
+// with the error when the job can't be started
+func (s *TCPServer) submit(ctx context.Context, info requestInfo, request *model.TaskRequest) *model.JobStatus {
+	logger := logging.FromContext(ctx, s.logger)
+
+	// Refuse new work once we are shutting down
+	if !s.drain.beginTask() {
+		logger.Info("refusing request while shutting down", "outcome", outcomeShuttingDown)
+		requestsTotal.WithLabelValues(outcomeShuttingDown).Inc()
+		return &model.JobStatus{Type: model.MessageJob, Error: constant.TaskResultShuttingDownError}
+	}
+
+	// The request id doubles as the job id so the job shows up under it in the admin tasks
+	status := model.JobStatus{
+		Type:        model.MessageJob,
+		JobID:       info.requestID,
+		State:       model.JobRunning,
+		Command:     request.Command,
+		SubmittedAt: time.Now().Unix(),
+	}
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	if !s.jobs.add(info.client, status, cancel) {
+		cancel(nil)
+		s.drain.endTask()
+		logger.Warn("refusing job, too many running", "outcome", outcomeJobLimit)
+		requestsTotal.WithLabelValues(outcomeJobLimit).Inc()
+		return &model.JobStatus{Type: model.MessageJob, Error: constant.JobLimitError}
+	}
+	logger.Info("job submitted", "job_id", status.JobID)
+
+	go func() {
+		defer s.drain.endTask()
+		defer cancel(nil)
+		result := s.execute(jobCtx, info, request, nil, nil)
+		s.jobs.finish(status.JobID, result)
+	}()
+	return &status
+}
+
+// handleJobRequest answers status, cancel and jobs requests. A client only
+// ever sees its own jobs.
+func (s *TCPServer) handleJobRequest(ctx context.Context, conn *clientConn, info requestInfo, request *model.TaskRequest) {
+	if request.Type == model.RequestJobs {
+		s.writeMessage(ctx, conn, s.listJobs(info, request, conn.codec))
+		return
+	}
+	status := s.jobStatus(ctx, info, request)
+	status.Result = encodeResult(conn.codec, request, status.Result)
+	s.writeMessage(ctx, conn, status)
+}
+
+// listJobs returns the client's jobs with their output encoded for c
+func (s *TCPServer) listJobs(info requestInfo, request *model.TaskRequest, c codec.Codec) *model.JobList {
+	jobs := s.jobs.list(info.client)
+	for i := range jobs {
+		jobs[i].Result = encodeResult(c, request, jobs[i].Result)
+	}
+	return &model.JobList{Type: model.MessageJobs, Jobs: jobs}
+}
+
+// jobStatus answers a status or cancel request. The result is the job's own,
+// it is encoded into a copy before it is sent.
+func (s *TCPServer) jobStatus(ctx context.Context, info requestInfo, request *model.TaskRequest) *model.JobStatus {
+	var (
+		status model.JobStatus
+		found  bool
+	)
+	if request.Type == model.RequestCancel {
+		status, found = s.jobs.kill(info.client, request.JobID)
+		if found {
+			logging.FromContext(ctx, s.logger).Info("job cancelled", "job_id", request.JobID)
+		}
+	} else {
+		status, found = s.jobs.get(info.client, request.JobID)
+	}
+	if !found {
+		status = model.JobStatus{JobID: request.JobID, Error: constant.JobNotFoundError}
+	}
+	status.Type = model.MessageJob
+	return &status
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Request outcomes reported by tcp_server_requests_total
+const (
+	outcomeSuccess        = "success"
+	outcomeNonZeroExit    = "non_zero_exit"
+	outcomeTimeout        = "timeout"
+	outcomeError          = "error"
+	outcomeParseError     = "parse_error"
+	outcomeRateLimited    = "rate_limited"
+	outcomeShuttingDown   = "shutting_down"
+	outcomeAuditFailed    = "audit_failed"
+	outcomeKilled         = "killed"
+	outcomeInvalidRequest = "invalid_request"
+	outcomeJobLimit       = "too_many_jobs"
+	outcomeUnauthorized   = "unauthorized"
+	outcomeForbidden      = "forbidden"
+	outcomeFrameTooLarge  = "frame_too_large"
+	outcomeUnsupported    = "unsupported_version"
+)
+
+// Reasons reported by tcp_server_connections_rejected_total besides rate_limited
+const (
+	reasonUnidentified = "unidentified"
+)
+
+var (
+	connectionsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tcp_server",
+		Name:      "connections_accepted_total",
+		Help:      "Connections accepted on any listener.",
+	})
+	connectionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tcp_server",
+		Name:      "connections_active",
+		Help:      "Connections currently open.",
+	})
+	connectionsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tcp_server",
+		Name:      "connections_rejected_total",
+		Help:      "Connections closed before serving a request, by reason.",
+	}, []string{"reason"})
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tcp_server",
+		Name:      "requests_total",
+		Help:      "Task requests handled, by outcome.",
+	}, []string{"outcome"})
+	compressionInput = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tcp_server",
+		Name:      "compression_input_bytes_total",
+		Help:      "Bytes of responses sent to compressing connections, before compression.",
+	})
+	compressionOutput = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tcp_server",
+		Name:      "compression_output_bytes_total",
+		Help:      "Bytes of responses sent to compressing connections, after compression.",
+	})
+	auditErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tcp_server",
+		Name:      "audit_write_errors_total",
+		Help:      "Audit records that could not be written.",
+	})
+)
+
+// runningServers are the servers whose current rate limiter is counted by
+// tcp_server_ratelimit_tracked_ips. The limiter is read on every scrape so one
+// swapped out by a reload stops being counted straight away.
+var (
+	runningServersMu sync.Mutex
+	runningServers   = map[*TCPServer]struct{}{}
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "tcp_server",
+		Name:      "ratelimit_tracked_ips",
+		Help:      "Number of ips in the rate limiter table.",
+	}, trackedIPs)
+)
+
+func trackedIPs() float64 {
+	runningServersMu.Lock()
+	defer runningServersMu.Unlock()
+	total := 0
+	for s := range runningServers {
+		if tracker := s.currentRateLimitTracker(); tracker != nil {
+			total += tracker.Len()
+		}
+	}
+	return float64(total)
+}
+
+func addRunningServer(s *TCPServer) {
+	runningServersMu.Lock()
+	defer runningServersMu.Unlock()
+	runningServers[s] = struct{}{}
+}
+
+func removeRunningServer(s *TCPServer) {
+	runningServersMu.Lock()
+	defer runningServersMu.Unlock()
+	delete(runningServers, s)
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"encoding/base64"
+	"unicode/utf8"
+
+	"github.com/Oyal2/tcp-server/pkg/codec"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// encodeOutput base64 encodes output the request asked to get that way, or
+// that isn't UTF-8 and would have its bytes replaced by a text codec
+func encodeOutput(c codec.Codec, request *model.TaskRequest, output model.Bytes) (model.Bytes, string) {
+	if len(output) == 0 {
+		return output, ""
+	}
+	if request.OutputEncoding != model.OutputEncodingBase64 && (c.Binary() || utf8.Valid(output)) {
+		return output, ""
+	}
+	encoded := make(model.Bytes, base64.StdEncoding.EncodedLen(len(output)))
+	base64.StdEncoding.Encode(encoded, output)
+	return encoded, model.OutputEncodingBase64
+}
+
+// encodeResult returns a copy of the result with its output encoded for the
+// request, the result itself may be kept by a job
+func encodeResult(c codec.Codec, request *model.TaskRequest, result *model.TaskResult) *model.TaskResult {
+	if result == nil {
+		return nil
+	}
+	encoded := *result
+	encoded.Output, encoded.OutputEncoding = encodeOutput(c, request, result.Output)
+	return &encoded
+}
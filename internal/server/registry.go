@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errTaskKilled is the cancel cause of a task killed through KillTask
+var errTaskKilled = errors.New("task killed")
+
+// ConnectionInfo describes an open connection
+type ConnectionInfo struct {
+	ID          string    `json:"id"`
+	Client      string    `json:"client"`
+	Network     string    `json:"network"`
+	LocalAddr   string    `json:"local_addr"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// TaskInfo describes a running task
+type TaskInfo struct {
+	RequestID string    `json:"request_id"`
+	ConnID    string    `json:"conn_id"`
+	Client    string    `json:"client"`
+	Command   []string  `json:"command"`
+	Timeout   int       `json:"timeout,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type runningTask struct {
+	info   TaskInfo
+	cancel context.CancelCauseFunc
+}
+
+// registry keeps track of the open connections and running tasks for the admin endpoints
+type registry struct {
+	mu    sync.Mutex
+	conns map[string]ConnectionInfo
+	tasks map[string]runningTask
+}
+
+func newRegistry() *registry {
+	return &registry{
+		conns: make(map[string]ConnectionInfo),
+		tasks: make(map[string]runningTask),
+	}
+}
+
+func (r *registry) addConn(info ConnectionInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[info.ID] = info
+}
+
+func (r *registry) removeConn(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, id)
+}
+
+func (r *registry) setClient(id, client string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if info, ok := r.conns[id]; ok {
+		info.Client = client
+		r.conns[id] = info
+	}
+}
+
+func (r *registry) addTask(info TaskInfo, cancel context.CancelCauseFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tasks[info.RequestID] = runningTask{info: info, cancel: cancel}
+}
+
+func (r *registry) removeTask(requestID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tasks, requestID)
+}
+
+// Connections returns the open connections, oldest first
+func (s *TCPServer) Connections() []ConnectionInfo {
+	s.registry.mu.Lock()
+	defer s.registry.mu.Unlock()
+	conns := make([]ConnectionInfo, 0, len(s.registry.conns))
+	for _, info := range s.registry.conns {
+		conns = append(conns, info)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ConnectedAt.Before(conns[j].ConnectedAt) })
+	return conns
+}
+
+// Tasks returns the running tasks, oldest first
+func (s *TCPServer) Tasks() []TaskInfo {
+	s.registry.mu.Lock()
+	defer s.registry.mu.Unlock()
+	tasks := make([]TaskInfo, 0, len(s.registry.tasks))
+	for _, task := range s.registry.tasks {
+		tasks = append(tasks, task.info)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].StartedAt.Before(tasks[j].StartedAt) })
+	return tasks
+}
+
+// KillTask kills the task started by the given request. The client gets a
+// result with the killed error. It reports false when no such task is running.
+func (s *TCPServer) KillTask(requestID string) bool {
+	s.registry.mu.Lock()
+	defer s.registry.mu.Unlock()
+	task, ok := s.registry.tasks[requestID]
+	if ok {
+		task.cancel(errTaskKilled)
+	}
+	return ok
+}
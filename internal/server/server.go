@@ -1,46 +1,132 @@
 package server
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Oyal2/tcp-server/internal/model"
+	"github.com/Oyal2/tcp-server/internal/audit"
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/listener"
+	"github.com/Oyal2/tcp-server/internal/logging"
+	"github.com/Oyal2/tcp-server/internal/tracing"
+	"github.com/Oyal2/tcp-server/pkg/codec"
 	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
 	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TCPServer struct {
 	executor    executor.TaskExecutor
 	wg          *sync.WaitGroup
 	rateLimiter ratelimit.RateLimiter
+	tlsConfig   *tls.Config
+	logger      *slog.Logger
+
+	audit           audit.Sink
+	auditFailClosed bool
 
 	mu           sync.RWMutex
-	listener     net.Listener
+	listeners    []net.Listener
 	readTimeout  time.Duration
 	writeTimeout time.Duration
+	certificate  *tls.Certificate
+	drainTimeout time.Duration
+	maxFrameSize int
+	tokens       []string
+	// runAs are the run_as values requests may ask for
+	runAs []string
+	// rateLimitTracker is rateLimiter when it can report the clients it tracks
+	rateLimitTracker ratelimit.Tracker
+
+	// tasksCtx is the parent of every task, cancelling it force stops them all
+	tasksCtx    context.Context
+	cancelTasks context.CancelFunc
+
+	// drain tracks the connections and in-flight tasks while shutting down
+	drain *drainState
+	// registry lists the connections and running tasks for the admin endpoints
+	registry *registry
+	// jobs keeps the submitted jobs until a while after they finish
+	jobs *jobStore
+	// serving counts the listeners accepting connections
+	serving atomic.Int32
 }
 
 type TCPServerParams struct {
+	// Listeners are already open listeners, e.g. inherited from a previous process. The server takes ownership of them.
+	Listeners []net.Listener
+	// Listen is a list of listener specs such as tcp://127.0.0.1:3000 or unix:///run/tcp-server.sock.
+	// When both Listen and Listeners are empty we listen on Address.
+	Listen []string
+	// Address to listen on, e.g. 127.0.0.1:3000. When empty we listen on all interfaces on Port.
+	Address      string
 	Port         int
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+	// DrainTimeout is how long Stop waits for in-flight tasks before killing them, 0 waits forever
+	DrainTimeout time.Duration
+	// MaxFrameSize is the largest request in bytes, 0 means 1 MiB
+	MaxFrameSize int
 	Executor     executor.TaskExecutor
 	WaitGroup    *sync.WaitGroup
 	RateLimiter  ratelimit.RateLimiter
+	// Tokens are the credentials a request has to carry one of, empty lets every request in
+	Tokens []string
+	// RunAs are the run_as values a request may ask for, empty refuses every request with one
+	RunAs []string
+	// Logger is used for everything the server logs, nil means slog.Default()
+	Logger *slog.Logger
+	// Audit receives a record before and after every task, nil turns auditing off
+	Audit audit.Sink
+	// AuditFailClosed refuses to run a task when its audit record can't be written
+	AuditFailClosed bool
+	// JobRetention is how long a finished job can still be asked about, 0 means 10 minutes
+	JobRetention time.Duration
+	// MaxJobsPerClient caps the jobs a client can have running at once, 0 means 100
+	MaxJobsPerClient int
+	// Certificate serves the connections over TLS, nil serves them as plain text
+	Certificate *tls.Certificate
 }
 
 func NewTCPServer(params TCPServerParams) (*TCPServer, error) {
-	// Create a tcp listener
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", params.Port))
-	if err != nil {
-		return nil, fmt.Errorf("error listening: %w", err)
+	// Work out what we are listening on
+	specs := params.Listen
+	if len(specs) == 0 && len(params.Listeners) == 0 {
+		address := params.Address
+		if address == "" {
+			address = fmt.Sprintf(":%d", params.Port)
+		}
+		specs = []string{address}
+	}
+
+	// Create all the listeners, if one fails we close the ones we already opened
+	listeners := append([]net.Listener{}, params.Listeners...)
+	for _, s := range specs {
+		spec, err := listener.ParseSpec(s)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		l, err := listener.Listen(spec)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("error listening on %s: %w", spec, err)
+		}
+		listeners = append(listeners, l)
 	}
 
 	// If there is not waitgroup assinged, then we will assign it one
@@ -48,57 +134,149 @@ func NewTCPServer(params TCPServerParams) (*TCPServer, error) {
 		params.WaitGroup = &sync.WaitGroup{}
 	}
 
+	if params.Logger == nil {
+		params.Logger = slog.Default()
+	}
+
+	if params.MaxFrameSize <= 0 {
+		params.MaxFrameSize = constant.DefaultMaxFrameSize
+	}
+
+	tasksCtx, cancelTasks := context.WithCancel(context.Background())
 	ts := TCPServer{
-		listener:     listener,
-		readTimeout:  params.ReadTimeout,
-		writeTimeout: params.WriteTimeout,
-		executor:     params.Executor,
-		wg:           params.WaitGroup,
-		rateLimiter:  params.RateLimiter,
+		listeners:       listeners,
+		readTimeout:     params.ReadTimeout,
+		writeTimeout:    params.WriteTimeout,
+		drainTimeout:    params.DrainTimeout,
+		maxFrameSize:    params.MaxFrameSize,
+		tokens:          params.Tokens,
+		runAs:           params.RunAs,
+		tasksCtx:        tasksCtx,
+		cancelTasks:     cancelTasks,
+		drain:           newDrainState(),
+		registry:        newRegistry(),
+		jobs:            newJobStore(params.JobRetention, params.MaxJobsPerClient),
+		executor:        params.Executor,
+		wg:              params.WaitGroup,
+		logger:          params.Logger,
+		audit:           params.Audit,
+		auditFailClosed: params.AuditFailClosed,
+		certificate:     params.Certificate,
 	}
 
+	ts.setRateLimiter(params.RateLimiter)
+	if params.Certificate != nil {
+		ts.tlsConfig = ts.newTLSConfig()
+	}
 	return &ts, nil
 }
 
 func (s *TCPServer) Start(ctx context.Context) {
-	// Get ready to close the server when we end this function
-	defer s.listener.Close()
-	log.Printf("Server listening on %s", s.listener.Addr())
+	// Cancelling the start context kills every running task straight away
+	stop := context.AfterFunc(ctx, s.cancelTasks)
+	defer stop()
+	addRunningServer(s)
+	defer removeRunningServer(s)
+
+	// Asynchronously run a cleanup on our rate limiter
+	go s.handleRateLimitCleanup(ctx)
 
-	// Asynchronously run a cleanup on our rate limiter if we have one assigned.
-	if s.rateLimiter != nil {
-		go s.handleRateLimitCleanup(ctx)
+	// Accept connections on every listener until they are all closed
+	var wg sync.WaitGroup
+	for _, l := range s.listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			s.serve(ctx, l)
+		}(l)
 	}
+	wg.Wait()
+}
 
+func (s *TCPServer) serve(ctx context.Context, l net.Listener) {
+	// Get ready to close the listener when we end this function
+	defer l.Close()
+	s.serving.Add(1)
+	defer s.serving.Add(-1)
+	s.logger.Info("server listening", "network", l.Addr().Network(), "address", l.Addr().String())
+	s.accept(ctx, l)
+}
+
+// accept hands every connection from l to handleConnection until l is closed
+func (s *TCPServer) accept(ctx context.Context, l net.Listener) {
 	for {
 		// Look out for any client connections
-		conn, err := s.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				log.Printf("listener closed: %v", err)
+				s.logger.Info("listener closed", "address", l.Addr().String(), "error", err)
 				return
 			}
 		}
 
+		connectionsAccepted.Inc()
+		// The handshake happens on the connection's first read, so a slow client doesn't hold up accepting
+		if s.tlsConfig != nil {
+			conn = tls.Server(conn, s.tlsConfig)
+		}
 		// Add to our waitgroup a new process that will be running
 		s.wg.Add(1)
-		// Asynchronously handle the incoming connection
-		go s.handleConnection(ctx, conn)
+		// Asynchronously handle the incoming connection. Tasks run under the server's own context
+		// so they can outlive the listener while we drain.
+		go s.handleConnection(s.tasksCtx, conn)
 	}
 }
 
+// Stop drains the server, waiting up to the drain timeout for in-flight tasks
 func (s *TCPServer) Stop() {
-	s.listener.Close()
-	s.wg.Wait()
+	ctx := context.Background()
+	if drainTimeout := s.DrainTimeout(); drainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, drainTimeout)
+		defer cancel()
+	}
+	_ = s.Shutdown(ctx)
 }
 
+// Addr returns the address of the first listener
 func (s *TCPServer) Addr() net.Addr {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.listener.Addr()
+	return s.listeners[0].Addr()
+}
+
+// Addrs returns the addresses of all the listeners
+func (s *TCPServer) Addrs() []net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// Errors returned by Ready
+var (
+	ErrNotListening = errors.New("not accepting connections on every listener")
+	ErrDraining     = errors.New("draining")
+)
+
+// Ready reports whether every listener is accepting connections and we are not draining
+func (s *TCPServer) Ready() error {
+	if s.drain.isDraining() {
+		return ErrDraining
+	}
+	s.mu.RLock()
+	listeners := len(s.listeners)
+	s.mu.RUnlock()
+	if int(s.serving.Load()) < listeners {
+		return ErrNotListening
+	}
+	return nil
 }
 
 func (s *TCPServer) ReadTimeout() time.Duration {
@@ -113,81 +291,544 @@ func (s *TCPServer) WriteTimeout() time.Duration {
 	return s.writeTimeout
 }
 
-func (s *TCPServer) handleConnection(ctx context.Context, conn net.Conn) {
+func (s *TCPServer) RateLimiter() ratelimit.RateLimiter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rateLimiter
+}
+
+// setRateLimiter swaps the rate limiter, the caller holds s.mu
+func (s *TCPServer) setRateLimiter(rateLimiter ratelimit.RateLimiter) {
+	s.rateLimiter = rateLimiter
+	s.rateLimitTracker = nil
+	if rateLimiter == nil {
+		return
+	}
+	tracker, ok := rateLimiter.(ratelimit.Tracker)
+	if !ok {
+		s.logger.Warn("rate limiter can't report the clients it tracks, tcp_server_ratelimit_tracked_ips leaves it out")
+		return
+	}
+	s.rateLimitTracker = tracker
+}
+
+func (s *TCPServer) currentRateLimitTracker() ratelimit.Tracker {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rateLimitTracker
+}
+
+func (s *TCPServer) DrainTimeout() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.drainTimeout
+}
+
+func (s *TCPServer) MaxFrameSize() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maxFrameSize
+}
+
+// TCPServerSettings are the settings that can be changed while the server is running
+type TCPServerSettings struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	DrainTimeout time.Duration
+	// MaxFrameSize is the largest request in bytes, 0 means 1 MiB
+	MaxFrameSize int
+	RateLimiter  ratelimit.RateLimiter
+	Tokens       []string
+	RunAs        []string
+	// Certificate replaces the one new TLS connections are served with, nil keeps it
+	Certificate *tls.Certificate
+}
+
+// Reconfigure swaps the settings in one step. Connections that are already open
+// keep running and pick up the new values on their next request.
+func (s *TCPServer) Reconfigure(settings TCPServerSettings) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readTimeout = settings.ReadTimeout
+	s.writeTimeout = settings.WriteTimeout
+	s.drainTimeout = settings.DrainTimeout
+	s.maxFrameSize = settings.MaxFrameSize
+	if s.maxFrameSize <= 0 {
+		s.maxFrameSize = constant.DefaultMaxFrameSize
+	}
+	s.setRateLimiter(settings.RateLimiter)
+	s.tokens = settings.Tokens
+	s.runAs = settings.RunAs
+	// TLS can't be turned on or off without a restart, so only a new certificate is taken
+	if settings.Certificate != nil {
+		s.certificate = settings.Certificate
+	}
+}
+
+func (s *TCPServer) handleConnection(ctx context.Context, rawConn net.Conn) {
+	conn := newClientConn(rawConn)
 	defer conn.Close()
 	defer s.wg.Done()
 
-	// Get the IP Address without the port if they have one. (Limits malicious actors from requesting from different ports)
-	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	// Keep track of the connection so we can close it once we are drained
+	s.drain.addConn(conn)
+	defer s.drain.removeConn(conn)
+	connectionsActive.Inc()
+	defer connectionsActive.Dec()
+
+	ctx, connSpan := tracer().Start(ctx, "connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(tracing.AttrNetwork.String(conn.LocalAddr().Network())),
+	)
+	defer connSpan.End()
+	connID := logging.NewID()
+	logger := s.logger.With("conn_id", connID)
+	s.registry.addConn(ConnectionInfo{
+		ID:          connID,
+		Network:     conn.LocalAddr().Network(),
+		LocalAddr:   conn.LocalAddr().String(),
+		RemoteAddr:  conn.RemoteAddr().String(),
+		ConnectedAt: time.Now(),
+	})
+	defer s.registry.removeConn(connID)
+
+	// Identify the client, the IP without the port for tcp or the peer's uid for unix sockets
+	peer, err := listener.PeerOf(rawConn)
 	if err != nil {
-		log.Printf("Error parsing remote address: %v", err)
+		logger.Warn("cannot identify client", "error", err)
+		connectionsRejected.WithLabelValues(reasonUnidentified).Inc()
+		connSpan.SetStatus(codes.Error, err.Error())
 		return
 	}
+	client := peer.Identity()
+	connSpan.SetAttributes(tracing.AttrPeer.String(client))
+	logger = logger.With(peerAttrs(peer)...)
+	s.registry.setClient(connID, client)
+	ctx = logging.NewContext(ctx, logger)
+	logger.Debug("connection accepted")
 
-	// Check if the ip is rate limited or not
-	if !s.rateLimiter.Allow(ip) {
-		log.Printf("Rate limit exceeded for IP: %s", ip)
+	// Check if the client is rate limited or not, and tell it so it knows to back off
+	if !s.allow(ctx, client) {
+		logger.Warn("rate limit exceeded")
+		connectionsRejected.WithLabelValues(outcomeRateLimited).Inc()
+		requestsTotal.WithLabelValues(outcomeRateLimited).Inc()
+		connSpan.SetStatus(codes.Error, outcomeRateLimited)
+		s.writeMessage(ctx, conn, &model.TaskResult{ExitCode: -1, Error: constant.TaskResultRateLimitedError})
 		return
 	}
 
 	// Start extracting the information, lets run this until our cancel context is activated.
-	scanner := bufio.NewScanner(conn)
 	for ctx.Err() == nil {
 		// set a reading deadline
-		if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
-			log.Printf("Error setting read deadline: %v", err)
+		reading, err := s.drain.setReadDeadline(conn, s.ReadTimeout())
+		if err != nil {
+			logger.Error("cannot set read deadline", "error", err)
+			return
+		}
+		// we are done draining and closing the connections
+		if !reading {
 			return
 		}
-		// wait for a message with a new line
-		if !scanner.Scan() {
-			if err := scanner.Err(); err != nil {
-				if err != io.EOF {
-					log.Printf("Error reading from connection: %v", err)
+		// wait for a whole message
+		b, err := conn.nextFrame(s.MaxFrameSize())
+		if errors.Is(err, errFrameTooLarge) {
+			logger.Warn("request too large", "outcome", outcomeFrameTooLarge, "max_frame_size", s.MaxFrameSize())
+			requestsTotal.WithLabelValues(outcomeFrameTooLarge).Inc()
+			s.writeMessage(ctx, conn, &model.TaskResult{ExitCode: -1, Error: constant.TaskResultFrameTooLargeError})
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !s.drain.isDraining() {
+				logger.Warn("cannot read from connection", "error", err)
+				// Length prefixed clients would take the text for a frame header
+				if !conn.lengthPrefixed {
+					conn.writeText(err.Error())
 				}
-				fmt.Fprint(conn, err)
 			}
 			return
 		}
-		b := scanner.Bytes()
-		// Unmarshal the incoming request. We expect only the TaskRequest json
-		var request model.TaskRequest
-		if err := json.Unmarshal(b, &request); err != nil {
-			err := fmt.Sprintf("Error parsing request: %v", err)
-			log.Print(err)
-			fmt.Fprint(conn, err)
+		// Unmarshal the incoming request
+		request, err := parseRequest(ctx, conn.codec, b)
+		if err != nil {
+			logger.Warn("cannot parse request", "outcome", outcomeParseError, "error", err)
+			// Line framed JSON clients have always been told in plain text, framed
+			// and binary ones need a message in their codec
+			if conn.lengthPrefixed {
+				s.writeMessage(ctx, conn, &model.TaskResult{ExitCode: -1, Error: constant.TaskResultParseError})
+			} else {
+				conn.writeText(fmt.Sprintf("Error parsing request: %v", err))
+			}
+			requestsTotal.WithLabelValues(outcomeParseError).Inc()
 			return
 		}
+		info := requestInfo{connID: connID, requestID: logging.NewID(), client: client}
+		reqLogger := logger.With("request_id", info.requestID, "command", request.Command)
+		reqCtx := logging.NewContext(ctx, reqLogger)
 
-		if request.Timeout > 0 {
-			// Create a timeout with the new timeout
-			var cancel context.CancelFunc
-			ctx, cancel = context.WithTimeout(ctx, time.Duration(request.Timeout)*time.Millisecond)
-			defer cancel()
+		// Switching the framing needs no credentials, the reply goes out in the old framing
+		switch request.Type {
+		case model.RequestFraming:
+			s.handleFraming(reqCtx, conn, request)
+			continue
+		case model.RequestHello:
+			s.handleHello(reqCtx, conn, request)
+			continue
 		}
-		// Execute the task
-		result := s.executor.ExecuteTask(ctx, &request)
 
-		// Set a writing deadline
-		if err := conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
-			log.Printf("Error setting write deadline: %v", err)
-			return
+		// Only let in requests with valid credentials
+		if !s.authorized(request.Token) {
+			reqLogger.Warn("refusing request with invalid token", "outcome", outcomeUnauthorized)
+			requestsTotal.WithLabelValues(outcomeUnauthorized).Inc()
+			s.writeMessage(reqCtx, conn, refused(request, constant.TaskResultUnauthorizedError))
+			continue
 		}
 
-		// Unmarshal the result from executing the task
-		response, err := json.Marshal(result)
-		if err != nil {
-			err := fmt.Sprintf("Error marshaling response: %v", err)
-			log.Print(err)
-			fmt.Fprint(conn, err)
+		// Only run tasks as the users the policy allows
+		if !s.permitted(request) {
+			reqLogger.Warn("refusing request to run as another user", "run_as", request.RunAs, "outcome", outcomeForbidden)
+			requestsTotal.WithLabelValues(outcomeForbidden).Inc()
+			s.writeMessage(reqCtx, conn, refused(request, constant.TaskResultForbiddenError))
+			continue
+		}
+
+		// Tasks and jobs need something to run, whichever transport they come in on
+		if missingCommand(request) {
+			reqLogger.Warn("refusing request without a command", "outcome", outcomeInvalidRequest)
+			requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+			s.writeMessage(reqCtx, conn, refused(request, constant.TaskResultCommandNilError))
 			continue
 		}
 
-		// Write out the marshalled response.
-		if _, err := conn.Write(response); err != nil {
-			log.Printf("Error sending response: %v", err)
-			fmt.Fprintf(conn, "Error sending response: %v", err)
+		if request.OutputEncoding != "" && request.OutputEncoding != model.OutputEncodingBase64 {
+			reqLogger.Warn("unknown output encoding", "output_encoding", request.OutputEncoding, "outcome", outcomeInvalidRequest)
+			requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+			s.writeMessage(reqCtx, conn, refused(request, constant.TaskResultInvalidRequestError))
 			continue
 		}
+
+		if !s.sessionAllowed(request) {
+			reqLogger.Warn("cannot give task the connection", "type", request.Type, "interactive", request.Interactive, "stdin", request.Stdin, "outcome", outcomeInvalidRequest)
+			requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+			s.writeMessage(reqCtx, conn, refused(request, constant.TaskResultInvalidRequestError))
+			continue
+		}
+
+		switch request.Type {
+		case "", model.RequestRun:
+			if !s.handleRun(reqCtx, conn, info, request) {
+				return
+			}
+		case model.RequestSubmit:
+			if !s.handleSubmit(reqCtx, conn, info, request) {
+				return
+			}
+		case model.RequestStatus, model.RequestCancel, model.RequestJobs:
+			s.handleJobRequest(reqCtx, conn, info, request)
+		default:
+			reqLogger.Warn("unknown request type", "type", request.Type, "outcome", outcomeInvalidRequest)
+			requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+			s.writeMessage(reqCtx, conn, refused(request, constant.TaskResultInvalidRequestError))
+		}
+	}
+}
+
+// handleRun runs the task and answers with its result, after streaming the
+// output if the request asked for it. The connection is read for the input of
+// an interactive task or one with stdin while it runs. It reports false when
+// the connection should be closed.
+func (s *TCPServer) handleRun(ctx context.Context, conn *clientConn, info requestInfo, request *model.TaskRequest) bool {
+	// Refuse new work once we are shutting down
+	if !s.drain.beginTask() {
+		logging.FromContext(ctx, s.logger).Info("refusing request while shutting down", "outcome", outcomeShuttingDown)
+		requestsTotal.WithLabelValues(outcomeShuttingDown).Inc()
+		s.writeMessage(ctx, conn, refused(request, constant.TaskResultShuttingDownError))
+		return false
+	}
+	// Send back the result before we count the task as done
+	defer s.drain.endTask()
+
+	// Kill the task when the transport notices the client went away, like a closed WebSocket
+	if notifier, ok := conn.Conn.(closeNotifier); ok {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = killWhen(ctx, notifier.Closed())
+		defer cancel(nil)
+	}
+
+	// An interactive task's output is its terminal, so it is always streamed
+	var session *taskSession
+	if request.Interactive || request.Stdin {
+		request.Stream = request.Stream || request.Interactive
+		session = s.startSession(ctx, conn, request)
+		ctx = session.ctx
+	}
+
+	var output executor.OutputFunc
+	if request.Stream {
+		output = func(stream string, data []byte) {
+			frame := &model.OutputFrame{Type: model.MessageOutput, Stream: stream}
+			frame.Data, frame.Encoding = encodeOutput(conn.codec, request, data)
+			s.writeMessage(ctx, conn, frame)
+		}
+	}
+	result := encodeResult(conn.codec, request, s.execute(ctx, info, request, output, session.taskInput()))
+	session.end()
+	if request.Stream {
+		result.Type = model.MessageResult
+	}
+	s.writeMessage(ctx, conn, result)
+	return true
+}
+
+// killWhen returns a context that is cancelled like a killed task once done is
+// closed. The returned cancel has to be called when the task is over.
+func killWhen(ctx context.Context, done <-chan struct{}) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-done:
+			cancel(errTaskKilled)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// execute runs a task the drain has let in. Tasks are audited, traced, logged
+// and counted the same way however they were requested. With input the task
+// reads from the connection, which the executor has to be able to do.
+func (s *TCPServer) execute(ctx context.Context, info requestInfo, request *model.TaskRequest, output executor.OutputFunc, input *taskInput) *model.TaskResult {
+	logger := logging.FromContext(ctx, s.logger)
+
+	// Don't run anything we can't account for
+	if !s.auditExec(info, request) {
+		logger.Warn("refusing request, audit log unavailable", "outcome", outcomeAuditFailed)
+		requestsTotal.WithLabelValues(outcomeAuditFailed).Inc()
+		return refused(request, constant.TaskResultAuditError)
+	}
+
+	// Streamed output never makes it into the result, so hash it on its way to the client
+	var outputHash hash.Hash
+	if output != nil && s.audit != nil {
+		outputHash = sha256.New()
+		send := output
+		output = func(stream string, data []byte) {
+			outputHash.Write(data)
+			send(stream, data)
+		}
+	}
+
+	taskCtx, span := startTaskSpan(ctx, request)
+	result := s.runTask(taskCtx, info, request, output, input)
+	endTaskSpan(span, result)
+	outcome := resultOutcome(result)
+	attrs := []any{"outcome", outcome, "exit_code", result.ExitCode, "duration_ms", result.DurationMs}
+	if result.Error != "" {
+		attrs = append(attrs, "error", result.Error)
+	}
+	logger.Info("task finished", attrs...)
+	s.auditResult(info, result, outputHash)
+	requestsTotal.WithLabelValues(outcome).Inc()
+	return result
+}
+
+// handleFraming switches the connection to the framing the client asked for
+// once it has been told, in the framing it used to ask
+func (s *TCPServer) handleFraming(ctx context.Context, conn *clientConn, request *model.TaskRequest) {
+	switch {
+	case request.Framing == model.FramingLengthPrefixed:
+	case request.Framing == model.FramingLine && !conn.codec.Binary():
+	default:
+		logging.FromContext(ctx, s.logger).Warn("unusable framing", "framing", request.Framing, "codec", conn.codec.Name(), "outcome", outcomeInvalidRequest)
+		requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+		s.writeMessage(ctx, conn, refused(request, constant.TaskResultInvalidRequestError))
+		return
+	}
+	s.writeMessage(ctx, conn, &model.Framing{
+		Type:         model.MessageFraming,
+		Framing:      request.Framing,
+		MaxFrameSize: s.MaxFrameSize(),
+	})
+	conn.setFraming(request.Framing)
+	logging.FromContext(ctx, s.logger).Debug("framing changed", "framing", request.Framing)
+}
+
+// refused is the result of a request that was turned down before running
+func refused(request *model.TaskRequest, code string) *model.TaskResult {
+	result := &model.TaskResult{
+		Command:  request.Command,
+		ExitCode: -1,
+		Error:    code,
+	}
+	if request.Stream {
+		result.Type = model.MessageResult
+	}
+	return result
+}
+
+// allow checks the client against the current rate limiter
+func (s *TCPServer) allow(ctx context.Context, client string) bool {
+	_, span := tracer().Start(ctx, "ratelimit")
+	defer span.End()
+	allowed := true
+	if rateLimiter := s.RateLimiter(); rateLimiter != nil {
+		allowed = rateLimiter.Allow(client)
+	}
+	span.SetAttributes(tracing.AttrAllowed.Bool(allowed))
+	return allowed
+}
+
+// authorized checks the request's token against the configured ones
+func (s *TCPServer) authorized(token string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.tokens) == 0 {
+		return true
+	}
+	valid := false
+	// Compare against every token so the time taken doesn't tell which one matched
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// permitted reports whether the policy lets the request run as the user it asks for
+func (s *TCPServer) permitted(request *model.TaskRequest) bool {
+	if request.RunAs == "" {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Contains(s.runAs, request.RunAs)
+}
+
+// missingCommand reports whether a task or job request has nothing to run, the other requests need no command
+func missingCommand(request *model.TaskRequest) bool {
+	switch request.Type {
+	case "", model.RequestRun, model.RequestSubmit:
+		return len(request.Command) == 0
+	}
+	return false
+}
+
+// parseRequest unmarshals a request frame. We expect only a TaskRequest
+func parseRequest(ctx context.Context, c codec.Codec, b []byte) (*model.TaskRequest, error) {
+	_, span := tracer().Start(ctx, "parse")
+	defer span.End()
+	var request model.TaskRequest
+	if err := c.Unmarshal(b, &request); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	return &request, nil
+}
+
+// runTask runs the task so that it shows up in Tasks and can be killed with KillTask
+func (s *TCPServer) runTask(ctx context.Context, info requestInfo, request *model.TaskRequest, output executor.OutputFunc, input *taskInput) *model.TaskResult {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	s.registry.addTask(TaskInfo{
+		RequestID: info.requestID,
+		ConnID:    info.connID,
+		Client:    info.client,
+		Command:   request.Command,
+		Timeout:   request.Timeout,
+		StartedAt: time.Now(),
+	}, cancel)
+	defer s.registry.removeTask(info.requestID)
+
+	result := s.executeTask(ctx, request, output, input)
+	if errors.Is(context.Cause(ctx), errTaskKilled) {
+		result.ExitCode = -1
+		result.Error = constant.TaskResultKilledError
+	}
+	return result
+}
+
+func (s *TCPServer) executeTask(ctx context.Context, request *model.TaskRequest, output executor.OutputFunc, input *taskInput) *model.TaskResult {
+	if request.Timeout > 0 {
+		// Create a timeout with the new timeout
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(request.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+	switch {
+	case input != nil && input.terminal != nil:
+		return s.executor.(executor.InteractiveExecutor).ExecuteTaskInteractive(ctx, request, input.terminal, output)
+	case input != nil:
+		return s.executor.(executor.StdinExecutor).ExecuteTaskStdin(ctx, request, input.stdin, output)
+	}
+	if output == nil {
+		return s.executor.ExecuteTask(ctx, request)
+	}
+	if streaming, ok := s.executor.(executor.StreamingExecutor); ok {
+		return streaming.ExecuteTaskStream(ctx, request, output)
+	}
+
+	// The executor can't stream, so pass on all the output at the end
+	result := s.executor.ExecuteTask(ctx, request)
+	if len(result.Output) > 0 {
+		output(model.StreamStdout, result.Output)
+		result.Output = nil
+	}
+	return result
+}
+
+// peerAttrs are the log attributes that identify the client
+func peerAttrs(peer listener.Peer) []any {
+	if peer.Unix {
+		return []any{"peer_uid", peer.UID, "peer_pid", peer.PID}
+	}
+	return []any{"remote_ip", peer.IP}
+}
+
+// resultOutcome sorts a task result into one of the outcomes we report
+func resultOutcome(result *model.TaskResult) string {
+	switch {
+	case result.Error == constant.TaskResultTimeoutError:
+		return outcomeTimeout
+	case result.Error == constant.TaskResultKilledError:
+		return outcomeKilled
+	case result.Error == constant.TaskResultRootNotAllowedError:
+		return outcomeForbidden
+	case result.ExitCode > 0:
+		return outcomeNonZeroExit
+	case result.ExitCode < 0 || result.Error != "":
+		return outcomeError
+	default:
+		return outcomeSuccess
+	}
+}
+
+// writeMessage sends a TaskResult, OutputFrame or JobStatus to the client
+func (s *TCPServer) writeMessage(ctx context.Context, conn *clientConn, message any) {
+	logger := logging.FromContext(ctx, s.logger)
+	// Set a writing deadline
+	if err := conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout())); err != nil {
+		logger.Error("cannot set write deadline", "error", err)
+		return
+	}
+
+	// Marshal the message
+	response, err := conn.codec.Marshal(message)
+	if err != nil {
+		logger.Error("cannot marshal response", "error", err)
+		conn.writeText(fmt.Sprintf("Error marshaling response: %v", err))
+		return
+	}
+
+	// Write out the marshalled response.
+	if err := conn.writeFrame(response); err != nil {
+		logger.Warn("cannot send response", "error", err)
+		conn.writeText(fmt.Sprintf("Error sending response: %v", err))
+	}
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
 	}
 }
 
@@ -201,7 +842,10 @@ func (s *TCPServer) handleRateLimitCleanup(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			s.rateLimiter.Clean()
+			// The rate limiter can be swapped by Reconfigure, so always clean the current one
+			if rateLimiter := s.RateLimiter(); rateLimiter != nil {
+				rateLimiter.Clean()
+			}
 		}
 	}
 }
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/logging"
+	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// taskInput is what a task that has the connection to itself reads while it
+// runs, typed into its terminal or written to its stdin
+type taskInput struct {
+	terminal <-chan executor.TerminalInput
+	stdin    io.Reader
+}
+
+// interactive reports whether the executor can run tasks in a terminal
+func (s *TCPServer) interactive() bool {
+	_, ok := s.executor.(executor.InteractiveExecutor)
+	return ok
+}
+
+// feedsStdin reports whether the executor can write to a task's stdin while it runs
+func (s *TCPServer) feedsStdin() bool {
+	_, ok := s.executor.(executor.StdinExecutor)
+	return ok
+}
+
+// sessionAllowed reports whether the task the request asks for can have the
+// connection to itself. Only a task that is run can, for either a terminal or
+// its stdin, and only when the executor can give it them.
+func (s *TCPServer) sessionAllowed(request *model.TaskRequest) bool {
+	switch {
+	case !request.Interactive && !request.Stdin:
+		return true
+	case request.Type != "" && request.Type != model.RequestRun, request.Interactive && request.Stdin:
+		return false
+	case request.Interactive:
+		return s.interactive()
+	default:
+		return s.feedsStdin()
+	}
+}
+
+// taskSession gives the connection to an interactive task or one reading its
+// stdin until the task is over. The requests read meanwhile go to the task.
+type taskSession struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	input  *taskInput
+	stdin  *io.PipeReader
+	// done is closed once the task is over, whatever is read after it is the next request
+	done chan struct{}
+}
+
+// startSession starts reading the connection for the task the request runs.
+// The session's context is cancelled like a killed task when the connection
+// can't be read, a client that went away can't answer it.
+func (s *TCPServer) startSession(ctx context.Context, conn *clientConn, request *model.TaskRequest) *taskSession {
+	session := &taskSession{done: make(chan struct{})}
+	session.ctx, session.cancel = context.WithCancelCause(ctx)
+	var handle func(*model.TaskRequest) bool
+	if request.Interactive {
+		terminal := make(chan executor.TerminalInput)
+		session.input = &taskInput{terminal: terminal}
+		handle = session.typeInto(terminal)
+	} else {
+		r, w := io.Pipe()
+		session.stdin = r
+		session.input = &taskInput{stdin: r}
+		handle = writeStdin(w)
+	}
+
+	// The client may take its time to type, the connection is read until the task is over
+	if err := s.drain.clearReadDeadline(conn); err != nil {
+		logging.FromContext(ctx, s.logger).Error("cannot clear read deadline", "error", err)
+	}
+	conn.carried = make(chan carriedFrame, 1)
+	go s.readSession(session, conn, handle)
+	return session
+}
+
+// taskInput is nil without a session, for tasks that read nothing
+func (session *taskSession) taskInput() *taskInput {
+	if session == nil {
+		return nil
+	}
+	return session.input
+}
+
+// end hands the connection back before the result goes out. A write to stdin
+// the task will never read is given up.
+func (session *taskSession) end() {
+	if session == nil {
+		return
+	}
+	close(session.done)
+	if session.stdin != nil {
+		session.stdin.Close()
+	}
+	session.cancel(nil)
+}
+
+// readSession passes the requests on the connection to handle until the
+// session is done. A cancel without a job id kills the task. handle reports
+// false for those that aren't for the task, which are refused so the client
+// isn't left waiting for an answer. The first frame read after the session,
+// or the read error, is left in conn.carried for the connection's loop.
+func (s *TCPServer) readSession(session *taskSession, conn *clientConn, handle func(*model.TaskRequest) bool) {
+	logger := logging.FromContext(session.ctx, s.logger)
+	for {
+		b, err := conn.readFrame(s.MaxFrameSize())
+		if err != nil {
+			session.cancel(errTaskKilled)
+			conn.carried <- carriedFrame{err: err}
+			return
+		}
+		request, err := parseRequest(session.ctx, conn.codec, b)
+		if err == nil {
+			err = decodeData(request)
+		}
+		if err == nil && request.Type == model.RequestCancel && request.JobID == "" {
+			logger.Info("task cancelled by the client")
+			session.cancel(errTaskKilled)
+			continue
+		}
+		if err == nil && handle(request) {
+			continue
+		}
+		select {
+		case <-session.done:
+			// The next request, the connection's loop answers it
+			conn.carried <- carriedFrame{b: b}
+			return
+		default:
+		}
+		// The answer goes out in the connection's codec whatever the framing,
+		// plain text would break up the output around it
+		switch {
+		case request == nil:
+			logger.Warn("cannot parse request during session", "outcome", outcomeParseError, "error", err)
+			requestsTotal.WithLabelValues(outcomeParseError).Inc()
+			s.writeMessage(session.ctx, conn, &model.TaskResult{ExitCode: -1, Error: constant.TaskResultParseError})
+		case err != nil:
+			logger.Warn("refusing invalid request during session", "outcome", outcomeInvalidRequest, "error", err)
+			requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+			s.writeMessage(session.ctx, conn, refused(request, constant.TaskResultInvalidRequestError))
+		default:
+			logger.Warn("refusing request during session", "type", request.Type, "outcome", outcomeInvalidRequest)
+			requestsTotal.WithLabelValues(outcomeInvalidRequest).Inc()
+			s.writeMessage(session.ctx, conn, refused(request, constant.TaskResultInvalidRequestError))
+		}
+	}
+}
+
+// typeInto passes input and resize requests on to an interactive task's terminal
+func (session *taskSession) typeInto(terminal chan<- executor.TerminalInput) func(*model.TaskRequest) bool {
+	return func(request *model.TaskRequest) bool {
+		var in executor.TerminalInput
+		switch request.Type {
+		case model.RequestInput:
+			in.Data = request.Data
+		case model.RequestResize:
+			in.Window = request.Window
+		default:
+			return false
+		}
+		select {
+		case terminal <- in:
+		case <-session.done:
+			// Came in as the task exited, there is nothing left to type into
+		}
+		return true
+	}
+}
+
+// writeStdin writes stdin requests to the task's stdin and closes it on an eof
+// request. A write only returns once the task has read it, so a client
+// sending faster than the task reads is held back by the connection rather
+// than buffered here.
+func writeStdin(w *io.PipeWriter) func(*model.TaskRequest) bool {
+	return func(request *model.TaskRequest) bool {
+		switch request.Type {
+		case model.RequestStdin:
+			// Fails once stdin is closed or the task is over, there is nobody left to tell
+			_, _ = w.Write(request.Data)
+		case model.RequestEOF:
+			w.Close()
+		default:
+			return false
+		}
+		return true
+	}
+}
+
+// decodeData decodes the data of a request that comes base64 encoded
+func decodeData(request *model.TaskRequest) error {
+	switch request.Encoding {
+	case "":
+		return nil
+	case model.OutputEncodingBase64:
+	default:
+		return fmt.Errorf("unknown encoding %q", request.Encoding)
+	}
+	data, err := base64.StdEncoding.DecodeString(string(request.Data))
+	if err != nil {
+		return err
+	}
+	request.Data, request.Encoding = data, ""
+	return nil
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// LoadCertificate reads a PEM encoded certificate and key to serve connections over TLS
+func LoadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading tls certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// Certificate is the certificate new TLS connections are served with, nil when they are plain text
+func (s *TCPServer) Certificate() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.certificate
+}
+
+// newTLSConfig looks the certificate up on every handshake, so one swapped in
+// by Reconfigure is served along with the rest of the new settings
+func (s *TCPServer) newTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.Certificate(), nil
+		},
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+
+	"github.com/Oyal2/tcp-server/internal/tracing"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer looks up the tracer on every call, a tracer taken from the global
+// provider up front would stick to the first provider that is installed
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/Oyal2/tcp-server/internal/server")
+}
+
+// startTaskSpan starts the span covering one request. When the client sent a
+// traceparent the span joins the client's trace and links back to the
+// connection, otherwise it is a child of the connection span.
+func startTaskSpan(ctx context.Context, request *model.TaskRequest) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(
+			tracing.AttrCommand.StringSlice(request.Command),
+			tracing.AttrTimeoutMs.Int(request.Timeout),
+		),
+	}
+	parent := tracing.Extract(ctx, request.TraceParent)
+	if remote := trace.SpanContextFromContext(parent); remote.IsRemote() {
+		opts = append(opts, trace.WithLinks(trace.LinkFromContext(ctx)))
+	}
+	return tracer().Start(parent, "task", opts...)
+}
+
+// endTaskSpan records the result of the task on its span
+func endTaskSpan(span trace.Span, result *model.TaskResult) {
+	span.SetAttributes(tracing.AttrExitCode.Int(result.ExitCode))
+	if result.Error != "" {
+		span.SetAttributes(tracing.AttrError.String(result.Error))
+		span.SetStatus(codes.Error, result.Error)
+	}
+	span.End()
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coder/websocket"
+)
+
+var _ Server = (*WebSocketServer)(nil)
+
+// WebSocketServer carries the TCP protocol over WebSockets for browsers. The
+// sockets are handed to the TCPServer as connections like any other, so
+// requests are framed, authorized, rate limited and drained the same way.
+type WebSocketServer struct {
+	server   *TCPServer
+	listener net.Listener
+	http     *http.Server
+	// conns passes the upgraded sockets on to the TCPServer
+	conns *connListener
+	// originPatterns are the hosts besides our own browsers may connect from
+	originPatterns []string
+}
+
+type WebSocketServerParams struct {
+	// Listener is an already open listener, e.g. inherited from a previous process. The server takes ownership of it.
+	Listener net.Listener
+	// Address to listen on when there is no Listener, e.g. 127.0.0.1:8081
+	Address string
+	// Server handles the sockets like its own connections
+	Server *TCPServer
+	// OriginPatterns are the hosts besides the server's own that browsers may connect from, e.g. dashboard.example.com
+	OriginPatterns []string
+}
+
+func NewWebSocketServer(params WebSocketServerParams) (*WebSocketServer, error) {
+	l := params.Listener
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", params.Address); err != nil {
+			return nil, fmt.Errorf("error listening on %s: %w", params.Address, err)
+		}
+	}
+	ws := &WebSocketServer{
+		server:         params.Server,
+		listener:       l,
+		conns:          newConnListener(l.Addr()),
+		originPatterns: params.OriginPatterns,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/ws", ws.handleUpgrade)
+	ws.http = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return ws, nil
+}
+
+// Start serves WebSocket upgrades until Stop is called
+func (ws *WebSocketServer) Start(ctx context.Context) error {
+	go ws.server.accept(ctx, ws.conns)
+	ws.server.logger.Info("server listening", "network", "websocket", "address", ws.listener.Addr().String())
+	if err := ws.http.Serve(ws.listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Stop stops accepting sockets. The open ones are drained with the TCPServer.
+func (ws *WebSocketServer) Stop() {
+	ws.http.Close()
+	ws.conns.Close()
+}
+
+func (ws *WebSocketServer) GetAddr() net.Addr {
+	return ws.listener.Addr()
+}
+
+// handleUpgrade accepts the socket and waits for the TCPServer to be done with it
+func (ws *WebSocketServer) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	socket, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: ws.originPatterns})
+	if err != nil {
+		ws.server.logger.Warn("cannot accept websocket", "remote_addr", r.RemoteAddr, "error", err)
+		return
+	}
+	// Leave room for the header of a length prefixed frame
+	socket.SetReadLimit(int64(ws.server.MaxFrameSize()) + 4)
+
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	conn := newWSConn(socket, local, wsAddr(r.RemoteAddr))
+	if !ws.conns.push(conn) {
+		conn.Close()
+		return
+	}
+	<-conn.Closed()
+}
+
+// closeNotifier is a connection that notices when its client goes away, even
+// while no request is being read
+type closeNotifier interface {
+	Closed() <-chan struct{}
+}
+
+// wsConn turns a WebSocket into a net.Conn. Every message read is passed on
+// as a line, or as it is when it already ends with one or is binary, and
+// every write is sent as a message of its own.
+type wsConn struct {
+	socket        *websocket.Conn
+	local, remote net.Addr
+	ctx           context.Context
+	cancel        context.CancelFunc
+	// messages are read all the time so a closed socket is noticed mid task
+	messages chan []byte
+	// gone is closed once the socket can't be read anymore
+	gone    chan struct{}
+	pending []byte
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// deadlineMoved is closed and replaced when the read deadline changes
+	deadlineMoved chan struct{}
+	closeOnce     sync.Once
+}
+
+func newWSConn(socket *websocket.Conn, local, remote net.Addr) *wsConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &wsConn{
+		socket:        socket,
+		local:         local,
+		remote:        remote,
+		ctx:           ctx,
+		cancel:        cancel,
+		messages:      make(chan []byte, 16),
+		gone:          make(chan struct{}),
+		deadlineMoved: make(chan struct{}),
+	}
+	go c.readMessages()
+	return c
+}
+
+func (c *wsConn) readMessages() {
+	defer close(c.gone)
+	for {
+		typ, b, err := c.socket.Read(c.ctx)
+		if err != nil {
+			return
+		}
+		if typ == websocket.MessageText && (len(b) == 0 || b[len(b)-1] != '\n') {
+			b = append(b, '\n')
+		}
+		select {
+		case c.messages <- b:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *wsConn) Closed() <-chan struct{} {
+	return c.gone
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// next waits for the next message until the read deadline. The messages that
+// came in before the socket closed are still handed over.
+func (c *wsConn) next() error {
+	c.mu.Lock()
+	deadline, moved := c.readDeadline, c.deadlineMoved
+	c.mu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case c.pending = <-c.messages:
+	case <-c.gone:
+		select {
+		case c.pending = <-c.messages:
+		default:
+			return io.EOF
+		}
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-moved:
+	}
+	return nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	ctx := c.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	typ := websocket.MessageText
+	if !utf8.Valid(p) {
+		typ = websocket.MessageBinary
+	}
+	if err := c.socket.Write(ctx, typ, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.socket.Close(websocket.StatusNormalClosure, "")
+		c.cancel()
+	})
+	return err
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return wsAddr("")
+	}
+	return wsAddr(c.local.String())
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineMoved)
+	c.deadlineMoved = make(chan struct{})
+	return nil
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// wsAddr is the address of either end of a WebSocket, its network is websocket
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// connListener is a net.Listener for connections that were accepted elsewhere
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// push hands conn to Accept. It reports false once the listener is closed.
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return wsAddr(l.addr.String())
+}
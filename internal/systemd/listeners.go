@@ -0,0 +1,69 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SpecPrefix marks listeners that came from systemd, e.g. systemd:tcp-server.socket
+	SpecPrefix = "systemd:"
+
+	// listenFDsStart is the first file descriptor systemd passes to us (SD_LISTEN_FDS_START)
+	listenFDsStart = 3
+)
+
+// Listeners returns the listeners passed in through socket activation, keyed
+// by systemd:<name> where name comes from FileDescriptorName= (or the fd
+// number if there is none). It returns an empty map when we were not socket activated.
+func Listeners() (map[string]net.Listener, error) {
+	listeners := map[string]net.Listener{}
+
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	// Don't pass these on to the tasks we run
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// The fds are only meant for us if the pid matches
+	if pid == "" || fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return listeners, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		name := strconv.Itoa(fd)
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		// Several sockets can share a name, so make the spec unique
+		spec := SpecPrefix + name
+		if _, exists := listeners[spec]; exists {
+			spec = fmt.Sprintf("%s%s.%d", SpecPrefix, name, fd)
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket activated fd %d (%s) is not a listening socket: %w", fd, name, err)
+		}
+		listeners[spec] = l
+	}
+	return listeners, nil
+}
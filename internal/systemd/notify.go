@@ -0,0 +1,125 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States we report to systemd, see sd_notify(3)
+const (
+	Ready     = "READY=1"
+	Reloading = "RELOADING=1"
+	Stopping  = "STOPPING=1"
+	Watchdog  = "WATCHDOG=1"
+)
+
+// MainPID tells systemd that another process is now the main process of the service
+func MainPID(pid int) string {
+	return fmt.Sprintf("MAINPID=%d", pid)
+}
+
+// Status is a free form status shown by systemctl status
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// Notifier sends state changes to systemd over NOTIFY_SOCKET. A Notifier
+// without a socket does nothing, so it is safe to use when not run by systemd.
+type Notifier struct {
+	socket   string
+	watchdog time.Duration
+}
+
+// NewNotifierFromEnv reads NOTIFY_SOCKET and WATCHDOG_USEC and removes them
+// from the environment so the tasks we run can't talk to systemd
+func NewNotifierFromEnv() *Notifier {
+	n := &Notifier{socket: os.Getenv("NOTIFY_SOCKET")}
+
+	// The watchdog is only meant for us if WATCHDOG_PID is unset or matches
+	watchdogPID := os.Getenv("WATCHDOG_PID")
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		if watchdogPID == "" || watchdogPID == strconv.Itoa(os.Getpid()) {
+			n.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	return n
+}
+
+// Enabled reports whether we were started with a NOTIFY_SOCKET
+func (n *Notifier) Enabled() bool {
+	return n != nil && n.socket != ""
+}
+
+// Notify sends the states in a single datagram
+func (n *Notifier) Notify(states ...string) error {
+	if !n.Enabled() {
+		return nil
+	}
+
+	// A leading @ means an abstract socket
+	addr := &net.UnixAddr{Name: n.socket, Net: "unixgram"}
+	if strings.HasPrefix(n.socket, "@") {
+		addr.Name = "\x00" + n.socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return fmt.Errorf("connecting to NOTIFY_SOCKET: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return fmt.Errorf("writing to NOTIFY_SOCKET: %w", err)
+	}
+	return nil
+}
+
+// WatchdogInterval is how often systemd expects to hear from us, 0 when the watchdog is off
+func (n *Notifier) WatchdogInterval() time.Duration {
+	if !n.Enabled() {
+		return 0
+	}
+	return n.watchdog
+}
+
+// RunWatchdog pings the watchdog at half the interval systemd asked for until ctx is done
+func (n *Notifier) RunWatchdog(ctx context.Context, onError func(error)) {
+	interval := n.WatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := n.Notify(Watchdog); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// Env is the environment a process we hand over to (see internal/upgrade)
+// needs to keep talking to systemd
+func (n *Notifier) Env() []string {
+	if !n.Enabled() {
+		return nil
+	}
+	env := []string{"NOTIFY_SOCKET=" + n.socket}
+	if n.watchdog > 0 {
+		env = append(env, "WATCHDOG_USEC="+strconv.FormatInt(n.watchdog.Microseconds(), 10))
+	}
+	return env
+}
@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// ServiceName is reported as service.name on every span
+const ServiceName = "tcp-server"
+
+// Attributes we put on the spans
+const (
+	AttrCommand   = attribute.Key("task.command")
+	AttrTimeoutMs = attribute.Key("task.timeout_ms")
+	AttrExitCode  = attribute.Key("task.exit_code")
+	AttrError     = attribute.Key("task.error")
+	AttrPeer      = attribute.Key("tcp_server.peer")
+	AttrNetwork   = attribute.Key("tcp_server.network")
+	AttrAllowed   = attribute.Key("tcp_server.ratelimit.allowed")
+)
+
+// Extract returns ctx with the remote span described by a W3C traceparent
+// header as its parent. An empty or invalid traceparent leaves ctx as is.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
+
+// NewProvider creates a tracer provider that batches spans to the exporter
+func NewProvider(exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(ServiceName))),
+	)
+}
+
+// NewOTLPExporter sends spans to an OTLP/HTTP collector. An empty endpoint
+// falls back to the OTEL_EXPORTER_OTLP_* environment variables.
+func NewOTLPExporter(ctx context.Context, endpoint string) (sdktrace.SpanExporter, error) {
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	}
+	return otlptracehttp.New(ctx, opts...)
+}
+
+// NewFileExporter appends spans to a file as one JSON object per line
+func NewFileExporter(path string) (sdktrace.SpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening trace file: %w", err)
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileExporter{SpanExporter: exporter, file: f}, nil
+}
+
+// fileExporter closes the file once the exporter is shut down
+type fileExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
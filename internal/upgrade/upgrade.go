@@ -0,0 +1,202 @@
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// EnvListeners holds the comma separated specs of the listeners passed to the new process.
+	// Their file descriptors start at 3 in the same order.
+	EnvListeners = "TCP_SERVER_UPGRADE_LISTENERS"
+	// EnvReadyFD is the file descriptor the new process writes to once it is accepting connections
+	EnvReadyFD = "TCP_SERVER_UPGRADE_READY_FD"
+
+	// firstFD is the first file descriptor after stdin, stdout and stderr
+	firstFD = 3
+)
+
+// Listener is an open listener along with the spec it was created from, so
+// the new process can match it to its own configuration
+type Listener struct {
+	Spec string
+	net.Listener
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Inherited returns the listeners handed down by the process that started us,
+// keyed by their spec. It returns an empty map when we were not started by an upgrade.
+func Inherited() (map[string]net.Listener, error) {
+	value, ok := os.LookupEnv(EnvListeners)
+	if !ok {
+		return map[string]net.Listener{}, nil
+	}
+	// Don't pass these on to the tasks we run or the next upgrade
+	os.Unsetenv(EnvListeners)
+
+	listeners := map[string]net.Listener{}
+	if value == "" {
+		return listeners, nil
+	}
+	for i, spec := range strings.Split(value, ",") {
+		f := os.NewFile(uintptr(firstFD+i), spec)
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor so we close ours either way
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inheriting listener %s: %w", spec, err)
+		}
+		listeners[spec] = l
+	}
+	return listeners, nil
+}
+
+// Ready tells the process that started us that we are accepting connections
+// so it can stop accepting and drain. It does nothing when we were not started by an upgrade.
+func Ready() error {
+	value, ok := os.LookupEnv(EnvReadyFD)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(EnvReadyFD)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", EnvReadyFD, value, err)
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte("ready"))
+	return err
+}
+
+// Upgrade starts a new copy of our binary with the same arguments and hands it
+// the listeners, with env added to its environment. It returns once the new
+// process is accepting connections on them, after which we should stop
+// accepting and drain. If the new process fails to start or doesn't become
+// ready within the timeout it is killed and we keep serving.
+func Upgrade(listeners []Listener, env []string, timeout time.Duration) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("finding executable: %w", err)
+	}
+
+	// Duplicate every listener's file descriptor for the new process
+	specs := make([]string, 0, len(listeners))
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.Listener.(filer)
+		if !ok {
+			return nil, fmt.Errorf("listener %s cannot be passed to another process", l.Spec)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, fmt.Errorf("getting file for listener %s: %w", l.Spec, err)
+		}
+		specs = append(specs, l.Spec)
+		files = append(files, f)
+	}
+
+	// The new process signals that it is ready by writing to this pipe
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environWithout(EnvListeners, EnvReadyFD), env...)
+	cmd.Env = append(cmd.Env,
+		EnvListeners+"="+strings.Join(specs, ","),
+		fmt.Sprintf("%s=%d", EnvReadyFD, firstFD+len(specs)),
+	)
+
+	// Keep unix socket files around when we close our listeners, they belong to the new process now
+	setUnlinkOnClose(listeners, false)
+	if err := cmd.Start(); err != nil {
+		setUnlinkOnClose(listeners, true)
+		return nil, fmt.Errorf("starting %s: %w", path, err)
+	}
+	// Close our copy of the write end so we see EOF if the new process dies before it is ready
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	if err := waitReady(readyR, timeout); err != nil {
+		setUnlinkOnClose(listeners, true)
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, err
+	}
+
+	// Reap the new process in the background, it outlives us in the normal case
+	go func() { _ = cmd.Wait() }()
+	return cmd.Process, nil
+}
+
+func waitReady(r *os.File, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		b := make([]byte, len("ready"))
+		_, err := io.ReadFull(r, b)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errors.New("new process exited before it was ready")
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("new process was not ready after %s", timeout)
+	}
+}
+
+func setUnlinkOnClose(listeners []Listener, unlink bool) {
+	for _, l := range listeners {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(unlink)
+		}
+	}
+}
+
+func environWithout(keys ...string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		skip := false
+		for _, key := range keys {
+			if k == key {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
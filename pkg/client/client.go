@@ -0,0 +1,291 @@
+package client
+
+import (
+	"bufio"
+	"context"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/pkg/codec"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// Client sends task requests to a server. Connections are kept open between
+// requests and it is safe to use from several goroutines.
+type Client struct {
+	network      string
+	address      string
+	token        string
+	framing      string
+	codec        codec.Codec
+	compression  string
+	dialTimeout  time.Duration
+	pollInterval time.Duration
+	retry        Retry
+
+	mu     sync.Mutex
+	idle   []*conn
+	max    int
+	closed bool
+}
+
+// Retry says how requests that were rate limited are tried again
+type Retry struct {
+	// MaxAttempts is how many times a request is sent in total, 0 means 5 and 1 turns retrying off
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, it doubles with each one. 0 means 100ms.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries, 0 means 5s
+	MaxBackoff time.Duration
+}
+
+type Params struct {
+	// Network is tcp or unix, empty means tcp
+	Network string
+	// Address of the server, e.g. 127.0.0.1:3000 or /run/tcp-server.sock
+	Address string
+	// Token is sent with every request when the server needs one
+	Token string
+	// Framing is model.FramingLine or model.FramingLengthPrefixed, empty means line.
+	// Length prefixed frames are negotiated when a connection is opened.
+	Framing string
+	// Codec is the name of the codec to use, see pkg/codec. Empty means JSON,
+	// binary codecs like msgpack and cbor come with length prefixed frames.
+	Codec string
+	// Compression is model.CompressionGzip to have the responses compressed, empty means none
+	Compression string
+	// DialTimeout caps how long connecting takes, 0 means 10s
+	DialTimeout time.Duration
+	// MaxIdleConns is how many connections are kept open between requests, 0 means 2 and a negative value keeps none
+	MaxIdleConns int
+	// PollInterval is how often Wait asks about a job, 0 means 500ms
+	PollInterval time.Duration
+	Retry        Retry
+}
+
+func New(params Params) (*Client, error) {
+	if params.Address == "" {
+		return nil, errors.New("client: address is required")
+	}
+	if params.Network == "" {
+		params.Network = "tcp"
+	}
+	if params.Codec == "" {
+		params.Codec = codec.JSON
+	}
+	c, ok := codec.Get(params.Codec)
+	if !ok {
+		return nil, fmt.Errorf("client: unknown codec %q", params.Codec)
+	}
+	switch params.Framing {
+	case "":
+		params.Framing = model.FramingLine
+		if c.Binary() {
+			params.Framing = model.FramingLengthPrefixed
+		}
+	case model.FramingLine:
+		if c.Binary() {
+			return nil, fmt.Errorf("client: codec %q needs length prefixed frames", params.Codec)
+		}
+	case model.FramingLengthPrefixed:
+	default:
+		return nil, fmt.Errorf("client: unknown framing %q", params.Framing)
+	}
+	if params.Compression != "" && params.Compression != model.CompressionGzip {
+		return nil, fmt.Errorf("client: unknown compression %q", params.Compression)
+	}
+	if params.DialTimeout <= 0 {
+		params.DialTimeout = constant.DefaultClientDialTimeout
+	}
+	if params.MaxIdleConns == 0 {
+		params.MaxIdleConns = constant.DefaultClientMaxIdleConns
+	}
+	if params.PollInterval <= 0 {
+		params.PollInterval = constant.DefaultClientPollInterval
+	}
+	if params.Retry.MaxAttempts <= 0 {
+		params.Retry.MaxAttempts = constant.DefaultRetryMaxAttempts
+	}
+	if params.Retry.InitialBackoff <= 0 {
+		params.Retry.InitialBackoff = constant.DefaultRetryInitialBackoff
+	}
+	if params.Retry.MaxBackoff <= 0 {
+		params.Retry.MaxBackoff = constant.DefaultRetryMaxBackoff
+	}
+
+	return &Client{
+		network:      params.Network,
+		address:      params.Address,
+		token:        params.Token,
+		framing:      params.Framing,
+		codec:        c,
+		compression:  params.Compression,
+		dialTimeout:  params.DialTimeout,
+		pollInterval: params.PollInterval,
+		retry:        params.Retry,
+		max:          max(params.MaxIdleConns, 0),
+	}, nil
+}
+
+// Close closes the idle connections. Requests still in flight finish normally
+// but their connections are closed rather than kept.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// conn is a connection to the server along with what reads its responses
+type conn struct {
+	net.Conn
+	// decoder reads line framed JSON, reader length prefixed frames
+	decoder *json.Decoder
+	reader  *bufio.Reader
+	codec   codec.Codec
+	// lengthPrefixed is set once the server agreed to length prefixed frames
+	lengthPrefixed bool
+	// reused is set once the connection served a request, the server may have closed it since
+	reused bool
+	// answered is set when the server sent anything back for the last request
+	answered bool
+	// handedOff is set when the connection was given to a task, it is closed rather than reused
+	handedOff bool
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: c.dialTimeout}
+	nc, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	jsonCodec, _ := codec.Get(codec.JSON)
+	cn := &conn{Conn: nc, decoder: json.NewDecoder(nc), codec: jsonCodec}
+	if c.framing == model.FramingLine && c.codec.Name() == codec.JSON && c.compression == "" {
+		return cn, nil
+	}
+
+	// Negotiate under the dial timeout unless the context gives up sooner
+	deadline := time.Now().Add(c.dialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	nc.SetDeadline(deadline)
+	if err := c.negotiate(cn); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	cn.reused = true
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || cn.handedOff || len(c.idle) >= c.max {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// do sends the request and hands the connection to read for the responses.
+// Rate limited requests are retried with backoff.
+func (c *Client) do(ctx context.Context, request *model.TaskRequest, read func(messageDecoder) error) error {
+	backoff := c.retry.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.roundTrip(ctx, request, read)
+		if !errors.Is(err, ErrRateLimited) || attempt >= c.retry.MaxAttempts {
+			return err
+		}
+
+		// Wait somewhere between half and all of the backoff so clients don't retry in lockstep
+		wait := backoff/2 + rand.N(backoff/2+1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, c.retry.MaxBackoff)
+	}
+}
+
+func (c *Client) roundTrip(ctx context.Context, request *model.TaskRequest, read func(messageDecoder) error) error {
+	for {
+		cn, err := c.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = c.send(ctx, cn, request, read)
+		// The server closes idle connections, so try a request a reused one hung up on again on a new one
+		if err != nil && cn.reused && !cn.answered && isHangUp(err) {
+			cn.Close()
+			continue
+		}
+		var exitErr *ExitError
+		var serverErr *Error
+		if err == nil || errors.As(err, &exitErr) || (errors.As(err, &serverErr) && !closesConn(err)) {
+			c.put(cn)
+		} else {
+			cn.Close()
+		}
+		return err
+	}
+}
+
+func (c *Client) send(ctx context.Context, cn *conn, request *model.TaskRequest, read func(messageDecoder) error) error {
+	// Follow the context's deadline and give up on the connection as soon as it is cancelled
+	deadline, _ := ctx.Deadline()
+	if err := cn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		cn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	if request.Token == "" {
+		request.Token = c.token
+	}
+	cn.answered = false
+	err := cn.writeRequest(request)
+	if err == nil {
+		err = read(cn)
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// isHangUp reports whether the server closed the connection. It writes why
+// in plain text first when it times out waiting for a request.
+func isHangUp(err error) bool {
+	var syntaxErr *json.SyntaxError
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &syntaxErr)
+}
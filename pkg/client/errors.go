@@ -0,0 +1,88 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// Errors the server can answer with, match them with errors.Is
+var (
+	ErrRateLimited        = errors.New("rate limited")
+	ErrShuttingDown       = errors.New("server shutting down")
+	ErrTimeout            = errors.New("task timed out")
+	ErrKilled             = errors.New("task killed")
+	ErrAuditFailed        = errors.New("audit log unavailable")
+	ErrInvalidRequest     = errors.New("invalid request")
+	ErrJobNotFound        = errors.New("job not found")
+	ErrTooManyJobs        = errors.New("too many jobs running")
+	ErrUnauthorized       = errors.New("invalid or missing token")
+	ErrForbidden          = errors.New("not allowed to run as that user")
+	ErrRootNotAllowed     = errors.New("server refuses to run tasks as root")
+	ErrFrameTooLarge      = errors.New("request larger than the server's max frame size")
+	ErrParse              = errors.New("server couldn't parse the request")
+	ErrUnsupportedVersion = errors.New("no protocol version in common with the server")
+)
+
+var codeErrors = map[string]error{
+	constant.TaskResultRateLimitedError:    ErrRateLimited,
+	constant.TaskResultShuttingDownError:   ErrShuttingDown,
+	constant.TaskResultTimeoutError:        ErrTimeout,
+	constant.TaskResultKilledError:         ErrKilled,
+	constant.TaskResultAuditError:          ErrAuditFailed,
+	constant.TaskResultInvalidRequestError: ErrInvalidRequest,
+	constant.JobNotFoundError:              ErrJobNotFound,
+	constant.JobLimitError:                 ErrTooManyJobs,
+	constant.TaskResultUnauthorizedError:   ErrUnauthorized,
+	constant.TaskResultForbiddenError:      ErrForbidden,
+	constant.TaskResultRootNotAllowedError: ErrRootNotAllowed,
+	constant.TaskResultFrameTooLargeError:  ErrFrameTooLarge,
+	constant.TaskResultParseError:          ErrParse,
+	constant.UnsupportedVersionError:       ErrUnsupportedVersion,
+}
+
+// Error is a request the server turned down or a task it couldn't run.
+// Code is the error the server sent back.
+type Error struct {
+	Code string
+}
+
+func (e *Error) Error() string {
+	if err, ok := codeErrors[e.Code]; ok {
+		return err.Error()
+	}
+	return e.Code
+}
+
+func (e *Error) Is(target error) bool {
+	return codeErrors[e.Code] == target
+}
+
+// ExitError is a task that ran but exited with a non-zero code
+type ExitError struct {
+	ExitCode int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.ExitCode)
+}
+
+// resultError turns a result that didn't succeed into an *Error or *ExitError
+func resultError(result *model.TaskResult) error {
+	switch {
+	case result.ExitCode > 0:
+		return &ExitError{ExitCode: result.ExitCode}
+	case result.ExitCode < 0 || result.Error != "":
+		return &Error{Code: result.Error}
+	default:
+		return nil
+	}
+}
+
+// closesConn reports whether the server hangs up after sending this error
+func closesConn(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrShuttingDown) || errors.Is(err, ErrFrameTooLarge) ||
+		errors.Is(err, ErrParse)
+}
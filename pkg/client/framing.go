@@ -0,0 +1,120 @@
+package client
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// messageDecoder reads the responses to a request
+type messageDecoder interface {
+	Decode(v any) error
+}
+
+// Decode reads the next response
+func (cn *conn) Decode(v any) error {
+	if !cn.lengthPrefixed {
+		start := cn.decoder.InputOffset()
+		err := cn.decoder.Decode(v)
+		cn.answered = cn.answered || cn.decoder.InputOffset() > start
+		return err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(cn.reader, header[:]); err != nil {
+		return err
+	}
+	cn.answered = true
+	frame := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(cn.reader, frame); err != nil {
+		return err
+	}
+	return cn.codec.Unmarshal(frame, v)
+}
+
+// writeRequest encodes the request in the connection's codec and sends it
+func (cn *conn) writeRequest(request *model.TaskRequest) error {
+	b, err := cn.codec.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return cn.write(b)
+}
+
+// write sends a request in the connection's framing
+func (cn *conn) write(b []byte) error {
+	var frame []byte
+	if cn.lengthPrefixed {
+		frame = binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(b)), uint32(len(b)))
+		frame = append(frame, b...)
+	} else {
+		frame = append(b, '\n')
+	}
+	_, err := cn.Write(frame)
+	return err
+}
+
+// negotiate says hello asking for the framing, codec and compression. The
+// server answers in line framed JSON and may turn the connection away before
+// reading the hello.
+func (c *Client) negotiate(cn *conn) error {
+	b, err := json.Marshal(&model.TaskRequest{
+		Type:        model.RequestHello,
+		Versions:    []int{model.ProtocolVersion},
+		Features:    []string{model.FeatureFraming, model.FeatureCompression},
+		Framing:     c.framing,
+		Codec:       c.codec.Name(),
+		Compression: c.compression,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := cn.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(cn.Conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+
+	var hello model.Hello
+	if err := json.Unmarshal(line, &hello); err != nil {
+		return err
+	}
+	if hello.Type != model.MessageHello {
+		var result model.TaskResult
+		if err := json.Unmarshal(line, &result); err != nil {
+			return err
+		}
+		if err := resultError(&result); err != nil {
+			return err
+		}
+		return fmt.Errorf("client: unexpected answer to hello: %s", line)
+	}
+	if hello.Error != "" {
+		return &Error{Code: hello.Error}
+	}
+	if hello.Framing != c.framing || hello.Codec != c.codec.Name() || hello.Compression != c.compression {
+		return fmt.Errorf("client: server answered with %s framing, codec %q and compression %q", hello.Framing, hello.Codec, hello.Compression)
+	}
+
+	// Everything after the answer is compressed, starting with the gzip header
+	if c.compression == model.CompressionGzip {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		reader = bufio.NewReader(gz)
+	}
+	cn.codec = c.codec
+	cn.lengthPrefixed = c.framing == model.FramingLengthPrefixed
+	cn.reader = reader
+	cn.decoder = json.NewDecoder(reader)
+	return nil
+}
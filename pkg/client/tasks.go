@@ -0,0 +1,194 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"time"
+
+	"github.com/Oyal2/tcp-server/pkg/model"
+)
+
+// Run runs the task and waits for its result. The error is an *ExitError when
+// the task exited with a non-zero code and an *Error when it couldn't run,
+// the result is returned either way. Cancelling ctx stops waiting but not the task.
+// Output the server base64 encoded is decoded again.
+func (c *Client) Run(ctx context.Context, request model.TaskRequest) (model.TaskResult, error) {
+	request.Type = ""
+	request.Stream = false
+	var result model.TaskResult
+	err := c.do(ctx, &request, func(decoder messageDecoder) error {
+		result = model.TaskResult{}
+		if err := decoder.Decode(&result); err != nil {
+			return err
+		}
+		if err := decodeResult(&result); err != nil {
+			return err
+		}
+		return resultError(&result)
+	})
+	return result, err
+}
+
+// Stream runs the task like Run, passing its output to output as it is written.
+// The result has no Output.
+func (c *Client) Stream(ctx context.Context, request model.TaskRequest, output func(stream string, data []byte)) (model.TaskResult, error) {
+	request.Type = ""
+	request.Stream = true
+	var result model.TaskResult
+	err := c.do(ctx, &request, func(decoder messageDecoder) error {
+		return readStream(decoder, output, &result)
+	})
+	return result, err
+}
+
+// StreamKillable runs the task like Stream, but cancelling ctx kills the task
+// and waits for its result rather than giving up on it. The task has the
+// connection to itself with its stdin closed, which the server needs the stdin
+// feature for, and the connection isn't reused.
+func (c *Client) StreamKillable(ctx context.Context, request model.TaskRequest, output func(stream string, data []byte)) (model.TaskResult, error) {
+	request.Type = ""
+	request.Stream = true
+	request.Stdin = true
+	var result model.TaskResult
+	err := c.do(context.WithoutCancel(ctx), &request, func(decoder messageDecoder) error {
+		cn := decoder.(*conn)
+		// Requests the server turns down leave the eof for the connection's next request
+		cn.handedOff = true
+		if err := cn.writeRequest(&model.TaskRequest{Type: model.RequestEOF}); err != nil {
+			return err
+		}
+		stop := context.AfterFunc(ctx, func() {
+			cn.writeRequest(&model.TaskRequest{Type: model.RequestCancel})
+		})
+		defer stop()
+		return readStream(decoder, output, &result)
+	})
+	return result, err
+}
+
+// readStream passes the output to output until the result comes
+func readStream(decoder messageDecoder, output func(stream string, data []byte), result *model.TaskResult) error {
+	for {
+		// Output and the result share the type field, so either fits in a message
+		var message struct {
+			model.TaskResult
+			Stream   string      `json:"stream"`
+			Data     model.Bytes `json:"data"`
+			Encoding string      `json:"encoding"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			return err
+		}
+		if message.Type == model.MessageOutput {
+			data, err := decodeOutput(message.Data, message.Encoding)
+			if err != nil {
+				return err
+			}
+			output(message.Stream, data)
+			continue
+		}
+
+		// Anything else is the result, or the rate limit answer which has no type
+		*result = message.TaskResult
+		return resultError(result)
+	}
+}
+
+// Submit starts the task in the background and returns its job straight away
+func (c *Client) Submit(ctx context.Context, request model.TaskRequest) (model.JobStatus, error) {
+	request.Type = model.RequestSubmit
+	request.Stream = false
+	return c.job(ctx, &request)
+}
+
+// Status returns the job, its Result is set once it is done
+func (c *Client) Status(ctx context.Context, jobID string) (model.JobStatus, error) {
+	return c.job(ctx, &model.TaskRequest{Type: model.RequestStatus, JobID: jobID})
+}
+
+// Cancel kills the job if it is still running
+func (c *Client) Cancel(ctx context.Context, jobID string) (model.JobStatus, error) {
+	return c.job(ctx, &model.TaskRequest{Type: model.RequestCancel, JobID: jobID})
+}
+
+// Jobs returns the jobs submitted from this client's address, oldest first
+func (c *Client) Jobs(ctx context.Context) ([]model.JobStatus, error) {
+	var list model.JobList
+	err := c.do(ctx, &model.TaskRequest{Type: model.RequestJobs}, func(decoder messageDecoder) error {
+		var response struct {
+			model.JobList
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&response); err != nil {
+			return err
+		}
+		if response.Error != "" {
+			return &Error{Code: response.Error}
+		}
+		for _, job := range response.Jobs {
+			if err := decodeResult(job.Result); err != nil {
+				return err
+			}
+		}
+		list = response.JobList
+		return nil
+	})
+	return list.Jobs, err
+}
+
+// Wait polls the job until it is done and returns its result, with the same errors as Run
+func (c *Client) Wait(ctx context.Context, jobID string) (model.TaskResult, error) {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		status, err := c.Status(ctx, jobID)
+		if err != nil {
+			return model.TaskResult{}, err
+		}
+		if status.State == model.JobDone && status.Result != nil {
+			return *status.Result, resultError(status.Result)
+		}
+		select {
+		case <-ctx.Done():
+			return model.TaskResult{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) job(ctx context.Context, request *model.TaskRequest) (model.JobStatus, error) {
+	var status model.JobStatus
+	err := c.do(ctx, request, func(decoder messageDecoder) error {
+		status = model.JobStatus{}
+		if err := decoder.Decode(&status); err != nil {
+			return err
+		}
+		if status.Error != "" {
+			return &Error{Code: status.Error}
+		}
+		return decodeResult(status.Result)
+	})
+	return status, err
+}
+
+// decodeResult decodes the result's output if the server base64 encoded it
+func decodeResult(result *model.TaskResult) error {
+	if result == nil {
+		return nil
+	}
+	output, err := decodeOutput(result.Output, result.OutputEncoding)
+	if err != nil {
+		return err
+	}
+	result.Output, result.OutputEncoding = output, ""
+	return nil
+}
+
+func decodeOutput(output model.Bytes, encoding string) (model.Bytes, error) {
+	if encoding != model.OutputEncodingBase64 {
+		return output, nil
+	}
+	decoded := make(model.Bytes, base64.StdEncoding.DecodedLen(len(output)))
+	n, err := base64.StdEncoding.Decode(decoded, output)
+	return decoded[:n], err
+}
@@ -0,0 +1,11 @@
+package codec
+
+import "github.com/fxamacker/cbor/v2"
+
+// cborCodec encodes structs as maps keyed like their JSON, []byte fields as byte strings
+type cborCodec struct{}
+
+func (cborCodec) Name() string                       { return CBOR }
+func (cborCodec) Marshal(v any) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v any) error { return cbor.Unmarshal(data, v) }
+func (cborCodec) Binary() bool                       { return true }
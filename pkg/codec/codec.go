@@ -0,0 +1,63 @@
+// Package codec encodes the messages sent to and from the server. Connections
+// start out with JSON and can switch to another codec in a hello.
+package codec
+
+import (
+	"sort"
+	"sync"
+)
+
+// Names of the codecs that come with the package
+const (
+	JSON        = "json"
+	MessagePack = "msgpack"
+	CBOR        = "cbor"
+)
+
+// Codec marshals messages. Codecs use the json struct tags of the model types.
+type Codec interface {
+	// Name is what a hello asks for the codec by
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	// Binary codecs can't be newline delimited and need length prefixed frames
+	Binary() bool
+}
+
+var (
+	mu     sync.RWMutex
+	codecs = map[string]Codec{}
+)
+
+func init() {
+	Register(jsonCodec{})
+	Register(msgpackCodec{})
+	Register(cborCodec{})
+}
+
+// Register makes a codec available under its name, replacing any codec registered under it before
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// Get returns the codec registered under name
+func Get(name string) (Codec, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Names returns the names of the registered codecs, sorted
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
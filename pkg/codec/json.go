@@ -0,0 +1,10 @@
+package codec
+
+import "encoding/json"
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return JSON }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Binary() bool                       { return false }
@@ -1,30 +1,96 @@
 package executor
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"log/slog"
 	"os/exec"
+	"sync/atomic"
 	"time"
 
 	"github.com/Oyal2/tcp-server/internal/constant"
-	"github.com/Oyal2/tcp-server/internal/model"
+	"github.com/Oyal2/tcp-server/internal/logging"
+	"github.com/Oyal2/tcp-server/internal/tracing"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type CommandExecutor struct{}
+// errRootNotAllowed refuses a task that would run as root
+var errRootNotAllowed = errors.New(constant.TaskResultRootNotAllowedError)
 
+type CommandExecutor struct {
+	// slots limits how many tasks can run at once. A nil channel means no limit.
+	slots  chan struct{}
+	logger *slog.Logger
+	// runAs is who tasks run as unless they ask for someone else
+	runAs     string
+	allowRoot bool
+
+	running atomic.Int64
+	queued  atomic.Int64
+}
+
+type CommandExecutorParams struct {
+	// MaxConcurrent is the maximum number of tasks running at the same time, 0 means unlimited
+	MaxConcurrent int
+	// Logger is used when the task's context doesn't carry one, nil means slog.Default()
+	Logger *slog.Logger
+	// RunAs is the user, or user:group, tasks run as when the request has no RunAs, e.g. nobody.
+	// Empty runs them as the server's own user.
+	RunAs string
+	// AllowRoot lets tasks run as root. Without it a task that would is refused, which
+	// includes every task without a RunAs when the server runs as root.
+	AllowRoot bool
+}
+
+// NewCommandExecutor returns an executor with the default params, tasks aren't
+// limited and run as the server's own user unless that is root
 func NewCommandExecutor() *CommandExecutor {
-	ce := CommandExecutor{}
+	return NewCommandExecutorWithParams(CommandExecutorParams{})
+}
+
+func NewCommandExecutorWithParams(params CommandExecutorParams) *CommandExecutor {
+	ce := CommandExecutor{logger: params.Logger, runAs: params.RunAs, allowRoot: params.AllowRoot}
+	if params.MaxConcurrent > 0 {
+		ce.slots = make(chan struct{}, params.MaxConcurrent)
+	}
+	maxConcurrent.Set(float64(params.MaxConcurrent))
 	return &ce
 }
 
 func (ce *CommandExecutor) ExecuteTask(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+	return ce.execute(ctx, request, nil, nil, nil)
+}
+
+// ExecuteTaskStream runs the task like ExecuteTask but passes stdout and stderr to output as they are written
+func (ce *CommandExecutor) ExecuteTaskStream(ctx context.Context, request *model.TaskRequest, output OutputFunc) *model.TaskResult {
+	return ce.execute(ctx, request, output, nil, nil)
+}
+
+// ExecuteTaskInteractive runs the task like ExecuteTaskStream but in a pseudo-terminal that input is typed into
+func (ce *CommandExecutor) ExecuteTaskInteractive(ctx context.Context, request *model.TaskRequest, input <-chan TerminalInput, output OutputFunc) *model.TaskResult {
+	return ce.execute(ctx, request, output, input, nil)
+}
+
+// ExecuteTaskStdin runs the task like ExecuteTaskStream, or ExecuteTask without output, feeding its stdin from stdin
+func (ce *CommandExecutor) ExecuteTaskStdin(ctx context.Context, request *model.TaskRequest, stdin io.Reader, output OutputFunc) *model.TaskResult {
+	return ce.execute(ctx, request, output, nil, stdin)
+}
+
+func (ce *CommandExecutor) execute(ctx context.Context, request *model.TaskRequest, output OutputFunc, input <-chan TerminalInput, stdin io.Reader) *model.TaskResult {
 	// Build the Task Result
 	result := &model.TaskResult{
 		Command:    request.Command,
 		ExecutedAt: time.Now().Unix(),
 	}
 
-	// Safe check if the command coming in is set
-	if request.Command == nil {
+	logger := logging.FromContext(ctx, ce.logger)
+
+	// Safe check if the command coming in is set, an empty list has no program to run
+	if len(request.Command) == 0 {
 		result.ExitCode = -1
 		result.Error = constant.TaskResultCommandNilError
 		return result
@@ -32,10 +98,98 @@ func (ce *CommandExecutor) ExecuteTask(ctx context.Context, request *model.TaskR
 
 	// Setup the command that we will be running with the context.
 	cmd := exec.CommandContext(ctx, request.Command[0], request.Command[1:]...)
+	setProcessGroup(cmd)
+	// Don't wait forever on output pipes held open by orphaned children after the task is killed
+	cmd.WaitDelay = constant.DefaultWaitDelay
+	// Run it as the user it asks for or our default one, before it takes up a slot
+	runAs := request.RunAs
+	if runAs == "" {
+		runAs = ce.runAs
+	}
+	if err := setCredential(cmd, runAs, ce.allowRoot); err != nil {
+		logger.Warn("refusing to run task", "run_as", runAs, "error", err)
+		result.ExitCode = -1
+		result.Error = err.Error()
+		result.DurationMs = calculateDuration(result.ExecutedAt)
+		return result
+	}
+
+	// Wait for a free slot if we are limiting the number of running tasks
+	if ce.slots != nil {
+		logger.Debug("waiting for a free slot")
+		tasksQueued.Inc()
+		ce.queued.Add(1)
+		_, queueSpan := tracer().Start(ctx, "queue")
+		select {
+		case ce.slots <- struct{}{}:
+			tasksQueued.Dec()
+			ce.queued.Add(-1)
+			queueSpan.End()
+			defer func() { <-ce.slots }()
+		case <-ctx.Done():
+			tasksQueued.Dec()
+			ce.queued.Add(-1)
+			queueSpan.SetStatus(codes.Error, ctx.Err().Error())
+			queueSpan.End()
+			logger.Debug("gave up waiting for a free slot", "error", ctx.Err())
+			result.ExitCode = -1
+			result.Error = ctx.Err().Error()
+			if ctx.Err() == context.DeadlineExceeded {
+				result.Error = constant.TaskResultTimeoutError
+			}
+			result.DurationMs = calculateDuration(result.ExecutedAt)
+			return result
+		}
+	}
+
 	// Run it and collect the outputs
-	output, err := cmd.CombinedOutput()
+	_, execSpan := tracer().Start(ctx, "exec", trace.WithAttributes(tracing.AttrCommand.StringSlice(request.Command)))
+	defer func() {
+		execSpan.SetAttributes(tracing.AttrExitCode.Int(result.ExitCode))
+		if result.Error != "" {
+			execSpan.SetAttributes(tracing.AttrError.String(result.Error))
+			execSpan.SetStatus(codes.Error, result.Error)
+		}
+		execSpan.End()
+	}()
+	// Collect stdout and stderr together, or hand them over as they come when streaming.
+	// An interactive task's terminal is set up when it starts.
+	var combined bytes.Buffer
+	var stream *streamWriter
+	switch {
+	case input != nil:
+		stream = &streamWriter{output: output}
+	case output == nil:
+		cmd.Stdout = &combined
+		cmd.Stderr = &combined
+	default:
+		stream = &streamWriter{output: output}
+		cmd.Stdout = stream.writer(model.StreamStdout)
+		cmd.Stderr = stream.writer(model.StreamStderr)
+	}
+	logger.Debug("running task", "interactive", input != nil)
+	tasksRunning.Inc()
+	ce.running.Add(1)
+	start := time.Now()
+	var err error
+	switch {
+	case input != nil:
+		err = runTerminal(cmd, request.Window, input, stream.writer(model.StreamStdout))
+	case stdin != nil:
+		err = runWithStdin(cmd, stdin)
+	default:
+		err = cmd.Run()
+	}
+	taskDuration.Observe(time.Since(start).Seconds())
+	tasksRunning.Dec()
+	ce.running.Add(-1)
 	// Populate the ouput to our result
-	result.Output = string(output)
+	if stream == nil {
+		result.Output = combined.Bytes()
+		taskOutputBytes.Add(float64(combined.Len()))
+	} else {
+		taskOutputBytes.Add(float64(stream.written))
+	}
 
 	// If there was a context deadline then we set the result to timeout exceeded
 	if ctx.Err() == context.DeadlineExceeded {
@@ -46,6 +200,8 @@ func (ce *CommandExecutor) ExecuteTask(ctx context.Context, request *model.TaskR
 		result.ExitCode = -1
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			result.ExitCode = exitErr.ExitCode()
+		} else {
+			logger.Warn("cannot run task", "error", err)
 		}
 		result.Error = err.Error()
 	}
@@ -56,6 +212,16 @@ func (ce *CommandExecutor) ExecuteTask(ctx context.Context, request *model.TaskR
 	return result
 }
 
+// Running returns how many tasks are running right now
+func (ce *CommandExecutor) Running() int {
+	return int(ce.running.Load())
+}
+
+// Queued returns how many tasks are waiting for a free slot
+func (ce *CommandExecutor) Queued() int {
+	return int(ce.queued.Load())
+}
+
 func calculateDuration(executedAt int64) float64 {
 	return float64(time.Since(time.Unix(executedAt, 0))) / float64(time.Millisecond)
 }
@@ -2,10 +2,47 @@ package executor
 
 import (
 	"context"
+	"io"
 
-	"github.com/Oyal2/tcp-server/internal/model"
+	"github.com/Oyal2/tcp-server/pkg/model"
 )
 
 type TaskExecutor interface {
 	ExecuteTask(ctx context.Context, taskRequest *model.TaskRequest) *model.TaskResult
 }
+
+// OutputFunc receives a chunk of a task's output on one of the model.Stream* streams.
+// data is only valid until the function returns.
+type OutputFunc func(stream string, data []byte)
+
+// StreamingExecutor can hand over the output while the task is still running.
+// The result it returns has no Output since it has all been passed to output.
+type StreamingExecutor interface {
+	TaskExecutor
+	ExecuteTaskStream(ctx context.Context, taskRequest *model.TaskRequest, output OutputFunc) *model.TaskResult
+}
+
+// TerminalInput is what reaches an interactive task's terminal, keystrokes or a new window size
+type TerminalInput struct {
+	Data   []byte
+	Window *model.Window
+}
+
+// InteractiveExecutor can run a task in a pseudo-terminal
+type InteractiveExecutor interface {
+	TaskExecutor
+	// ExecuteTaskInteractive runs the task in a pseudo-terminal the size of the request's Window.
+	// What the task writes to it goes to output on model.StreamStdout and input is written to it
+	// until the task exits. The result has no Output.
+	ExecuteTaskInteractive(ctx context.Context, taskRequest *model.TaskRequest, input <-chan TerminalInput, output OutputFunc) *model.TaskResult
+}
+
+// StdinExecutor can feed a task's stdin while it runs
+type StdinExecutor interface {
+	TaskExecutor
+	// ExecuteTaskStdin runs the task like ExecuteTaskStream, or like ExecuteTask when output
+	// is nil, writing what is read from stdin to the task's stdin. The task's stdin is closed
+	// when stdin ends. Reading stops when the task exits, but a read that is blocked then
+	// is left to return on its own, so the caller should unblock it once the call returns.
+	ExecuteTaskStdin(ctx context.Context, taskRequest *model.TaskRequest, stdin io.Reader, output OutputFunc) *model.TaskResult
+}
@@ -0,0 +1,35 @@
+package executor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	taskDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "tcp_server",
+		Name:      "task_duration_seconds",
+		Help:      "Time spent running tasks, not counting the time waiting for a slot.",
+		Buckets:   []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+	})
+	taskOutputBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tcp_server",
+		Name:      "task_output_bytes_total",
+		Help:      "Bytes of output produced by tasks.",
+	})
+	tasksRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tcp_server",
+		Name:      "executor_tasks_running",
+		Help:      "Tasks currently running.",
+	})
+	tasksQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tcp_server",
+		Name:      "executor_tasks_queued",
+		Help:      "Tasks waiting for a free slot when executor.max_concurrent is set.",
+	})
+	maxConcurrent = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tcp_server",
+		Name:      "executor_max_concurrent",
+		Help:      "Maximum number of tasks that can run at once, 0 is unlimited.",
+	})
+)
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package executor
+
+import "os/exec"
+
+// setProcessGroup is a no-op where process groups are not supported, cancelling only kills the command itself
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func leaveProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package executor
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs the command in its own process group. Signals sent to the
+// server (like Ctrl+C) no longer reach the task, so it can finish while we drain,
+// and when the task is cancelled we kill the whole group including any children it started.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// leaveProcessGroup undoes the process group of setProcessGroup for a task that
+// starts a session of its own, as a task in a terminal does. The session leader
+// leads a process group of the same id, so the whole group is still killed.
+func leaveProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr.Setpgid = false
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package executor
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// setCredential can't switch users where there are no uids, tasks run as the server
+func setCredential(cmd *exec.Cmd, runAs string, allowRoot bool) error {
+	if runAs != "" {
+		return fmt.Errorf("run_as is not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+//go:build unix
+
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setCredential runs the command as runAs, a user or user:group by name or id.
+// The task gets the user's supplementary groups in place of the server's. A
+// task that would run as root, as the server itself when it is root and runAs
+// is empty too, is refused unless allowRoot is set.
+func setCredential(cmd *exec.Cmd, runAs string, allowRoot bool) error {
+	if runAs == "" {
+		if os.Geteuid() == 0 && !allowRoot {
+			return errRootNotAllowed
+		}
+		return nil
+	}
+	credential, err := lookupCredential(runAs)
+	if err != nil {
+		return fmt.Errorf("run_as %q: %w", runAs, err)
+	}
+	if credential.Uid == 0 && !allowRoot {
+		return errRootNotAllowed
+	}
+	// Switching to who we already are would still need the privilege to set the groups
+	if int(credential.Uid) == os.Geteuid() && int(credential.Gid) == os.Getegid() {
+		return nil
+	}
+	cmd.SysProcAttr.Credential = credential
+	return nil
+}
+
+func lookupCredential(runAs string) (*syscall.Credential, error) {
+	name, groupName, withGroup := strings.Cut(runAs, ":")
+	u, err := lookupUser(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad uid %q: %w", u.Uid, err)
+	}
+
+	gidName := u.Gid
+	if withGroup {
+		if gidName, err = lookupGroup(groupName); err != nil {
+			return nil, err
+		}
+	}
+	if gidName == "" {
+		return nil, fmt.Errorf("uid %s is not a known user, give its group too", name)
+	}
+	gid, err := strconv.ParseUint(gidName, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad gid %q: %w", gidName, err)
+	}
+
+	// A uid that isn't in the user database has no supplementary groups
+	groups := []uint32{}
+	if u.Username != "" {
+		ids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("cannot list the groups of %s: %w", u.Username, err)
+		}
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, nil
+}
+
+// lookupUser finds a user by name or uid. A uid that isn't in the user
+// database is still a user, only without a name or groups.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, numErr := strconv.ParseUint(name, 10, 32); numErr != nil {
+		return nil, err
+	}
+	if u, err := user.LookupId(name); err == nil {
+		return u, nil
+	}
+	return &user.User{Uid: name}, nil
+}
+
+// lookupGroup returns the gid of a group given by name or gid
+func lookupGroup(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err == nil {
+		return g.Gid, nil
+	}
+	if _, numErr := strconv.ParseUint(name, 10, 32); numErr != nil {
+		return "", err
+	}
+	return name, nil
+}
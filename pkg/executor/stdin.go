@@ -0,0 +1,26 @@
+package executor
+
+import (
+	"io"
+	"os/exec"
+)
+
+// runWithStdin runs cmd writing what is read from stdin to its stdin. Writes
+// block while the task isn't reading, so no more than the pipe holds is
+// buffered. The pipe is closed when stdin ends, so the task sees EOF, and by
+// Wait when the task exits first. exec would instead wait for stdin to end
+// before Wait returns if it was handed the reader.
+func runWithStdin(cmd *exec.Cmd, stdin io.Reader) error {
+	pipe, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		_, _ = io.Copy(pipe, stdin)
+		pipe.Close()
+	}()
+	return cmd.Wait()
+}
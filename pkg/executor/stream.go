@@ -0,0 +1,31 @@
+package executor
+
+import (
+	"io"
+	"sync"
+)
+
+// streamWriter passes the output of a task on to an OutputFunc. exec copies
+// stdout and stderr in separate goroutines, so calls are serialized here to
+// spare the OutputFunc from having to lock.
+type streamWriter struct {
+	mu      sync.Mutex
+	output  OutputFunc
+	written int
+}
+
+func (s *streamWriter) writer(stream string) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.output(stream, p)
+		s.written += len(p)
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
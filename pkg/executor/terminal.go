@@ -0,0 +1,74 @@
+package executor
+
+import (
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/creack/pty"
+)
+
+// Size of a terminal when the request doesn't give one
+const (
+	defaultRows = 24
+	defaultCols = 80
+)
+
+// runTerminal runs cmd in a pseudo-terminal, typing input into it and passing
+// what the task writes to output until the task exits
+func runTerminal(cmd *exec.Cmd, window *model.Window, input <-chan TerminalInput, output io.Writer) error {
+	leaveProcessGroup(cmd)
+	terminal, err := pty.StartWithSize(cmd, winsize(window))
+	if err != nil {
+		return err
+	}
+	defer terminal.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case in, ok := <-input:
+				if !ok {
+					return
+				}
+				// The task may be gone already, it is only told about a resize while it runs
+				if in.Window != nil {
+					_ = pty.Setsize(terminal, winsize(in.Window))
+				}
+				if len(in.Data) > 0 {
+					_, _ = terminal.Write(in.Data)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		_, _ = io.Copy(output, terminal)
+	}()
+	err = cmd.Wait()
+
+	// Pass on everything the task wrote before it exited. Children it left
+	// behind can hold the terminal open, so don't wait on them for long.
+	select {
+	case <-copied:
+	case <-time.After(constant.DefaultWaitDelay):
+		terminal.Close()
+		<-copied
+	}
+	return err
+}
+
+func winsize(window *model.Window) *pty.Winsize {
+	if window == nil || window.Rows <= 0 || window.Cols <= 0 {
+		return &pty.Winsize{Rows: defaultRows, Cols: defaultCols}
+	}
+	return &pty.Winsize{Rows: uint16(window.Rows), Cols: uint16(window.Cols)}
+}
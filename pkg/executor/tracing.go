@@ -0,0 +1,11 @@
+package executor
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer uses whichever provider is installed when the task runs
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/Oyal2/tcp-server/pkg/executor")
+}
@@ -0,0 +1,24 @@
+package model
+
+import "encoding/json"
+
+// Bytes is output that may not be text. It is a string in JSON, as output has
+// always been, and a byte string in the binary codecs so it comes through as is.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == nil {
+		*b = nil
+		return nil
+	}
+	*b = Bytes(*s)
+	return nil
+}
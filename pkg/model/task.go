@@ -0,0 +1,185 @@
+package model
+
+// ProtocolVersion is the version of the protocol described here. Connections
+// that never say hello speak version 1.
+const ProtocolVersion = 1
+
+// Request types. A request without a type runs the task and answers with its result.
+const (
+	RequestRun    = "run"
+	RequestSubmit = "submit"
+	RequestStatus = "status"
+	RequestCancel = "cancel"
+	RequestJobs   = "jobs"
+	// RequestFraming switches the framing of the messages that follow
+	RequestFraming = "framing"
+	// RequestHello agrees on the protocol version and features for the connection
+	RequestHello = "hello"
+	// RequestInput and RequestResize are sent while an interactive task runs,
+	// they type Data into its terminal or change the terminal's Window
+	RequestInput  = "input"
+	RequestResize = "resize"
+	// RequestStdin and RequestEOF are sent while a task with Stdin runs, they
+	// write Data to its stdin or close it
+	RequestStdin = "stdin"
+	RequestEOF   = "eof"
+)
+
+// Message types set on the responses to streaming and job requests. Plain run
+// requests get a TaskResult without a type, as they always have.
+const (
+	MessageOutput  = "output"
+	MessageResult  = "result"
+	MessageJob     = "job"
+	MessageJobs    = "jobs"
+	MessageFraming = "framing"
+	MessageHello   = "hello"
+)
+
+// Features a client can ask for in a hello. The server answers with the ones
+// it supports, auth is only there when requests need a token.
+const (
+	FeatureStreaming   = "streaming"
+	FeatureJobs        = "jobs"
+	FeatureFraming     = "framing"
+	FeatureCompression = "compression"
+	FeatureInteractive = "interactive"
+	FeatureStdin       = "stdin"
+	FeatureAuth        = "auth"
+)
+
+// CompressionGzip compresses what the server sends as one gzip stream, flushed
+// after every message. Requests are never compressed.
+const CompressionGzip = "gzip"
+
+// Framings a connection can use. Line framing sends newline delimited JSON
+// messages. Length prefixed framing sends every message after its length as a
+// 4 byte big endian integer.
+const (
+	FramingLine           = "line"
+	FramingLengthPrefixed = "length_prefixed"
+)
+
+// OutputEncodingBase64 is set on output that was base64 encoded, because the
+// request asked for it or because it wasn't UTF-8 and the codec is JSON
+const OutputEncodingBase64 = "base64"
+
+// Output streams of a task
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// Job states
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+type TaskRequest struct {
+	Type    string   `json:"type,omitempty"`
+	Command []string `json:"command,omitempty"`
+	Timeout int      `json:"timeout,omitempty"`
+	// TraceParent is an optional W3C traceparent so the task shows up in the caller's trace
+	TraceParent string `json:"traceparent,omitempty"`
+	// Stream sends the output in OutputFrames as it is written, followed by the TaskResult
+	Stream bool `json:"stream,omitempty"`
+	// JobID is the job a status or cancel request is about
+	JobID string `json:"job_id,omitempty"`
+	// Token is needed when the server is set up with auth tokens
+	Token string `json:"token,omitempty"`
+	// Framing is the framing a framing or hello request switches to
+	Framing string `json:"framing,omitempty"`
+	// Versions are the protocol versions a hello offers
+	Versions []int `json:"versions,omitempty"`
+	// Features are the features a hello asks for
+	Features []string `json:"features,omitempty"`
+	// Codec is the codec a hello switches to, see pkg/codec
+	Codec string `json:"codec,omitempty"`
+	// Compression is the compression a hello turns on
+	Compression string `json:"compression,omitempty"`
+	// OutputEncoding asks for the output in the answer to be base64 encoded even if it is text
+	OutputEncoding string `json:"output_encoding,omitempty"`
+	// Interactive runs the task in a pseudo-terminal that input and resize requests go to until it exits
+	Interactive bool `json:"interactive,omitempty"`
+	// Window is the size of an interactive task's terminal
+	Window *Window `json:"window,omitempty"`
+	// RunAs is the user, or user:group, to run the task as by name or id, e.g. nobody or 65534:65534.
+	// The server's policy decides who a request may run as.
+	RunAs string `json:"run_as,omitempty"`
+	// Stdin keeps the task's stdin open for stdin requests until an eof request
+	Stdin bool `json:"stdin,omitempty"`
+	// Data is what an input request types into the terminal or a stdin request writes to stdin
+	Data Bytes `json:"data,omitempty"`
+	// Encoding is base64 when Data is base64 encoded, for data that isn't UTF-8 in JSON
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Window is the size of a terminal in characters
+type Window struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+type TaskResult struct {
+	Type       string   `json:"type,omitempty"`
+	Command    []string `json:"command"`
+	ExecutedAt int64    `json:"executed_at"`
+	DurationMs float64  `json:"duration_ms"`
+	ExitCode   int      `json:"exit_code"`
+	Output     Bytes    `json:"output,omitempty"`
+	// OutputEncoding is OutputEncodingBase64 when Output is base64 encoded
+	OutputEncoding string `json:"output_encoding,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// OutputFrame carries a chunk of a streaming task's output
+type OutputFrame struct {
+	Type   string `json:"type"`
+	Stream string `json:"stream"`
+	Data   Bytes  `json:"data"`
+	// Encoding is OutputEncodingBase64 when Data is base64 encoded
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// JobStatus answers submit, status and cancel requests
+type JobStatus struct {
+	Type        string      `json:"type"`
+	JobID       string      `json:"job_id,omitempty"`
+	State       string      `json:"state,omitempty"`
+	Command     []string    `json:"command,omitempty"`
+	SubmittedAt int64       `json:"submitted_at,omitempty"`
+	Result      *TaskResult `json:"result,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// Framing answers a framing request. The messages after it use the new framing.
+type Framing struct {
+	Type    string `json:"type"`
+	Framing string `json:"framing"`
+	// MaxFrameSize is the largest request the server takes, in bytes
+	MaxFrameSize int `json:"max_frame_size"`
+}
+
+// Hello answers a hello request with what the server chose. The messages after
+// it use the chosen framing, codec and compression.
+type Hello struct {
+	Type    string `json:"type"`
+	Version int    `json:"version,omitempty"`
+	// Versions are the versions the server speaks, sent when it speaks none of the offered ones
+	Versions []int    `json:"versions,omitempty"`
+	Features []string `json:"features"`
+	Framing  string   `json:"framing,omitempty"`
+	Codec    string   `json:"codec,omitempty"`
+	// Compression is set once the server compresses what it sends
+	Compression string `json:"compression,omitempty"`
+	// MaxFrameSize is the largest request the server takes, in bytes
+	MaxFrameSize int    `json:"max_frame_size,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// JobList answers a jobs request with the client's jobs
+type JobList struct {
+	Type string      `json:"type"`
+	Jobs []JobStatus `json:"jobs"`
+}
@@ -2,6 +2,7 @@ package ratelimit
 
 import (
 	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 )
@@ -32,7 +33,31 @@ func NewIPRateLimiter(limit int, interval time.Duration) (*IPRateLimiter, error)
 	return &rl, nil
 }
 
+// Update changes the limit and interval while keeping the counts of the ips we are tracking
+func (rl *IPRateLimiter) Update(limit int, interval time.Duration) error {
+	if limit < 1 {
+		return fmt.Errorf("limit cannot be %d", limit)
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limit = limit
+	rl.interval = interval
+	slog.Debug("rate limit updated", "limit", limit, "interval", interval, "tracked_ips", len(rl.ips))
+	return nil
+}
+
 func (rl *IPRateLimiter) Allow(ip string) bool {
+	allowed := rl.allow(ip)
+	if allowed {
+		checksAllowed.Inc()
+	} else {
+		checksDenied.Inc()
+	}
+	return allowed
+}
+
+func (rl *IPRateLimiter) allow(ip string) bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
@@ -68,11 +93,24 @@ func (rl *IPRateLimiter) Clean() {
 	defer rl.mu.Unlock()
 
 	// Go through all the ips in the system and delete anything that is old
+	removed := 0
 	for ip, entry := range rl.ips {
 		if time.Since(entry.LastReset) > rl.interval {
 			delete(rl.ips, ip)
+			removed++
 		}
 	}
+	cleanedIPs.Add(float64(removed))
+	slog.Debug("rate limiter cleaned", "removed", removed, "tracked_ips", len(rl.ips))
+}
+
+func (rl *IPRateLimiter) Reset(ip string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	_, exists := rl.ips[ip]
+	delete(rl.ips, ip)
+	return exists
 }
 
 func (rl *IPRateLimiter) IPs() map[string]*IP {
@@ -81,6 +119,19 @@ func (rl *IPRateLimiter) IPs() map[string]*IP {
 	return rl.ips
 }
 
+// Len is the number of ips being tracked
+func (rl *IPRateLimiter) Len() int {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return len(rl.ips)
+}
+
+func (rl *IPRateLimiter) Limit() int {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.limit
+}
+
 func (rl *IPRateLimiter) Interval() time.Duration {
 	rl.mu.RLock()
 	defer rl.mu.RUnlock()
@@ -0,0 +1,24 @@
+package ratelimit
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The table size isn't exported from here, only the server knows which of the
+// limiters is the current one. See Tracker.
+var (
+	checks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tcp_server",
+		Name:      "ratelimit_checks_total",
+		Help:      "Rate limit checks by result.",
+	}, []string{"result"})
+	checksAllowed = checks.WithLabelValues("allowed")
+	checksDenied  = checks.WithLabelValues("denied")
+
+	cleanedIPs = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tcp_server",
+		Name:      "ratelimit_cleaned_ips_total",
+		Help:      "Ips dropped from the rate limiter table because their interval had passed.",
+	})
+)
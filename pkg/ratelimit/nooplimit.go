@@ -0,0 +1,19 @@
+package ratelimit
+
+// NoopRateLimiter allows every request. It is used when rate limiting is turned off.
+type NoopRateLimiter struct{}
+
+func NewNoopRateLimiter() *NoopRateLimiter {
+	return &NoopRateLimiter{}
+}
+
+func (rl *NoopRateLimiter) Allow(ip string) bool {
+	return true
+}
+
+func (rl *NoopRateLimiter) Clean() {}
+
+// Len is always 0, nobody is tracked
+func (rl *NoopRateLimiter) Len() int {
+	return 0
+}
@@ -4,3 +4,15 @@ type RateLimiter interface {
 	Allow(ip string) bool
 	Clean()
 }
+
+// Resetter is implemented by rate limiters that can forget a single client
+type Resetter interface {
+	// Reset forgets the given ip, reporting whether it was being tracked
+	Reset(ip string) bool
+}
+
+// Tracker is implemented by rate limiters that keep a table of the clients they have seen
+type Tracker interface {
+	// Len is the number of clients being tracked
+	Len() int
+}
@@ -0,0 +1,244 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/admin"
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const token = "secret"
+
+func statusOf(status int, body string) int {
+	return status
+}
+
+type mockExecutor struct {
+	ExecuteTaskFunc func(ctx context.Context, request *model.TaskRequest) *model.TaskResult
+}
+
+func (m *mockExecutor) ExecuteTask(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+	return m.ExecuteTaskFunc(ctx, request)
+}
+
+type fixedQueue int
+
+func (q fixedQueue) Queued() int {
+	return int(q)
+}
+
+var _ = Describe("Admin", func() {
+	var (
+		s           *server.TCPServer
+		mockExe     *mockExecutor
+		rateLimiter *ratelimit.IPRateLimiter
+		params      admin.HandlerParams
+		api         *httptest.Server
+	)
+
+	do := func(method, path, token string) (int, string) {
+		req, err := http.NewRequest(method, api.URL+path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	BeforeEach(func() {
+		mockExe = &mockExecutor{
+			ExecuteTaskFunc: func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+				<-ctx.Done()
+				return &model.TaskResult{Command: request.Command, ExitCode: -1, Error: ctx.Err().Error()}
+			},
+		}
+		var err error
+		rateLimiter, err = ratelimit.NewIPRateLimiter(2, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			Listen:       []string{"tcp://127.0.0.1:0"},
+			ReadTimeout:  time.Second * 3,
+			WriteTimeout: time.Second * 3,
+			Executor:     mockExe,
+			RateLimiter:  rateLimiter,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+		DeferCleanup(s.Stop)
+
+		params = admin.HandlerParams{Server: s, Token: token}
+	})
+
+	JustBeforeEach(func() {
+		api = httptest.NewServer(admin.NewHandler(params))
+		DeferCleanup(api.Close)
+	})
+
+	It("should report healthy and ready once the server is accepting connections", func() {
+		Expect(statusOf(do("GET", "/healthz", ""))).To(Equal(http.StatusOK))
+		Eventually(func() int {
+			status, _ := do("GET", "/readyz", "")
+			return status
+		}).Should(Equal(http.StatusOK))
+	})
+
+	It("should report not ready while draining", func() {
+		Eventually(func() int {
+			status, _ := do("GET", "/readyz", "")
+			return status
+		}).Should(Equal(http.StatusOK))
+		Expect(s.Shutdown(context.Background())).To(Succeed())
+
+		status, body := do("GET", "/readyz", "")
+		Expect(status).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(ContainSubstring("draining"))
+		Expect(statusOf(do("GET", "/healthz", ""))).To(Equal(http.StatusOK))
+	})
+
+	Context("with a queue threshold", func() {
+		BeforeEach(func() {
+			params.Queue = fixedQueue(5)
+			params.MaxQueued = 4
+		})
+
+		It("should report not ready when too many tasks are queued", func() {
+			Eventually(func() string {
+				_, body := do("GET", "/readyz", "")
+				return body
+			}).Should(ContainSubstring("5 tasks queued"))
+		})
+	})
+
+	It("should require the token for the admin endpoints", func() {
+		status, _ := do("GET", "/admin/tasks", "")
+		Expect(status).To(Equal(http.StatusUnauthorized))
+		status, _ = do("GET", "/admin/tasks", "wrong")
+		Expect(status).To(Equal(http.StatusUnauthorized))
+		status, _ = do("GET", "/admin/tasks", token)
+		Expect(status).To(Equal(http.StatusOK))
+	})
+
+	Context("without a token", func() {
+		BeforeEach(func() {
+			params.Token = ""
+		})
+
+		It("should disable the admin endpoints", func() {
+			status, _ := do("GET", "/admin/tasks", "")
+			Expect(status).To(Equal(http.StatusForbidden))
+			Expect(statusOf(do("GET", "/healthz", ""))).To(Equal(http.StatusOK))
+		})
+	})
+
+	It("should list connections and running tasks and kill a task", func() {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte(`{"command":["sleep","60"],"timeout":60000}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		var tasks []server.TaskInfo
+		Eventually(func() []server.TaskInfo {
+			_, body := do("GET", "/admin/tasks", token)
+			Expect(json.Unmarshal([]byte(body), &tasks)).To(Succeed())
+			return tasks
+		}).Should(HaveLen(1))
+		Expect(tasks[0].Command).To(Equal([]string{"sleep", "60"}))
+		Expect(tasks[0].Client).To(Equal("127.0.0.1"))
+
+		var conns []server.ConnectionInfo
+		_, body := do("GET", "/admin/connections", token)
+		Expect(json.Unmarshal([]byte(body), &conns)).To(Succeed())
+		Expect(conns).To(HaveLen(1))
+		Expect(conns[0].ID).To(Equal(tasks[0].ConnID))
+		Expect(conns[0].RemoteAddr).To(Equal(conn.LocalAddr().String()))
+
+		status, _ := do("POST", "/admin/tasks/"+tasks[0].RequestID+"/kill", token)
+		Expect(status).To(Equal(http.StatusNoContent))
+		var result model.TaskResult
+		Expect(json.NewDecoder(conn).Decode(&result)).To(Succeed())
+		Expect(result.ExitCode).To(Equal(-1))
+		Expect(result.Error).To(Equal(constant.TaskResultKilledError))
+
+		status, _ = do("POST", "/admin/tasks/"+tasks[0].RequestID+"/kill", token)
+		Expect(status).To(Equal(http.StatusNotFound))
+	})
+
+	It("should reset a client's rate limit", func() {
+		for i := 0; i < 2; i++ {
+			Expect(rateLimiter.Allow("127.0.0.1")).To(BeTrue())
+		}
+		Expect(rateLimiter.Allow("127.0.0.1")).To(BeFalse())
+
+		status, _ := do("DELETE", "/admin/ratelimit/127.0.0.1", token)
+		Expect(status).To(Equal(http.StatusNoContent))
+		Expect(rateLimiter.Allow("127.0.0.1")).To(BeTrue())
+
+		status, _ = do("DELETE", "/admin/ratelimit/10.0.0.1", token)
+		Expect(status).To(Equal(http.StatusNotFound))
+	})
+
+	It("should refuse to reset a client when the rate limiter can't", func() {
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  time.Second * 3,
+			WriteTimeout: time.Second * 3,
+			RateLimiter:  ratelimit.NewNoopRateLimiter(),
+		})
+
+		status, _ := do("DELETE", "/admin/ratelimit/127.0.0.1", token)
+		Expect(status).To(Equal(http.StatusNotImplemented))
+	})
+
+	It("should clean the rate limiter", func() {
+		Expect(rateLimiter.Update(2, time.Millisecond)).To(Succeed())
+		rateLimiter.Allow("10.0.0.1")
+		time.Sleep(5 * time.Millisecond)
+
+		status, _ := do("POST", "/admin/ratelimit/clean", token)
+		Expect(status).To(Equal(http.StatusNoContent))
+		Expect(rateLimiter.IPs()).NotTo(HaveKey("10.0.0.1"))
+	})
+
+	Context("with a reload function", func() {
+		var reloads int
+
+		BeforeEach(func() {
+			reloads = 0
+			params.Reload = func() error {
+				reloads++
+				if reloads > 1 {
+					return errors.New("config: invalid read_timeout")
+				}
+				return nil
+			}
+		})
+
+		It("should reload the config", func() {
+			status, _ := do("POST", "/admin/reload", token)
+			Expect(status).To(Equal(http.StatusNoContent))
+
+			status, body := do("POST", "/admin/reload", token)
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			Expect(body).To(ContainSubstring("invalid read_timeout"))
+			Expect(reloads).To(Equal(2))
+		})
+	})
+})
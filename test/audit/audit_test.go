@@ -0,0 +1,296 @@
+package audit_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/audit"
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/client"
+	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func verify(paths ...string) (*audit.Verifier, error) {
+	var verifier audit.Verifier
+	for _, path := range paths {
+		f, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		err = verifier.Verify(path, f)
+		f.Close()
+		if err != nil {
+			return &verifier, err
+		}
+	}
+	return &verifier, nil
+}
+
+func readRecords(path string) []audit.Record {
+	f, err := os.Open(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+	var records []audit.Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record audit.Record
+		Expect(json.Unmarshal(scanner.Bytes(), &record)).To(Succeed())
+		records = append(records, record)
+	}
+	return records
+}
+
+func writeRecords(l *audit.Log, n int) {
+	for i := 0; i < n; i++ {
+		Expect(l.Write(&audit.Record{
+			Time:    time.Now(),
+			Event:   audit.EventExec,
+			Client:  "127.0.0.1",
+			Command: []string{"echo", fmt.Sprint(i)},
+		})).To(Succeed())
+	}
+}
+
+var _ = Describe("Log", func() {
+	var path string
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "audit.log")
+	})
+
+	It("should chain every record to the previous one", func() {
+		l, err := audit.NewLog(audit.LogParams{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		writeRecords(l, 3)
+		Expect(l.Close()).To(Succeed())
+
+		records := readRecords(path)
+		Expect(records).To(HaveLen(3))
+		Expect(records[0].Seq).To(Equal(uint64(1)))
+		Expect(records[0].PrevHash).To(BeEmpty())
+		Expect(records[1].PrevHash).To(Equal(records[0].Hash))
+		Expect(records[2].PrevHash).To(Equal(records[1].Hash))
+
+		verifier, err := verify(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verifier.Records).To(Equal(3))
+		Expect(verifier.Hash).To(Equal(records[2].Hash))
+	})
+
+	It("should carry on the chain when reopened", func() {
+		for i := 0; i < 2; i++ {
+			l, err := audit.NewLog(audit.LogParams{Path: path})
+			Expect(err).NotTo(HaveOccurred())
+			writeRecords(l, 2)
+			Expect(l.Close()).To(Succeed())
+		}
+
+		verifier, err := verify(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verifier.Seq).To(Equal(uint64(4)))
+	})
+
+	It("should keep a single chain when two processes share the file", func() {
+		first, err := audit.NewLog(audit.LogParams{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		defer first.Close()
+		second, err := audit.NewLog(audit.LogParams{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		defer second.Close()
+
+		for i := 0; i < 3; i++ {
+			writeRecords(first, 1)
+			writeRecords(second, 2)
+		}
+
+		verifier, err := verify(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verifier.Records).To(Equal(9))
+	})
+
+	It("should rotate the file and keep the chain across files", func() {
+		l, err := audit.NewLog(audit.LogParams{Path: path, MaxSize: 512, MaxBackups: 2})
+		Expect(err).NotTo(HaveOccurred())
+		writeRecords(l, 20)
+		Expect(l.Close()).To(Succeed())
+
+		Expect(path + ".1").To(BeAnExistingFile())
+		Expect(path + ".2").To(BeAnExistingFile())
+		Expect(path + ".3").NotTo(BeAnExistingFile())
+
+		verifier, err := verify(path+".2", path+".1", path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verifier.Seq).To(Equal(uint64(20)))
+
+		// The files only verify in order
+		_, err = verify(path+".1", path+".2")
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("Verifier", func() {
+		BeforeEach(func() {
+			l, err := audit.NewLog(audit.LogParams{Path: path})
+			Expect(err).NotTo(HaveOccurred())
+			writeRecords(l, 3)
+			Expect(l.Close()).To(Succeed())
+		})
+
+		It("should detect a modified record", func() {
+			b, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			tampered := strings.Replace(string(b), `"echo","1"`, `"echo","x"`, 1)
+			Expect(tampered).NotTo(Equal(string(b)))
+			Expect(os.WriteFile(path, []byte(tampered), 0o600)).To(Succeed())
+
+			_, err = verify(path)
+			var verifyErr *audit.VerifyError
+			Expect(errors.As(err, &verifyErr)).To(BeTrue())
+			Expect(verifyErr.Line).To(Equal(2))
+			Expect(err).To(MatchError(ContainSubstring("has been modified")))
+		})
+
+		It("should detect a removed record", func() {
+			b, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			lines := strings.SplitAfter(string(b), "\n")
+			Expect(os.WriteFile(path, []byte(lines[0]+lines[2]), 0o600)).To(Succeed())
+
+			_, err = verify(path)
+			Expect(err).To(MatchError(ContainSubstring("expected record 2, got 3")))
+		})
+	})
+})
+
+type mockExecutor struct {
+	calls atomic.Int32
+}
+
+func (m *mockExecutor) ExecuteTask(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+	m.calls.Add(1)
+	return &model.TaskResult{Command: request.Command, ExitCode: 0, Output: model.Bytes("hello\n")}
+}
+
+// ExecuteTaskStream sends the same output as ExecuteTask in chunks on both streams
+func (m *mockExecutor) ExecuteTaskStream(ctx context.Context, request *model.TaskRequest, output executor.OutputFunc) *model.TaskResult {
+	m.calls.Add(1)
+	output(model.StreamStdout, []byte("hel"))
+	output(model.StreamStderr, []byte("lo\n"))
+	return &model.TaskResult{Command: request.Command, ExitCode: 0}
+}
+
+type failingSink struct{}
+
+func (failingSink) Write(*audit.Record) error {
+	return errors.New("disk full")
+}
+
+var _ = Describe("Server auditing", func() {
+	var mockExe *mockExecutor
+
+	start := func(sink audit.Sink, failClosed bool) *server.TCPServer {
+		s, err := server.NewTCPServer(server.TCPServerParams{
+			Listen:          []string{"tcp://127.0.0.1:0"},
+			ReadTimeout:     time.Second,
+			WriteTimeout:    time.Second,
+			Executor:        mockExe,
+			Audit:           sink,
+			AuditFailClosed: failClosed,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+		DeferCleanup(s.Stop)
+		return s
+	}
+
+	run := func(s *server.TCPServer) model.TaskResult {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte(`{"command":["echo","hello"]}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		var result model.TaskResult
+		Expect(json.NewDecoder(conn).Decode(&result)).To(Succeed())
+		return result
+	}
+
+	BeforeEach(func() {
+		mockExe = &mockExecutor{}
+	})
+
+	It("should record who ran what before and after the task", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "audit.log")
+		l, err := audit.NewLog(audit.LogParams{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Close()
+		s := start(l, true)
+
+		Expect(run(s).ExitCode).To(Equal(0))
+
+		Eventually(func() []audit.Record { return readRecords(path) }).Should(HaveLen(2))
+		records := readRecords(path)
+		exec, result := records[0], records[1]
+		Expect(exec.Event).To(Equal(audit.EventExec))
+		Expect(exec.Client).To(Equal("127.0.0.1"))
+		Expect(exec.Command).To(Equal([]string{"echo", "hello"}))
+		Expect(exec.EnvKeys).To(ContainElement("PATH"))
+		Expect(exec.Cwd).NotTo(BeEmpty())
+		Expect(result.Event).To(Equal(audit.EventResult))
+		Expect(result.RequestID).To(Equal(exec.RequestID))
+		Expect(result.ConnID).To(Equal(exec.ConnID))
+		Expect(result.ExitCode).To(HaveValue(Equal(0)))
+		Expect(result.OutputSHA256).To(Equal(audit.OutputHash("hello\n")))
+
+		_, err = verify(path)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should hash the output of streamed tasks", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "audit.log")
+		l, err := audit.NewLog(audit.LogParams{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Close()
+		s := start(l, true)
+
+		c, err := client.New(client.Params{Address: s.Addr().String()})
+		Expect(err).NotTo(HaveOccurred())
+		defer c.Close()
+		var output strings.Builder
+		result, err := c.Stream(context.Background(), model.TaskRequest{Command: []string{"echo", "hello"}}, func(stream string, data []byte) {
+			output.Write(data)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Output).To(BeEmpty())
+		Expect(output.String()).To(Equal("hello\n"))
+
+		Eventually(func() []audit.Record { return readRecords(path) }).Should(HaveLen(2))
+		Expect(readRecords(path)[1].OutputSHA256).To(Equal(audit.OutputHash(output.String())))
+	})
+
+	It("should refuse to run tasks it can't audit when failing closed", func() {
+		s := start(failingSink{}, true)
+
+		result := run(s)
+		Expect(result.ExitCode).To(Equal(-1))
+		Expect(result.Error).To(Equal(constant.TaskResultAuditError))
+		Expect(mockExe.calls.Load()).To(BeZero())
+	})
+
+	It("should still run tasks it can't audit when failing open", func() {
+		s := start(failingSink{}, false)
+
+		Expect(string(run(s).Output)).To(Equal("hello\n"))
+		Expect(mockExe.calls.Load()).To(Equal(int32(1)))
+	})
+})
@@ -0,0 +1,125 @@
+package bench_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/bench"
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/client"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type mockExecutor struct {
+	ExecuteTaskFunc func(ctx context.Context, request *model.TaskRequest) *model.TaskResult
+}
+
+func (m *mockExecutor) ExecuteTask(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+	return m.ExecuteTaskFunc(ctx, request)
+}
+
+var _ = Describe("Bench", func() {
+	var (
+		s           *server.TCPServer
+		c           *client.Client
+		mockExe     *mockExecutor
+		rateLimiter ratelimit.RateLimiter
+	)
+
+	const connections = 4
+
+	BeforeEach(func() {
+		mockExe = &mockExecutor{
+			ExecuteTaskFunc: func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+				time.Sleep(time.Millisecond)
+				return &model.TaskResult{Command: request.Command}
+			},
+		}
+		rateLimiter = ratelimit.NewNoopRateLimiter()
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			Address:      "127.0.0.1:0",
+			Executor:     mockExe,
+			WaitGroup:    &sync.WaitGroup{},
+			ReadTimeout:  3 * time.Second,
+			WriteTimeout: 3 * time.Second,
+			RateLimiter:  rateLimiter,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+
+		c, err = client.New(client.Params{
+			Address:      s.Addr().String(),
+			MaxIdleConns: connections,
+			Retry:        client.Retry{MaxAttempts: 1},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		c.Close()
+		s.Stop()
+	})
+
+	run := func() *bench.Report {
+		return bench.Run(context.Background(), bench.Params{
+			Client:      c,
+			Connections: connections,
+			Requests:    40,
+			Request:     model.TaskRequest{Command: []string{"bench"}},
+		})
+	}
+
+	It("should report throughput and latency percentiles", func() {
+		report := run()
+		Expect(report.Requests).To(Equal(40))
+		Expect(report.Succeeded).To(Equal(40))
+		Expect(report.Failed).To(BeZero())
+		Expect(report.Errors).To(BeEmpty())
+		Expect(report.Command).To(Equal([]string{"bench"}))
+		Expect(report.Throughput).To(BeNumerically(">", 0))
+
+		l := report.Latency
+		Expect(l.Min).To(BeNumerically(">=", 1))
+		Expect(l.Min).To(BeNumerically("<=", l.P50))
+		Expect(l.P50).To(BeNumerically("<=", l.P90))
+		Expect(l.P90).To(BeNumerically("<=", l.P99))
+		Expect(l.P99).To(BeNumerically("<=", l.Max))
+		// The workers kept their connections open
+		Expect(len(s.Connections())).To(BeNumerically("<=", connections))
+	})
+
+	It("should break the failures down by type", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command, ExitCode: 2}
+		}
+		report := run()
+		Expect(report.Failed).To(Equal(40))
+		Expect(report.Errors).To(Equal(map[string]int{bench.ErrorNonZeroExit: 40}))
+	})
+
+	Context("when rate limited", func() {
+		BeforeEach(func() {
+			var err error
+			rateLimiter, err = ratelimit.NewIPRateLimiter(connections/2, time.Minute)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should count the rejections", func() {
+			report := run()
+			Expect(report.Requests).To(Equal(40))
+			Expect(report.RateLimited).To(BeNumerically(">", 0))
+			Expect(report.Errors).To(HaveKeyWithValue(constant.TaskResultRateLimitedError, report.RateLimited))
+			Expect(report.Succeeded + report.Failed).To(Equal(40))
+		})
+	})
+})
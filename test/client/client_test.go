@@ -0,0 +1,301 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/client"
+	"github.com/Oyal2/tcp-server/pkg/codec"
+	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		s           *server.TCPServer
+		c           *client.Client
+		rateLimiter ratelimit.RateLimiter
+		readTimeout time.Duration
+	)
+
+	BeforeEach(func() {
+		var err error
+		rateLimiter, err = ratelimit.NewIPRateLimiter(100, constant.DefaultRateInterval)
+		Expect(err).NotTo(HaveOccurred())
+		readTimeout = 3 * time.Second
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			Address:      "127.0.0.1:0",
+			Executor:     executor.NewCommandExecutorWithParams(executor.CommandExecutorParams{AllowRoot: true}),
+			WaitGroup:    &sync.WaitGroup{},
+			ReadTimeout:  readTimeout,
+			WriteTimeout: 3 * time.Second,
+			RateLimiter:  rateLimiter,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+
+		c, err = client.New(client.Params{
+			Address:      s.Addr().String(),
+			PollInterval: 20 * time.Millisecond,
+			Retry:        client.Retry{InitialBackoff: 50 * time.Millisecond},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		c.Close()
+		s.Stop()
+	})
+
+	It("should run tasks over one pooled connection", func() {
+		for i := 0; i < 3; i++ {
+			result, err := c.Run(context.Background(), model.TaskRequest{Command: []string{printerPath, "-message=pooled"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result.Output)).To(Equal("pooled\n"))
+		}
+		Expect(s.Connections()).To(HaveLen(1))
+	})
+
+	It("should return typed errors for failed tasks", func() {
+		result, err := c.Run(context.Background(), model.TaskRequest{Command: []string{"sh", "-c", "exit 3"}})
+		var exitErr *client.ExitError
+		Expect(errors.As(err, &exitErr)).To(BeTrue())
+		Expect(exitErr.ExitCode).To(Equal(3))
+		Expect(result.ExitCode).To(Equal(3))
+
+		result, err = c.Run(context.Background(), model.TaskRequest{Command: []string{printerPath, "-sleep=1000"}, Timeout: 50})
+		Expect(err).To(MatchError(client.ErrTimeout))
+		Expect(result.Error).To(Equal(constant.TaskResultTimeoutError))
+
+		// The connection is still good after a failed task
+		_, err = c.Run(context.Background(), model.TaskRequest{Command: []string{printerPath}})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should stream the output before the result", func() {
+		var output strings.Builder
+		result, err := c.Stream(context.Background(), model.TaskRequest{Command: []string{printerPath, "-message=chunk", "-repeat=3"}},
+			func(stream string, data []byte) {
+				Expect(stream).To(Equal(model.StreamStdout))
+				output.Write(data)
+			})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(output.String()).To(Equal("chunk\nchunk\nchunk\n"))
+		Expect(result.Type).To(Equal(model.MessageResult))
+		Expect(result.Output).To(BeEmpty())
+		Expect(result.ExitCode).To(Equal(0))
+	})
+
+	It("should kill a killable stream when its context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var output []string
+		result, err := c.StreamKillable(ctx, model.TaskRequest{Command: []string{"sh", "-c", "echo started; sleep 10"}}, func(stream string, data []byte) {
+			output = append(output, string(data))
+			cancel()
+		})
+		Expect(err).To(MatchError(client.ErrKilled))
+		Expect(result.Error).To(Equal(constant.TaskResultKilledError))
+		Expect(output).To(Equal([]string{"started\n"}))
+		Expect(s.Tasks()).To(BeEmpty())
+		// The connection was the task's, it isn't kept for the next request
+		Eventually(s.Connections).Should(BeEmpty())
+	})
+
+	It("should submit jobs and wait for them", func() {
+		job, err := c.Submit(context.Background(), model.TaskRequest{Command: []string{printerPath, "-message=later", "-sleep=100"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(job.JobID).NotTo(BeEmpty())
+		Expect(job.State).To(Equal(model.JobRunning))
+
+		jobs, err := c.Jobs(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(jobs).To(HaveLen(1))
+		Expect(jobs[0].JobID).To(Equal(job.JobID))
+
+		result, err := c.Wait(context.Background(), job.JobID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(result.Output)).To(Equal("later\n"))
+
+		status, err := c.Status(context.Background(), job.JobID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.State).To(Equal(model.JobDone))
+		Expect(string(status.Result.Output)).To(Equal("later\n"))
+	})
+
+	It("should cancel jobs", func() {
+		job, err := c.Submit(context.Background(), model.TaskRequest{Command: []string{printerPath, "-sleep=10000"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = c.Cancel(context.Background(), job.JobID)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = c.Wait(context.Background(), job.JobID)
+		Expect(err).To(MatchError(client.ErrKilled))
+
+		_, err = c.Status(context.Background(), "unknown")
+		Expect(err).To(MatchError(client.ErrJobNotFound))
+	})
+
+	It("should send large requests in length prefixed frames", func() {
+		framed, err := client.New(client.Params{
+			Address: s.Addr().String(),
+			Framing: model.FramingLengthPrefixed,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer framed.Close()
+
+		// Over the 64 KiB a line used to be limited to
+		message := strings.Repeat("a", 100*1024)
+		result, err := framed.Run(context.Background(), model.TaskRequest{Command: []string{printerPath, "-message=" + message}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(result.Output)).To(Equal(message + "\n"))
+
+		var output strings.Builder
+		_, err = framed.Stream(context.Background(), model.TaskRequest{Command: []string{printerPath, "-message=framed", "-repeat=2"}},
+			func(stream string, data []byte) {
+				output.Write(data)
+			})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(output.String()).To(Equal("framed\nframed\n"))
+		Expect(s.Connections()).To(HaveLen(1))
+	})
+
+	DescribeTable("should pass binary output through every codec",
+		func(name string) {
+			binary, err := client.New(client.Params{Address: s.Addr().String(), Codec: name})
+			Expect(err).NotTo(HaveOccurred())
+			defer binary.Close()
+
+			// Bytes that aren't UTF-8 are base64 encoded in JSON
+			command := []string{"sh", "-c", `printf '\377\000\376'`}
+			result, err := binary.Run(context.Background(), model.TaskRequest{Command: command})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Output).To(Equal(model.Bytes{0xff, 0x00, 0xfe}))
+
+			var output []byte
+			_, err = binary.Stream(context.Background(), model.TaskRequest{Command: command}, func(stream string, data []byte) {
+				output = append(output, data...)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(output).To(Equal([]byte{0xff, 0x00, 0xfe}))
+
+			job, err := binary.Submit(context.Background(), model.TaskRequest{Command: command})
+			Expect(err).NotTo(HaveOccurred())
+			result, err = binary.Wait(context.Background(), job.JobID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Output).To(Equal(model.Bytes{0xff, 0x00, 0xfe}))
+			jobs, err := binary.Jobs(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(jobs).To(HaveLen(1))
+		},
+		Entry("json", codec.JSON),
+		Entry("msgpack", codec.MessagePack),
+		Entry("cbor", codec.CBOR),
+	)
+
+	DescribeTable("should decompress the responses",
+		func(params client.Params) {
+			params.Address = s.Addr().String()
+			compressed, err := client.New(params)
+			Expect(err).NotTo(HaveOccurred())
+			defer compressed.Close()
+
+			// Several requests go over the same stream
+			for i := 0; i < 2; i++ {
+				result, err := compressed.Run(context.Background(), model.TaskRequest{Command: []string{printerPath, "-message=log line", "-repeat=500"}})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(result.Output)).To(Equal(strings.Repeat("log line\n", 500)))
+			}
+			var output strings.Builder
+			_, err = compressed.Stream(context.Background(), model.TaskRequest{Command: []string{printerPath, "-message=chunk", "-repeat=3"}},
+				func(stream string, data []byte) {
+					output.Write(data)
+				})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(output.String()).To(Equal("chunk\nchunk\nchunk\n"))
+			Expect(s.Connections()).To(HaveLen(1))
+		},
+		Entry("in lines", client.Params{Compression: model.CompressionGzip}),
+		Entry("in length prefixed frames", client.Params{Compression: model.CompressionGzip, Codec: codec.CBOR}),
+	)
+
+	Context("when rate limited", func() {
+		BeforeEach(func() {
+			var err error
+			rateLimiter, err = ratelimit.NewIPRateLimiter(1, 200*time.Millisecond)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should back off and retry", func() {
+			// Every request needs a new connection, the second one has to wait out the limit
+			unpooled, err := client.New(client.Params{
+				Address:      s.Addr().String(),
+				MaxIdleConns: -1,
+				Retry:        client.Retry{InitialBackoff: 100 * time.Millisecond},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer unpooled.Close()
+
+			for i := 0; i < 2; i++ {
+				_, err := unpooled.Run(context.Background(), model.TaskRequest{Command: []string{printerPath}})
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("should give up after the last attempt", func() {
+			once, err := client.New(client.Params{
+				Address:      s.Addr().String(),
+				MaxIdleConns: -1,
+				Retry:        client.Retry{MaxAttempts: 1},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer once.Close()
+
+			_, err = once.Run(context.Background(), model.TaskRequest{Command: []string{printerPath}})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := once.Run(context.Background(), model.TaskRequest{Command: []string{printerPath}})
+			Expect(err).To(MatchError(client.ErrRateLimited))
+			Expect(result.Error).To(Equal(constant.TaskResultRateLimitedError))
+
+			// The server turns the connection away before the framing is agreed on
+			framed, err := client.New(client.Params{
+				Address: s.Addr().String(),
+				Framing: model.FramingLengthPrefixed,
+				Retry:   client.Retry{MaxAttempts: 1},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer framed.Close()
+			_, err = framed.Run(context.Background(), model.TaskRequest{Command: []string{printerPath}})
+			Expect(err).To(MatchError(client.ErrRateLimited))
+		})
+	})
+
+	Context("when the server closes idle connections", func() {
+		BeforeEach(func() {
+			readTimeout = 100 * time.Millisecond
+		})
+
+		It("should reconnect", func() {
+			_, err := c.Run(context.Background(), model.TaskRequest{Command: []string{printerPath}})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(s.Connections).Should(BeEmpty())
+
+			result, err := c.Run(context.Background(), model.TaskRequest{Command: []string{printerPath, "-message=again"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(result.Output)).To(Equal("again\n"))
+		})
+	})
+})
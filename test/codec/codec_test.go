@@ -0,0 +1,73 @@
+package codec_test
+
+import (
+	"encoding/json"
+
+	"github.com/Oyal2/tcp-server/pkg/codec"
+	"github.com/Oyal2/tcp-server/pkg/model"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Codec", func() {
+	binary := model.Bytes{0xff, 0x00, 0xfe, '\n'}
+
+	DescribeTable("should round trip messages with binary output",
+		func(name string) {
+			c, ok := codec.Get(name)
+			Expect(ok).To(BeTrue())
+
+			b, err := c.Marshal(&model.TaskResult{Type: model.MessageResult, Command: []string{"cat"}, ExitCode: 3, Output: binary})
+			Expect(err).NotTo(HaveOccurred())
+			var result model.TaskResult
+			Expect(c.Unmarshal(b, &result)).To(Succeed())
+			Expect(result.Command).To(Equal([]string{"cat"}))
+			Expect(result.ExitCode).To(Equal(3))
+			Expect(result.Output).To(Equal(binary))
+
+			// Requests are keyed like their JSON, so optional fields are left out too
+			b, err = c.Marshal(&model.TaskRequest{Command: []string{"ls"}, Stream: true})
+			Expect(err).NotTo(HaveOccurred())
+			var request map[string]any
+			Expect(c.Unmarshal(b, &request)).To(Succeed())
+			Expect(request).To(HaveLen(2))
+			Expect(request).To(HaveKey("command"))
+			Expect(request).To(HaveKeyWithValue("stream", true))
+		},
+		Entry("msgpack", codec.MessagePack),
+		Entry("cbor", codec.CBOR),
+	)
+
+	It("should keep output a string in JSON", func() {
+		c, ok := codec.Get(codec.JSON)
+		Expect(ok).To(BeTrue())
+		Expect(c.Binary()).To(BeFalse())
+
+		b, err := c.Marshal(&model.OutputFrame{Type: model.MessageOutput, Stream: model.StreamStdout, Data: model.Bytes("line\n")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(b)).To(Equal(`{"type":"output","stream":"stdout","data":"line\n"}`))
+
+		var frame model.OutputFrame
+		Expect(json.Unmarshal(b, &frame)).To(Succeed())
+		Expect(string(frame.Data)).To(Equal("line\n"))
+	})
+
+	It("should take codecs registered by others", func() {
+		Expect(codec.Names()).To(Equal([]string{codec.CBOR, codec.JSON, codec.MessagePack}))
+		codec.Register(namedCodec{name: "custom"})
+		c, ok := codec.Get("custom")
+		Expect(ok).To(BeTrue())
+		Expect(c.Name()).To(Equal("custom"))
+	})
+})
+
+// namedCodec is JSON under another name
+type namedCodec struct {
+	name string
+}
+
+func (n namedCodec) Name() string                     { return n.name }
+func (namedCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (namedCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (namedCodec) Binary() bool                       { return false }
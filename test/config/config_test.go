@@ -0,0 +1,126 @@
+package config_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/config"
+	"github.com/Oyal2/tcp-server/internal/constant"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	var dir string
+
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("should use the defaults when nothing is set", func() {
+		cfg, err := config.Load("tcp", nil, nil, io.Discard)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Listen).To(Equal([]string{constant.DefaultListenAddress}))
+		Expect(cfg.ReadTimeout).To(Equal(constant.DefaultReadTimeout))
+		Expect(cfg.RateLimit.Type).To(Equal(config.RateLimiterIP))
+		Expect(cfg.RateLimit.Limit).To(Equal(constant.DefaultRateLimit))
+	})
+
+	DescribeTable("should read every supported file format",
+		func(name, content string) {
+			cfg, err := config.Load("tcp", []string{"-config", writeFile(name, content)}, nil, io.Discard)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Listen).To(Equal([]string{"127.0.0.1:4000"}))
+			Expect(cfg.ReadTimeout).To(Equal(5 * time.Second))
+			Expect(cfg.RateLimit.Limit).To(Equal(20))
+			Expect(cfg.Log.Format).To(Equal(config.LogFormatJSON))
+		},
+		Entry("yaml", "server.yaml", "listen: 127.0.0.1:4000\nread_timeout: 5s\nrate_limit:\n  limit: 20\nlog:\n  format: json\n"),
+		Entry("toml", "server.toml", "listen = \"127.0.0.1:4000\"\nread_timeout = \"5s\"\n[rate_limit]\nlimit = 20\n[log]\nformat = \"json\"\n"),
+		Entry("json", "server.json", `{"listen":"127.0.0.1:4000","read_timeout":"5s","rate_limit":{"limit":20},"log":{"format":"json"}}`),
+	)
+
+	It("should prefer flags over env vars over the file", func() {
+		path := writeFile("server.yaml", "listen: :1000\nread_timeout: 1s\nrate_limit:\n  limit: 1\n")
+		env := []string{
+			config.EnvConfigFile + "=" + path,
+			"TCP_SERVER_READ_TIMEOUT=2s",
+			"TCP_SERVER_RATE_LIMIT_LIMIT=2",
+		}
+		cfg, err := config.Load("tcp", []string{"-rate-limit.limit", "3"}, env, io.Discard)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Listen).To(Equal([]string{":1000"}))
+		Expect(cfg.ReadTimeout).To(Equal(2 * time.Second))
+		Expect(cfg.RateLimit.Limit).To(Equal(3))
+	})
+
+	DescribeTable("should point at the bad key",
+		func(args []string, env []string, key string) {
+			_, err := config.Load("tcp", args, env, io.Discard)
+			Expect(err).To(HaveOccurred())
+
+			var cfgErr *config.Error
+			Expect(errors.As(err, &cfgErr)).To(BeTrue())
+			Expect(cfgErr.Key).To(Equal(key))
+			Expect(err.Error()).To(ContainSubstring(key))
+		},
+		Entry("bad duration from env", nil, []string{"TCP_SERVER_WRITE_TIMEOUT=soon"}, "write_timeout"),
+		Entry("bad integer from flag", []string{"-executor.max-concurrent", "many"}, nil, "executor.max_concurrent"),
+		Entry("invalid limit", []string{"-rate-limit.limit", "0"}, nil, "rate_limit.limit"),
+		Entry("empty max frame size", []string{"-max-frame-size", "0"}, nil, "max_frame_size"),
+		Entry("http gateway without a port", []string{"-http.listen", "127.0.0.1"}, nil, "http.listen"),
+		Entry("websocket listener without a port", nil, []string{"TCP_SERVER_WEBSOCKET_LISTEN=localhost"}, "websocket.listen"),
+		Entry("grpc listener without a port", []string{"-grpc.listen", "localhost"}, nil, "grpc.listen"),
+		Entry("unknown limiter", []string{"-rate-limit.type", "token"}, nil, "rate_limit.type"),
+		Entry("bad listener", []string{"-listen", "udp://:53"}, nil, "listen"),
+		Entry("tls certificate without a key", []string{"-tls.cert-file", "server.crt"}, nil, "tls.key_file"),
+		Entry("tls key without a certificate", nil, []string{"TCP_SERVER_TLS_KEY_FILE=server.key"}, "tls.cert_file"),
+		Entry("unknown log level", nil, []string{"TCP_SERVER_LOG_LEVEL=loud"}, "log.level"),
+		Entry("unknown trace exporter", []string{"-tracing.exporter", "zipkin"}, nil, "tracing.exporter"),
+		Entry("file exporter without a file", []string{"-tracing.exporter", "file"}, nil, "tracing.file"),
+		Entry("fail closed without an audit file", []string{"-audit.fail-closed=true"}, nil, "audit.fail_closed"),
+		Entry("bad boolean from env", nil, []string{"TCP_SERVER_AUDIT_FAIL_CLOSED=maybe"}, "audit.fail_closed"),
+		Entry("run_as without a user", []string{"-executor.run-as", ":staff"}, nil, "executor.run_as"),
+		Entry("run_as policy with an empty group", []string{"-policy.run-as", "nobody,deploy:"}, nil, "policy.run_as"),
+	)
+
+	It("should read a list of listeners", func() {
+		path := writeFile("server.yaml", "listen:\n  - tcp://127.0.0.1:3000\n  - unix:///tmp/tcp-server.sock?mode=0660\n")
+		cfg, err := config.Load("tcp", []string{"-config", path}, nil, io.Discard)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Listen).To(Equal([]string{"tcp://127.0.0.1:3000", "unix:///tmp/tcp-server.sock?mode=0660"}))
+
+		cfg, err = config.Load("tcp", nil, []string{"TCP_SERVER_LISTEN=tcp://[::1]:3000, unix://@tcp-server"}, io.Discard)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Listen).To(Equal([]string{"tcp://[::1]:3000", "unix://@tcp-server"}))
+	})
+
+	It("should read a list of auth tokens", func() {
+		path := writeFile("server.yaml", "auth:\n  tokens:\n    - first\n    - second\n")
+		cfg, err := config.Load("tcp", []string{"-config", path}, nil, io.Discard)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Auth.Tokens).To(Equal([]string{"first", "second"}))
+
+		cfg, err = config.Load("tcp", nil, []string{"TCP_SERVER_AUTH_TOKENS=third"}, io.Discard)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Auth.Tokens).To(Equal([]string{"third"}))
+	})
+
+	It("should reject unknown keys in the file", func() {
+		path := writeFile("server.yaml", "rate_limit:\n  limt: 5\n")
+		_, err := config.Load("tcp", []string{"-config", path}, nil, io.Discard)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("rate_limit.limt"))
+		Expect(err.Error()).To(ContainSubstring(path))
+	})
+})
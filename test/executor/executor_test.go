@@ -1,12 +1,17 @@
 package executor_test
 
 import (
+	"bytes"
 	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Oyal2/tcp-server/internal/constant"
-	"github.com/Oyal2/tcp-server/internal/model"
 	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -16,7 +21,7 @@ var _ = Describe("CommandExecutor", func() {
 	var exe *executor.CommandExecutor
 
 	BeforeEach(func() {
-		exe = executor.NewCommandExecutor()
+		exe = executor.NewCommandExecutorWithParams(executor.CommandExecutorParams{AllowRoot: true})
 	})
 
 	It("should execute a simple command", func() {
@@ -29,7 +34,7 @@ var _ = Describe("CommandExecutor", func() {
 		result := exe.ExecuteTask(ctx, request)
 
 		Expect(result.ExitCode).To(Equal(0))
-		Expect(result.Output).To(Equal("test\n"))
+		Expect(string(result.Output)).To(Equal("test\n"))
 		Expect(result.Error).To(BeEmpty())
 	})
 
@@ -73,6 +78,13 @@ var _ = Describe("CommandExecutor", func() {
 		Expect(result.Error).To(Equal(constant.TaskResultCommandNilError))
 	})
 
+	It("should handle an empty command list", func() {
+		result := exe.ExecuteTask(context.Background(), &model.TaskRequest{Command: []string{}})
+
+		Expect(result.ExitCode).To(Equal(-1))
+		Expect(result.Error).To(Equal(constant.TaskResultCommandNilError))
+	})
+
 	It("should handle empty command", func() {
 		request := &model.TaskRequest{
 			Command: []string{""},
@@ -87,4 +99,155 @@ var _ = Describe("CommandExecutor", func() {
 		Expect(result.Error).To(Equal("exec: no command"))
 	})
 
+	It("should wait for a free slot when limiting concurrent tasks", func() {
+		exe = executor.NewCommandExecutorWithParams(executor.CommandExecutorParams{MaxConcurrent: 1, AllowRoot: true})
+
+		// Occupy the only slot with a slow task
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			exe.ExecuteTask(context.Background(), &model.TaskRequest{Command: []string{printerPath, "-sleep=500"}})
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		result := exe.ExecuteTask(ctx, &model.TaskRequest{Command: []string{printerPath}, Timeout: 100})
+
+		Expect(result.ExitCode).To(Equal(-1))
+		Expect(result.Error).To(Equal(constant.TaskResultTimeoutError))
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("should kill the child processes of a task that times out", func() {
+		request := &model.TaskRequest{
+			// The shell starts a child that holds on to the output pipe
+			Command: []string{"sh", "-c", "sleep 10; echo done"},
+			Timeout: 100,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request.Timeout)*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		result := exe.ExecuteTask(ctx, request)
+
+		Expect(result.ExitCode).To(Equal(-1))
+		Expect(result.Error).To(Equal(constant.TaskResultTimeoutError))
+		Expect(time.Since(start)).To(BeNumerically("<", constant.DefaultWaitDelay))
+	})
+
+	It("should run an interactive task in a terminal of the requested size", func() {
+		request := &model.TaskRequest{
+			Command:     []string{"sh", "-c", "stty size; read x; echo got $x"},
+			Timeout:     5000,
+			Interactive: true,
+			Window:      &model.Window{Rows: 30, Cols: 100},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request.Timeout)*time.Millisecond)
+		defer cancel()
+
+		var (
+			mu     sync.Mutex
+			output bytes.Buffer
+		)
+		input := make(chan executor.TerminalInput, 1)
+		input <- executor.TerminalInput{Data: []byte("hello\n")}
+		result := exe.ExecuteTaskInteractive(ctx, request, input, func(stream string, data []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(stream).To(Equal(model.StreamStdout))
+			output.Write(data)
+		})
+
+		Expect(result.ExitCode).To(Equal(0))
+		Expect(result.Error).To(BeEmpty())
+		Expect(result.Output).To(BeEmpty())
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(output.String()).To(ContainSubstring("30 100"))
+		Expect(output.String()).To(ContainSubstring("got hello"))
+	})
+
+	It("should run a task as the user it asks for or the default one", func() {
+		if os.Geteuid() != 0 {
+			Skip("switching users needs root")
+		}
+		exe = executor.NewCommandExecutorWithParams(executor.CommandExecutorParams{RunAs: "65534:65534"})
+		for runAs, expected := range map[string]string{"": "65534 65534\n", "1000:1000": "1000 1000\n"} {
+			request := &model.TaskRequest{
+				Command: []string{"sh", "-c", "echo $(id -u) $(id -g)"},
+				Timeout: 1000,
+				RunAs:   runAs,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request.Timeout)*time.Millisecond)
+			defer cancel()
+			result := exe.ExecuteTask(ctx, request)
+
+			Expect(result.Error).To(BeEmpty())
+			Expect(string(result.Output)).To(Equal(expected))
+		}
+	})
+
+	It("should refuse to run a task as root unless allowed", func() {
+		exe = executor.NewCommandExecutor()
+		runAs := []string{"root", "0:0"}
+		// Without a run_as the task would run as the server
+		if os.Geteuid() == 0 {
+			runAs = append(runAs, "")
+		}
+		for _, user := range runAs {
+			request := &model.TaskRequest{Command: []string{"id"}, Timeout: 1000, RunAs: user}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request.Timeout)*time.Millisecond)
+			defer cancel()
+			result := exe.ExecuteTask(ctx, request)
+
+			Expect(result.ExitCode).To(Equal(-1))
+			Expect(result.Error).To(Equal(constant.TaskResultRootNotAllowedError))
+		}
+	})
+
+	It("should feed stdin to a task until it ends", func() {
+		request := &model.TaskRequest{
+			Command: []string{"cat"},
+			Timeout: 1000,
+			Stdin:   true,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request.Timeout)*time.Millisecond)
+		defer cancel()
+		result := exe.ExecuteTaskStdin(ctx, request, strings.NewReader("hello"), nil)
+
+		Expect(result.ExitCode).To(Equal(0))
+		Expect(string(result.Output)).To(Equal("hello"))
+	})
+
+	It("should not wait for stdin to end once the task exits", func() {
+		request := &model.TaskRequest{
+			Command: []string{"true"},
+			Timeout: 1000,
+			Stdin:   true,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request.Timeout)*time.Millisecond)
+		defer cancel()
+		stdin, w := io.Pipe()
+		defer w.Close()
+		result := exe.ExecuteTaskStdin(ctx, request, stdin, nil)
+
+		Expect(result.ExitCode).To(Equal(0))
+		Expect(result.Error).To(BeEmpty())
+	})
+
+	It("should end an interactive task at its timeout", func() {
+		request := &model.TaskRequest{
+			Command:     []string{"sh", "-c", "read x"},
+			Timeout:     100,
+			Interactive: true,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request.Timeout)*time.Millisecond)
+		defer cancel()
+
+		result := exe.ExecuteTaskInteractive(ctx, request, make(chan executor.TerminalInput), func(string, []byte) {})
+
+		Expect(result.ExitCode).To(Equal(-1))
+		Expect(result.Error).To(Equal(constant.TaskResultTimeoutError))
+	})
 })
@@ -1,6 +1,7 @@
 package helper
 
 import (
+	"net"
 	"os/exec"
 	"path/filepath"
 	"runtime"
@@ -19,3 +20,36 @@ func BuildPrinterExecutable() (string, error) {
 	}
 	return filepath.Abs(filepath.Join(cmd.Dir, filename))
 }
+
+// BuildServerExecutable builds cmd/tcp into dir and returns the path to the binary
+func BuildServerExecutable(dir string) (string, error) {
+	return buildCommand(dir, "tcp-server", "./cmd/tcp")
+}
+
+// BuildCtlExecutable builds cmd/tcpctl into dir and returns the path to the binary
+func BuildCtlExecutable(dir string) (string, error) {
+	return buildCommand(dir, "tcpctl", "./cmd/tcpctl")
+}
+
+func buildCommand(dir, filename, pkg string) (string, error) {
+	if runtime.GOOS == "windows" {
+		filename += ".exe"
+	}
+	path := filepath.Join(dir, filename)
+	cmd := exec.Command("go", "build", "-o", path, pkg)
+	cmd.Dir = filepath.Join("..", "..")
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// FreePort returns a tcp port on localhost that nothing is listening on
+func FreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
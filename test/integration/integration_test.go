@@ -9,9 +9,9 @@ import (
 	"time"
 
 	"github.com/Oyal2/tcp-server/internal/constant"
-	"github.com/Oyal2/tcp-server/internal/model"
 	"github.com/Oyal2/tcp-server/internal/server"
 	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
 	"github.com/Oyal2/tcp-server/pkg/ratelimit"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -30,7 +30,7 @@ var _ = Describe("Integration", func() {
 	)
 
 	BeforeEach(func() {
-		exe := &executor.CommandExecutor{}
+		exe := executor.NewCommandExecutorWithParams(executor.CommandExecutorParams{AllowRoot: true})
 		port = 0
 		rateLimiter, err := ratelimit.NewIPRateLimiter(100, constant.DefaultRateInterval)
 		Expect(err).NotTo(HaveOccurred())
@@ -73,7 +73,7 @@ var _ = Describe("Integration", func() {
 		err = json.NewDecoder(conn).Decode(&response)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(response.Command).To(Equal(request.Command))
-		Expect(response.Output).To(Equal("simple_test\n"))
+		Expect(string(response.Output)).To(Equal("simple_test\n"))
 		Expect(response.ExitCode).To(Equal(0))
 	})
 
@@ -103,7 +103,7 @@ var _ = Describe("Integration", func() {
 				err = json.NewDecoder(conn).Decode(&response)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(response.Command).To(Equal(request.Command))
-				Expect(response.Output).To(Equal("concurrency_test\n"))
+				Expect(string(response.Output)).To(Equal("concurrency_test\n"))
 				Expect(response.ExitCode).To(Equal(0))
 			}()
 		}
@@ -131,7 +131,7 @@ var _ = Describe("Integration", func() {
 			err = json.NewDecoder(conn).Decode(&response)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(response.Command).To(Equal(request.Command))
-			Expect(response.Output).To(Equal("test\n"))
+			Expect(string(response.Output)).To(Equal("test\n"))
 			Expect(response.ExitCode).To(Equal(0))
 		})
 
@@ -154,7 +154,7 @@ var _ = Describe("Integration", func() {
 			err = json.NewDecoder(conn).Decode(&response)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(response.Command).To(Equal(request.Command))
-			Expect(response.Output).To(Equal("repeated\nrepeated\nrepeated\n"))
+			Expect(string(response.Output)).To(Equal("repeated\nrepeated\nrepeated\n"))
 			Expect(response.ExitCode).To(Equal(0))
 		})
 
@@ -0,0 +1,13 @@
+package listener_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestListener(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Listener Suite")
+}
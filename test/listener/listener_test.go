@@ -0,0 +1,115 @@
+package listener_test
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/Oyal2/tcp-server/internal/listener"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Listener", func() {
+	Context("ParseSpec", func() {
+		DescribeTable("should parse valid specs",
+			func(s string, expected listener.Spec) {
+				spec, err := listener.ParseSpec(s)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(spec).To(Equal(expected))
+			},
+			Entry("plain address", ":3000", listener.Spec{Network: "tcp", Address: ":3000"}),
+			Entry("tcp", "tcp://127.0.0.1:3000", listener.Spec{Network: "tcp", Address: "127.0.0.1:3000"}),
+			Entry("tcp ipv6", "tcp://[::1]:3000", listener.Spec{Network: "tcp", Address: "[::1]:3000"}),
+			Entry("unix", "unix:///run/tcp-server.sock", listener.Spec{Network: "unix", Address: "/run/tcp-server.sock"}),
+			Entry("unix with options", "unix:///run/tcp-server.sock?mode=0660&owner=0&group=0",
+				listener.Spec{Network: "unix", Address: "/run/tcp-server.sock", Mode: 0o660, Owner: "0", Group: "0"}),
+			Entry("abstract unix", "unix://@tcp-server", listener.Spec{Network: "unix", Address: "@tcp-server"}),
+		)
+
+		DescribeTable("should reject invalid specs",
+			func(s string) {
+				_, err := listener.ParseSpec(s)
+				Expect(err).To(HaveOccurred())
+			},
+			Entry("missing port", "localhost"),
+			Entry("unknown scheme", "udp://:53"),
+			Entry("tcp options", "tcp://:3000?mode=0660"),
+			Entry("missing path", "unix://"),
+			Entry("bad mode", "unix:///tmp/s.sock?mode=rw"),
+			Entry("unknown option", "unix:///tmp/s.sock?color=red"),
+			Entry("abstract with mode", "unix://@tcp-server?mode=0660"),
+		)
+	})
+
+	Context("Listen", func() {
+		It("should create a unix socket with the requested mode", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "server.sock")
+			spec, err := listener.ParseSpec("unix://" + path + "?mode=0600")
+			Expect(err).NotTo(HaveOccurred())
+
+			l, err := listener.Listen(spec)
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+
+			info, err := os.Stat(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode() & fs.ModeSocket).NotTo(BeZero())
+			Expect(info.Mode().Perm()).To(Equal(fs.FileMode(0o600)))
+		})
+
+		It("should refuse to replace a file that is not a socket", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "server.sock")
+			Expect(os.WriteFile(path, []byte("data"), 0o600)).To(Succeed())
+
+			_, err := listener.Listen(listener.Spec{Network: "unix", Address: path})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("PeerOf", func() {
+		It("should identify unix clients by their uid", func() {
+			spec := listener.Spec{Network: "unix", Address: fmt.Sprintf("@tcp-server-test-%d", GinkgoRandomSeed())}
+			l, err := listener.Listen(spec)
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+
+			client, err := net.Dial("unix", spec.Address)
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+
+			conn, err := l.Accept()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			peer, err := listener.PeerOf(conn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(peer.Unix).To(BeTrue())
+			Expect(peer.UID).To(Equal(os.Getuid()))
+			Expect(peer.GID).To(Equal(os.Getgid()))
+			Expect(peer.PID).To(Equal(os.Getpid()))
+			Expect(peer.Identity()).To(Equal(fmt.Sprintf("uid:%d", os.Getuid())))
+		})
+
+		It("should identify tcp clients by their ip", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+
+			client, err := net.Dial("tcp", l.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+
+			conn, err := l.Accept()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			peer, err := listener.PeerOf(conn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(peer.Identity()).To(Equal("127.0.0.1"))
+		})
+	})
+})
@@ -0,0 +1,186 @@
+package metrics_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/client"
+	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// metricValue reads a counter, gauge or histogram sample count from the default registry
+func metricValue(name string, labels map[string]string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if matchLabels(metric, labels) {
+				switch {
+				case metric.Counter != nil:
+					return metric.GetCounter().GetValue()
+				case metric.Gauge != nil:
+					return metric.GetGauge().GetValue()
+				case metric.Histogram != nil:
+					return float64(metric.GetHistogram().GetSampleCount())
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func matchLabels(metric *dto.Metric, labels map[string]string) bool {
+	found := 0
+	for _, pair := range metric.GetLabel() {
+		if v, ok := labels[pair.GetName()]; ok && v == pair.GetValue() {
+			found++
+		}
+	}
+	return found == len(labels)
+}
+
+var _ = Describe("Metrics", func() {
+	var (
+		s           *server.TCPServer
+		rateLimiter *ratelimit.IPRateLimiter
+	)
+
+	run := func(request string) model.TaskResult {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte(request + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		var response model.TaskResult
+		_ = json.NewDecoder(conn).Decode(&response)
+		return response
+	}
+
+	BeforeEach(func() {
+		var err error
+		rateLimiter, err = ratelimit.NewIPRateLimiter(4, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			Listen:       []string{"tcp://127.0.0.1:0"},
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			Executor:     executor.NewCommandExecutorWithParams(executor.CommandExecutorParams{MaxConcurrent: 2, AllowRoot: true}),
+			RateLimiter:  rateLimiter,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+	})
+
+	AfterEach(func() {
+		s.Stop()
+	})
+
+	It("should count requests by outcome", func() {
+		outcome := func(o string) float64 {
+			return metricValue("tcp_server_requests_total", map[string]string{"outcome": o})
+		}
+		success, nonZero, timeout, parseError, rateLimited := outcome("success"), outcome("non_zero_exit"), outcome("timeout"), outcome("parse_error"), outcome("rate_limited")
+		accepted := metricValue("tcp_server_connections_accepted_total", nil)
+		durations := metricValue("tcp_server_task_duration_seconds", nil)
+		outputBytes := metricValue("tcp_server_task_output_bytes_total", nil)
+		allowed := metricValue("tcp_server_ratelimit_checks_total", map[string]string{"result": "allowed"})
+		denied := metricValue("tcp_server_ratelimit_checks_total", map[string]string{"result": "denied"})
+
+		run(`{"command":["` + printerPath + `","-message=hello"]}`)
+		run(`{"command":["sh","-c","exit 3"]}`)
+		run(`{"command":["` + printerPath + `","-sleep=500"],"timeout":50}`)
+		run(`not json`)
+		// The limiter allows 4 connections per minute
+		run(`{"command":["` + printerPath + `"]}`)
+
+		Expect(outcome("success")).To(Equal(success + 1))
+		Expect(outcome("non_zero_exit")).To(Equal(nonZero + 1))
+		Expect(outcome("timeout")).To(Equal(timeout + 1))
+		Expect(outcome("parse_error")).To(Equal(parseError + 1))
+		Expect(outcome("rate_limited")).To(Equal(rateLimited + 1))
+		Expect(metricValue("tcp_server_connections_accepted_total", nil)).To(Equal(accepted + 5))
+		Expect(metricValue("tcp_server_task_duration_seconds", nil)).To(Equal(durations + 3))
+		Expect(metricValue("tcp_server_task_output_bytes_total", nil)).To(Equal(outputBytes + float64(len("hello\n"))))
+		Expect(metricValue("tcp_server_ratelimit_tracked_ips", nil)).To(Equal(float64(len(rateLimiter.IPs()))))
+		Expect(metricValue("tcp_server_ratelimit_checks_total", map[string]string{"result": "allowed"})).To(Equal(allowed + 4))
+		Expect(metricValue("tcp_server_ratelimit_checks_total", map[string]string{"result": "denied"})).To(Equal(denied + 1))
+		Expect(metricValue("tcp_server_executor_max_concurrent", nil)).To(Equal(2.0))
+		Eventually(func() float64 { return metricValue("tcp_server_connections_active", nil) }).Should(BeZero())
+	})
+
+	It("should only count the ips of the current rate limiter", func() {
+		run(`{"command":["` + printerPath + `"]}`)
+		Eventually(func() float64 { return metricValue("tcp_server_ratelimit_tracked_ips", nil) }).Should(Equal(1.0))
+
+		// A reload swaps in a new limiter, the old one keeps its table but isn't used any more
+		newRateLimiter, err := ratelimit.NewIPRateLimiter(4, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			RateLimiter:  newRateLimiter,
+		})
+		Expect(metricValue("tcp_server_ratelimit_tracked_ips", nil)).To(BeZero())
+		rateLimiter.Allow("10.0.0.1")
+		Expect(metricValue("tcp_server_ratelimit_tracked_ips", nil)).To(BeZero())
+
+		newRateLimiter.Allow("10.0.0.1")
+		newRateLimiter.Allow("10.0.0.2")
+		Expect(metricValue("tcp_server_ratelimit_tracked_ips", nil)).To(Equal(2.0))
+	})
+
+	It("should count the ips the rate limiter cleans", func() {
+		cleaned := metricValue("tcp_server_ratelimit_cleaned_ips_total", nil)
+		shortLimiter, err := ratelimit.NewIPRateLimiter(1, time.Millisecond)
+		Expect(err).NotTo(HaveOccurred())
+		shortLimiter.Allow("10.0.0.1")
+		shortLimiter.Allow("10.0.0.2")
+		time.Sleep(5 * time.Millisecond)
+		shortLimiter.Clean()
+		Expect(metricValue("tcp_server_ratelimit_cleaned_ips_total", nil)).To(Equal(cleaned + 2))
+	})
+
+	It("should track the compression ratio", func() {
+		input := metricValue("tcp_server_compression_input_bytes_total", nil)
+		output := metricValue("tcp_server_compression_output_bytes_total", nil)
+
+		c, err := client.New(client.Params{Address: s.Addr().String(), Compression: model.CompressionGzip})
+		Expect(err).NotTo(HaveOccurred())
+		defer c.Close()
+		_, err = c.Run(context.Background(), model.TaskRequest{Command: []string{printerPath, "-message=compressible", "-repeat=1000"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		// The repeated lines shrink to a fraction
+		sent := metricValue("tcp_server_compression_output_bytes_total", nil) - output
+		Expect(sent).To(BeNumerically(">", 0))
+		Expect(metricValue("tcp_server_compression_input_bytes_total", nil) - input).To(BeNumerically(">", 10*sent))
+	})
+
+	It("should expose the metrics in the Prometheus text format", func() {
+		run(`{"command":["` + printerPath + `"]}`)
+
+		recorder := httptest.NewRecorder()
+		promhttp.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body := recorder.Body.String()
+		Expect(body).To(ContainSubstring(`tcp_server_requests_total{outcome="success"}`))
+		Expect(body).To(ContainSubstring(`tcp_server_task_duration_seconds_bucket`))
+		Expect(body).To(ContainSubstring(`tcp_server_executor_tasks_running 0`))
+		Expect(body).To(ContainSubstring(`tcp_server_executor_tasks_queued 0`))
+	})
+})
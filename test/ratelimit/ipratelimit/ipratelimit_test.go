@@ -46,6 +46,26 @@ var _ = Describe("IpRateLimit", func() {
 		})
 	})
 
+	Context("Update", func() {
+		It("should apply the new limit to ips it already tracks", func() {
+			ip := "192.168.1.1"
+			for i := 0; i < limit; i++ {
+				Expect(rateLimiter.Allow(ip)).To(BeTrue())
+			}
+			Expect(rateLimiter.Allow(ip)).To(BeFalse())
+
+			Expect(rateLimiter.Update(limit+1, interval)).To(Succeed())
+			Expect(rateLimiter.Limit()).To(Equal(limit + 1))
+			Expect(rateLimiter.Allow(ip)).To(BeTrue())
+			Expect(rateLimiter.Allow(ip)).To(BeFalse())
+		})
+
+		It("should reject an invalid limit", func() {
+			Expect(rateLimiter.Update(0, interval)).NotTo(Succeed())
+			Expect(rateLimiter.Limit()).To(Equal(limit))
+		})
+	})
+
 	Context("Cleanup", func() {
 		It("should remove ips that are passed the interval time", func() {
 			ips := []string{"0.0.0.1", "0.0.0.2", "0.0.0.3"}
@@ -66,4 +86,19 @@ var _ = Describe("IpRateLimit", func() {
 			Expect(rateLimiter.IPs()["0.0.0.4"].Count).To(Equal(1))
 		})
 	})
+
+	Context("Reset", func() {
+		It("should let a reset ip straight back in", func() {
+			ip := "0.0.0.1"
+			for i := 0; i < limit; i++ {
+				Expect(rateLimiter.Allow(ip)).To(BeTrue())
+			}
+			Expect(rateLimiter.Allow(ip)).To(BeFalse())
+
+			Expect(rateLimiter.Reset(ip)).To(BeTrue())
+			Expect(rateLimiter.IPs()).NotTo(HaveKey(ip))
+			Expect(rateLimiter.Allow(ip)).To(BeTrue())
+			Expect(rateLimiter.Reset("0.0.0.2")).To(BeFalse())
+		})
+	})
 })
@@ -0,0 +1,244 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP gateway", func() {
+	var (
+		s       *server.TCPServer
+		mockExe *mockExecutor
+		gateway *httptest.Server
+	)
+
+	BeforeEach(func() {
+		mockExe = &mockExecutor{ExecuteTaskFunc: func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command, ExitCode: 3, Output: model.Bytes("out\n")}
+		}}
+		rateLimiter, err := ratelimit.NewIPRateLimiter(constant.DefaultRateLimit, constant.DefaultRateInterval)
+		Expect(err).NotTo(HaveOccurred())
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			Executor:     mockExe,
+			WaitGroup:    &sync.WaitGroup{},
+			RateLimiter:  rateLimiter,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+		gateway = httptest.NewServer(s.HTTPHandler())
+	})
+
+	AfterEach(func() {
+		gateway.Close()
+		s.Stop()
+	})
+
+	post := func(path, body string, header http.Header) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, gateway.URL+path, strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	It("should run a task and answer with its result whatever the exit code", func() {
+		resp := post("/v1/tasks", `{"command":["false"]}`, nil)
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		var result model.TaskResult
+		Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+		Expect(result.Command).To(Equal([]string{"false"}))
+		Expect(result.ExitCode).To(Equal(3))
+		Expect(string(result.Output)).To(Equal("out\n"))
+	})
+
+	It("should stream the output as server-sent events", func() {
+		resp := post("/v1/tasks", `{"command":["echo"]}`, http.Header{"Accept": {"text/event-stream"}})
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+		reader := bufio.NewReader(resp.Body)
+		readEvent := func() (string, string) {
+			var event, data string
+			for {
+				line, err := reader.ReadString('\n')
+				Expect(err).NotTo(HaveOccurred())
+				line = strings.TrimSuffix(line, "\n")
+				switch {
+				case line == "":
+					return event, data
+				case strings.HasPrefix(line, "event: "):
+					event = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					data = strings.TrimPrefix(line, "data: ")
+				}
+			}
+		}
+
+		event, data := readEvent()
+		Expect(event).To(Equal(model.MessageOutput))
+		var frame model.OutputFrame
+		Expect(json.Unmarshal([]byte(data), &frame)).To(Succeed())
+		Expect(frame.Stream).To(Equal(model.StreamStdout))
+		Expect(string(frame.Data)).To(Equal("out\n"))
+
+		event, data = readEvent()
+		Expect(event).To(Equal(model.MessageResult))
+		var result model.TaskResult
+		Expect(json.Unmarshal([]byte(data), &result)).To(Succeed())
+		Expect(result.ExitCode).To(Equal(3))
+		Expect(result.Output).To(BeEmpty())
+	})
+
+	It("should stream the output as JSON lines when the request asks for it", func() {
+		resp := post("/v1/tasks", `{"command":["echo"],"stream":true}`, nil)
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/x-ndjson"))
+
+		decoder := json.NewDecoder(resp.Body)
+		var frame model.OutputFrame
+		Expect(decoder.Decode(&frame)).To(Succeed())
+		Expect(frame.Type).To(Equal(model.MessageOutput))
+		Expect(string(frame.Data)).To(Equal("out\n"))
+		var result model.TaskResult
+		Expect(decoder.Decode(&result)).To(Succeed())
+		Expect(result.Type).To(Equal(model.MessageResult))
+		Expect(result.ExitCode).To(Equal(3))
+	})
+
+	It("should submit, report and cancel jobs", func() {
+		release := make(chan struct{})
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			select {
+			case <-release:
+				return &model.TaskResult{Command: request.Command, Output: model.Bytes("done")}
+			case <-ctx.Done():
+				return &model.TaskResult{Command: request.Command, ExitCode: -1}
+			}
+		}
+		defer close(release)
+
+		resp := post("/v1/jobs", `{"command":["sleep"]}`, nil)
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+		location := resp.Header.Get("Location")
+		Expect(location).To(HavePrefix("/v1/jobs/"))
+
+		getJob := func(method, path string) (int, model.JobStatus) {
+			req, err := http.NewRequest(method, gateway.URL+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			var status model.JobStatus
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+			return resp.StatusCode, status
+		}
+
+		code, status := getJob(http.MethodGet, location)
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(status.State).To(Equal(model.JobRunning))
+
+		resp, err := http.Get(gateway.URL + "/v1/jobs")
+		Expect(err).NotTo(HaveOccurred())
+		var list model.JobList
+		Expect(json.NewDecoder(resp.Body).Decode(&list)).To(Succeed())
+		resp.Body.Close()
+		Expect(list.Jobs).To(HaveLen(1))
+
+		code, _ = getJob(http.MethodDelete, location)
+		Expect(code).To(Equal(http.StatusOK))
+		Eventually(func() *model.TaskResult {
+			_, status := getJob(http.MethodGet, location)
+			return status.Result
+		}).ShouldNot(BeNil())
+		_, status = getJob(http.MethodGet, location)
+		Expect(status.Result.Error).To(Equal(constant.TaskResultKilledError))
+
+		code, status = getJob(http.MethodGet, "/v1/jobs/unknown")
+		Expect(code).To(Equal(http.StatusNotFound))
+		Expect(status.Error).To(Equal(constant.JobNotFoundError))
+	})
+
+	It("should take the token from the body or a bearer header", func() {
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			RateLimiter:  s.RateLimiter(),
+			Tokens:       []string{"secret"},
+		})
+
+		resp := post("/v1/tasks", `{"command":["none"]}`, nil)
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		resp = post("/v1/tasks", `{"command":["body"],"token":"secret"}`, nil)
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		resp = post("/v1/tasks", `{"command":["header"]}`, http.Header{"Authorization": {"Bearer secret"}})
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should refuse tasks and jobs without a command", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			defer GinkgoRecover()
+			Fail("a task without a command was run")
+			return nil
+		}
+		for _, path := range []string{"/v1/tasks", "/v1/jobs"} {
+			resp := post(path, `{"command":[]}`, http.Header{"Accept": {"text/event-stream"}})
+			var result model.TaskResult
+			Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(result.Error).To(Equal(constant.TaskResultCommandNilError))
+		}
+	})
+
+	It("should refuse requests over the rate limit or the max frame size", func() {
+		rateLimiter, err := ratelimit.NewIPRateLimiter(1, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			MaxFrameSize: 64,
+			RateLimiter:  rateLimiter,
+		})
+
+		resp := post("/v1/tasks", `{"command":["`+strings.Repeat("a", 64)+`"]}`, nil)
+		var result model.TaskResult
+		Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(result.Error).To(Equal(constant.TaskResultFrameTooLargeError))
+
+		resp = post("/v1/tasks", `{"command":["echo"]}`, nil)
+		Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+		Expect(result.Error).To(Equal(constant.TaskResultRateLimitedError))
+	})
+})
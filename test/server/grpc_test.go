@@ -0,0 +1,184 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/pb"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("gRPC service", func() {
+	var (
+		s          *server.TCPServer
+		mockExe    *mockExecutor
+		grpcServer *grpc.Server
+		conn       *grpc.ClientConn
+		client     pb.ExecutorClient
+		ctx        context.Context
+	)
+
+	BeforeEach(func() {
+		mockExe = &mockExecutor{ExecuteTaskFunc: func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command, ExitCode: 3, Output: model.Bytes{0xff, '\n'}}
+		}}
+		rateLimiter, err := ratelimit.NewIPRateLimiter(constant.DefaultRateLimit, constant.DefaultRateInterval)
+		Expect(err).NotTo(HaveOccurred())
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			Executor:     mockExe,
+			WaitGroup:    &sync.WaitGroup{},
+			RateLimiter:  rateLimiter,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		grpcServer = grpc.NewServer()
+		s.RegisterGRPC(grpcServer)
+		go grpcServer.Serve(l)
+
+		conn, err = grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		client = pb.NewExecutorClient(conn)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		DeferCleanup(cancel)
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		grpcServer.Stop()
+		s.Stop()
+	})
+
+	It("should run a task and return its result whatever the exit code", func() {
+		result, err := client.Execute(ctx, &pb.TaskRequest{Command: []string{"false"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Command).To(Equal([]string{"false"}))
+		Expect(result.ExitCode).To(BeEquivalentTo(3))
+		// Output comes as it is, bytes need no base64
+		Expect(result.Output).To(Equal([]byte{0xff, '\n'}))
+	})
+
+	It("should stream the output followed by the result", func() {
+		stream, err := client.ExecuteStream(ctx, &pb.TaskRequest{Command: []string{"echo"}})
+		Expect(err).NotTo(HaveOccurred())
+		response, err := stream.Recv()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.GetOutput().GetStream()).To(Equal(model.StreamStdout))
+		Expect(response.GetOutput().GetData()).To(Equal([]byte{0xff, '\n'}))
+		response, err = stream.Recv()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.GetResult().GetExitCode()).To(BeEquivalentTo(3))
+		Expect(response.GetResult().GetOutput()).To(BeEmpty())
+	})
+
+	It("should submit, get and cancel jobs", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			<-ctx.Done()
+			return &model.TaskResult{Command: request.Command, ExitCode: -1}
+		}
+
+		job, err := client.Submit(ctx, &pb.TaskRequest{Command: []string{"sleep"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(job.State).To(Equal(model.JobRunning))
+
+		job, err = client.Get(ctx, &pb.JobRequest{JobId: job.JobId})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(job.Result).To(BeNil())
+
+		_, err = client.Cancel(ctx, &pb.JobRequest{JobId: job.JobId})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() *pb.TaskResult {
+			job, err := client.Get(ctx, &pb.JobRequest{JobId: job.JobId})
+			Expect(err).NotTo(HaveOccurred())
+			return job.Result
+		}).ShouldNot(BeNil())
+		job, err = client.Get(ctx, &pb.JobRequest{JobId: job.JobId})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(job.Result.Error).To(Equal(constant.TaskResultKilledError))
+
+		_, err = client.Get(ctx, &pb.JobRequest{JobId: "unknown"})
+		Expect(status.Code(err)).To(Equal(codes.NotFound))
+	})
+
+	It("should take the token from the metadata", func() {
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			RateLimiter:  s.RateLimiter(),
+			Tokens:       []string{"secret"},
+		})
+
+		_, err := client.Execute(ctx, &pb.TaskRequest{Command: []string{"none"}})
+		Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+		Expect(status.Convert(err).Message()).To(Equal(constant.TaskResultUnauthorizedError))
+
+		authCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+		_, err = client.Execute(authCtx, &pb.TaskRequest{Command: []string{"token"}})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should fail with permission denied when running as a user the policy doesn't allow", func() {
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			RateLimiter:  s.RateLimiter(),
+			RunAs:        []string{"nobody"},
+		})
+
+		_, err := client.Execute(ctx, &pb.TaskRequest{Command: []string{"id"}, RunAs: "root"})
+		Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+		Expect(status.Convert(err).Message()).To(Equal(constant.TaskResultForbiddenError))
+
+		result, err := client.Execute(ctx, &pb.TaskRequest{Command: []string{"id"}, RunAs: "nobody"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Command).To(Equal([]string{"id"}))
+	})
+
+	It("should fail with invalid argument for a task or job without a command", func() {
+		_, err := client.Execute(ctx, &pb.TaskRequest{})
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		Expect(status.Convert(err).Message()).To(Equal(constant.TaskResultCommandNilError))
+
+		_, err = client.Submit(ctx, &pb.TaskRequest{})
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+
+		stream, err := client.ExecuteStream(ctx, &pb.TaskRequest{})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = stream.Recv()
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+	})
+
+	It("should fail with resource exhausted when rate limited", func() {
+		rateLimiter, err := ratelimit.NewIPRateLimiter(1, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			RateLimiter:  rateLimiter,
+		})
+
+		_, err = client.Execute(ctx, &pb.TaskRequest{Command: []string{"first"}})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.Execute(ctx, &pb.TaskRequest{Command: []string{"second"}})
+		Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+		Expect(status.Convert(err).Message()).To(Equal(constant.TaskResultRateLimitedError))
+	})
+})
@@ -0,0 +1,110 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/pb"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limiting across transports", func() {
+	var (
+		s       *server.TCPServer
+		gateway *httptest.Server
+		client  pb.ExecutorClient
+	)
+
+	BeforeEach(func() {
+		mockExe := &mockExecutor{ExecuteTaskFunc: func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command}
+		}}
+		rateLimiter, err := ratelimit.NewIPRateLimiter(3, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			Address:      "127.0.0.1:0",
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			Executor:     mockExe,
+			WaitGroup:    &sync.WaitGroup{},
+			RateLimiter:  rateLimiter,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+		DeferCleanup(s.Stop)
+
+		gateway = httptest.NewServer(s.HTTPHandler())
+		DeferCleanup(gateway.Close)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		grpcServer := grpc.NewServer()
+		s.RegisterGRPC(grpcServer)
+		go grpcServer.Serve(l)
+		DeferCleanup(grpcServer.Stop)
+		conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(conn.Close)
+		client = pb.NewExecutorClient(conn)
+	})
+
+	It("should count tcp connections, http requests and grpc calls against one budget", func() {
+		// A connection counts once however many requests it carries
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for range 5 {
+			_, err = conn.Write([]byte(`{"command":["tcp"]}` + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			var result model.TaskResult
+			Expect(decoder.Decode(&result)).To(Succeed())
+			Expect(result.Error).To(BeEmpty())
+		}
+
+		// Every http request and grpc call counts, these use up the other two
+		resp, err := http.Post(gateway.URL+"/v1/tasks", "application/json", strings.NewReader(`{"command":["http"]}`))
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		_, err = client.Execute(context.Background(), &pb.TaskRequest{Command: []string{"grpc"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		resp, err = http.Post(gateway.URL+"/v1/tasks", "application/json", strings.NewReader(`{"command":["http"]}`))
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+		_, err = client.Execute(context.Background(), &pb.TaskRequest{Command: []string{"grpc"}})
+		Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+
+		refused, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer refused.Close()
+		var result model.TaskResult
+		Expect(json.NewDecoder(refused).Decode(&result)).To(Succeed())
+		Expect(result.Error).To(Equal(constant.TaskResultRateLimitedError))
+
+		// The connection that was let in keeps going
+		_, err = conn.Write([]byte(`{"command":["tcp"]}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		result = model.TaskResult{}
+		Expect(decoder.Decode(&result)).To(Succeed())
+		Expect(result.Error).To(BeEmpty())
+	})
+})
@@ -2,20 +2,26 @@ package server_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"io"
+	"log/slog"
 	"net"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/Oyal2/tcp-server/internal/constant"
-	"github.com/Oyal2/tcp-server/internal/model"
 	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/codec"
+	"github.com/Oyal2/tcp-server/pkg/model"
 	"github.com/Oyal2/tcp-server/pkg/ratelimit"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
 type mockExecutor struct {
@@ -69,7 +75,7 @@ var _ = Describe("TCPServer", func() {
 				ExecutedAt: time.Now().Unix(),
 				DurationMs: 100,
 				ExitCode:   0,
-				Output:     "test output",
+				Output:     model.Bytes("test output"),
 			}
 		}
 
@@ -91,7 +97,7 @@ var _ = Describe("TCPServer", func() {
 		err = json.NewDecoder(conn).Decode(&response)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(response.Command).To(Equal(request.Command))
-		Expect(response.Output).To(Equal("test output"))
+		Expect(string(response.Output)).To(Equal("test output"))
 		Expect(response.ExitCode).To(Equal(0))
 	})
 
@@ -165,7 +171,7 @@ var _ = Describe("TCPServer", func() {
 				ExecutedAt: time.Now().Unix(),
 				DurationMs: 100,
 				ExitCode:   0,
-				Output:     "test output test outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest output",
+				Output:     model.Bytes("test output test outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest outputtest output"),
 			}
 		}
 
@@ -198,4 +204,529 @@ var _ = Describe("TCPServer", func() {
 		Expect(ok).To(BeTrue())
 		Expect(netErr.Timeout()).To(BeTrue())
 	})
+
+	It("should apply new settings to connections after a reconfigure", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command}
+		}
+
+		// Keep a connection open across the reconfigure
+		openConn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer openConn.Close()
+		decoder := json.NewDecoder(openConn)
+		var response model.TaskResult
+		_, err = openConn.Write([]byte(`{"command":["before"]}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoder.Decode(&response)).To(Succeed())
+
+		rateLimiter, err := ratelimit.NewIPRateLimiter(1, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  time.Second,
+			WriteTimeout: 2 * time.Second,
+			RateLimiter:  rateLimiter,
+		})
+		Expect(s.ReadTimeout()).To(Equal(time.Second))
+		Expect(s.WriteTimeout()).To(Equal(2 * time.Second))
+		Expect(s.RateLimiter()).To(BeIdenticalTo(rateLimiter))
+
+		// The open connection still gets served
+		_, err = openConn.Write([]byte(`{"command":["still","open"]}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoder.Decode(&response)).To(Succeed())
+		Expect(response.Command).To(Equal([]string{"still", "open"}))
+
+		// New connections go through the new limiter, the second one is told it is rate limited
+		for i, allowed := range []bool{true, false} {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			_, err = conn.Write([]byte(`{"command":["new"]}` + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			response = model.TaskResult{}
+			Expect(json.NewDecoder(conn).Decode(&response)).To(Succeed(), "connection %d", i)
+			if allowed {
+				Expect(response.Command).To(Equal([]string{"new"}), "connection %d", i)
+			} else {
+				Expect(response.Error).To(Equal(constant.TaskResultRateLimitedError), "connection %d", i)
+				Expect(response.ExitCode).To(Equal(-1), "connection %d", i)
+			}
+			conn.Close()
+		}
+	})
+
+	It("should refuse requests without a valid token", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command}
+		}
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			RateLimiter:  s.RateLimiter(),
+			Tokens:       []string{"first", "second"},
+		})
+
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for _, tc := range []struct {
+			line  string
+			error string
+		}{
+			{`{"command":["none"]}`, constant.TaskResultUnauthorizedError},
+			{`{"command":["wrong"],"token":"third"}`, constant.TaskResultUnauthorizedError},
+			{`{"command":["right"],"token":"second"}`, ""},
+		} {
+			_, err = conn.Write([]byte(tc.line + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			var response model.TaskResult
+			Expect(decoder.Decode(&response)).To(Succeed())
+			Expect(response.Error).To(Equal(tc.error), tc.line)
+		}
+
+		// A hello needs no token and says one is needed
+		_, err = conn.Write([]byte(`{"type":"hello","versions":[1],"features":["auth"]}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		var hello model.Hello
+		Expect(decoder.Decode(&hello)).To(Succeed())
+		Expect(hello.Features).To(Equal([]string{model.FeatureAuth}))
+	})
+
+	It("should only run tasks as the users the policy allows", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command}
+		}
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			RateLimiter:  s.RateLimiter(),
+			RunAs:        []string{"nobody", "deploy:www-data"},
+		})
+
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for _, tc := range []struct {
+			line  string
+			error string
+		}{
+			{`{"command":["id"]}`, ""},
+			{`{"command":["id"],"run_as":"nobody"}`, ""},
+			{`{"command":["id"],"run_as":"deploy:www-data"}`, ""},
+			{`{"command":["id"],"run_as":"deploy"}`, constant.TaskResultForbiddenError},
+			{`{"type":"submit","command":["id"],"run_as":"root"}`, constant.TaskResultForbiddenError},
+		} {
+			_, err = conn.Write([]byte(tc.line + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			var response model.TaskResult
+			Expect(decoder.Decode(&response)).To(Succeed())
+			Expect(response.Error).To(Equal(tc.error), tc.line)
+		}
+	})
+
+	It("should refuse tasks and jobs without a command before running them", func() {
+		ran := false
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			ran = true
+			return &model.TaskResult{Command: request.Command}
+		}
+
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for _, line := range []string{`{}`, `{"type":"run","command":[]}`, `{"type":"submit"}`} {
+			_, err = conn.Write([]byte(line + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			var response model.TaskResult
+			Expect(decoder.Decode(&response)).To(Succeed())
+			Expect(response.ExitCode).To(Equal(-1), line)
+			Expect(response.Error).To(Equal(constant.TaskResultCommandNilError), line)
+		}
+		Expect(ran).To(BeFalse())
+	})
+
+	It("should switch to length prefixed frames when asked", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command, Output: model.Bytes(request.Command[0])}
+		}
+
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		// The answer still comes as a line
+		_, err = conn.Write([]byte(`{"type":"framing","framing":"length_prefixed"}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		line, err := reader.ReadBytes('\n')
+		Expect(err).NotTo(HaveOccurred())
+		var ack model.Framing
+		Expect(json.Unmarshal(line, &ack)).To(Succeed())
+		Expect(ack.Framing).To(Equal(model.FramingLengthPrefixed))
+		Expect(ack.MaxFrameSize).To(Equal(constant.DefaultMaxFrameSize))
+
+		// An argument well over the old 64 KiB line limit goes through
+		large := string(bytes.Repeat([]byte("a"), 100*1024))
+		request, err := json.Marshal(&model.TaskRequest{Command: []string{large}})
+		Expect(err).NotTo(HaveOccurred())
+		frame := binary.BigEndian.AppendUint32(nil, uint32(len(request)))
+		_, err = conn.Write(append(frame, request...))
+		Expect(err).NotTo(HaveOccurred())
+
+		header := make([]byte, 4)
+		_, err = io.ReadFull(reader, header)
+		Expect(err).NotTo(HaveOccurred())
+		payload := make([]byte, binary.BigEndian.Uint32(header))
+		_, err = io.ReadFull(reader, payload)
+		Expect(err).NotTo(HaveOccurred())
+		var response model.TaskResult
+		Expect(json.Unmarshal(payload, &response)).To(Succeed())
+		Expect(string(response.Output)).To(Equal(large))
+	})
+
+	It("should refuse requests over the max frame size", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command}
+		}
+		s.Reconfigure(server.TCPServerSettings{
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			RateLimiter:  ratelimit.NewNoopRateLimiter(),
+			MaxFrameSize: 64,
+		})
+
+		// A line framed request
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte(`{"command":["` + string(bytes.Repeat([]byte("a"), 64)) + `"]}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		var response model.TaskResult
+		Expect(json.NewDecoder(conn).Decode(&response)).To(Succeed())
+		Expect(response.Error).To(Equal(constant.TaskResultFrameTooLargeError))
+		Expect(response.ExitCode).To(Equal(-1))
+
+		// A length prefixed one is refused from its header alone
+		conn, err = net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		_, err = conn.Write([]byte(`{"type":"framing","framing":"length_prefixed"}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = reader.ReadBytes('\n')
+		Expect(err).NotTo(HaveOccurred())
+		_, err = conn.Write(binary.BigEndian.AppendUint32(nil, 1<<30))
+		Expect(err).NotTo(HaveOccurred())
+		header := make([]byte, 4)
+		_, err = io.ReadFull(reader, header)
+		Expect(err).NotTo(HaveOccurred())
+		payload := make([]byte, binary.BigEndian.Uint32(header))
+		_, err = io.ReadFull(reader, payload)
+		Expect(err).NotTo(HaveOccurred())
+		response = model.TaskResult{}
+		Expect(json.Unmarshal(payload, &response)).To(Succeed())
+		Expect(response.Error).To(Equal(constant.TaskResultFrameTooLargeError))
+		_, err = reader.ReadByte()
+		Expect(err).To(MatchError(io.EOF))
+	})
+
+	It("should answer a request it can't parse in the connection's codec when it is framed", func() {
+		for switchLine, name := range map[string]string{
+			`{"type":"framing","framing":"length_prefixed"}`:                                codec.JSON,
+			`{"type":"hello","versions":[1],"framing":"length_prefixed","codec":"msgpack"}`: codec.MessagePack,
+			`{"type":"hello","versions":[1],"framing":"length_prefixed","codec":"cbor"}`:    codec.CBOR,
+		} {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			_, err = conn.Write([]byte(switchLine + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = reader.ReadBytes('\n')
+			Expect(err).NotTo(HaveOccurred())
+
+			// 0xc1 is never used by MessagePack and is a reserved CBOR type
+			garbage := []byte{0xc1}
+			_, err = conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(garbage))), garbage...))
+			Expect(err).NotTo(HaveOccurred())
+			header := make([]byte, 4)
+			_, err = io.ReadFull(reader, header)
+			Expect(err).NotTo(HaveOccurred())
+			payload := make([]byte, binary.BigEndian.Uint32(header))
+			_, err = io.ReadFull(reader, payload)
+			Expect(err).NotTo(HaveOccurred())
+			c, ok := codec.Get(name)
+			Expect(ok).To(BeTrue())
+			var response model.TaskResult
+			Expect(c.Unmarshal(payload, &response)).To(Succeed(), name)
+			Expect(response.Error).To(Equal(constant.TaskResultParseError), name)
+			Expect(response.ExitCode).To(Equal(-1), name)
+			_, err = reader.ReadByte()
+			Expect(err).To(MatchError(io.EOF), name)
+		}
+	})
+
+	It("should answer a hello with what it chose", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command}
+		}
+
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+
+		// Unknown features and versions are left out
+		_, err = conn.Write([]byte(`{"type":"hello","versions":[1,99],"features":["streaming","resume","compression","auth","jobs"]}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		var hello model.Hello
+		Expect(decoder.Decode(&hello)).To(Succeed())
+		Expect(hello.Version).To(Equal(model.ProtocolVersion))
+		Expect(hello.Features).To(Equal([]string{model.FeatureStreaming, model.FeatureCompression, model.FeatureJobs}))
+		Expect(hello.Framing).To(Equal(model.FramingLine))
+		Expect(hello.Codec).To(Equal(codec.JSON))
+		Expect(hello.Error).To(BeEmpty())
+
+		// Binary codecs can't go over lines, unknown ones keep JSON
+		for line, errorCode := range map[string]string{
+			`{"type":"hello","versions":[1],"codec":"msgpack"}`: constant.TaskResultInvalidRequestError,
+			`{"type":"hello","versions":[1],"codec":"xml"}`:     "",
+		} {
+			_, err = conn.Write([]byte(line + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			hello = model.Hello{}
+			Expect(decoder.Decode(&hello)).To(Succeed())
+			Expect(hello.Error).To(Equal(errorCode), line)
+			if errorCode == "" {
+				Expect(hello.Codec).To(Equal(codec.JSON))
+			}
+		}
+
+		// Without a common version the client is told which ones there are and can carry on without
+		_, err = conn.Write([]byte(`{"type":"hello","versions":[99]}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		hello = model.Hello{}
+		Expect(decoder.Decode(&hello)).To(Succeed())
+		Expect(hello.Error).To(Equal(constant.UnsupportedVersionError))
+		Expect(hello.Versions).To(Equal([]int{model.ProtocolVersion}))
+
+		_, err = conn.Write([]byte(`{"command":["after","hello"]}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		var response model.TaskResult
+		Expect(decoder.Decode(&response)).To(Succeed())
+		Expect(response.Command).To(Equal([]string{"after", "hello"}))
+	})
+
+	It("should base64 encode output that isn't UTF-8 or when asked to", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			if request.Command[0] == "binary" {
+				return &model.TaskResult{Command: request.Command, Output: model.Bytes{0xff, 0xfe}}
+			}
+			return &model.TaskResult{Command: request.Command, Output: model.Bytes(request.Command[0])}
+		}
+
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for _, tc := range []struct {
+			line     string
+			output   string
+			encoding string
+		}{
+			{`{"command":["text"]}`, `"text"`, ""},
+			{`{"command":["binary"]}`, `"//4="`, model.OutputEncodingBase64},
+			{`{"command":["text"],"output_encoding":"base64"}`, `"dGV4dA=="`, model.OutputEncodingBase64},
+		} {
+			_, err = conn.Write([]byte(tc.line + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			line, err := reader.ReadBytes('\n')
+			Expect(err).NotTo(HaveOccurred())
+			var response map[string]any
+			Expect(json.Unmarshal(line, &response)).To(Succeed())
+			Expect(string(line)).To(ContainSubstring(`"output":`+tc.output), tc.line)
+			if tc.encoding == "" {
+				Expect(response).NotTo(HaveKey("output_encoding"), tc.line)
+			} else {
+				Expect(response).To(HaveKeyWithValue("output_encoding", tc.encoding), tc.line)
+			}
+		}
+
+		_, err = conn.Write([]byte(`{"command":["text"],"output_encoding":"hex"}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		var response model.TaskResult
+		Expect(json.NewDecoder(reader).Decode(&response)).To(Succeed())
+		Expect(response.Error).To(Equal(constant.TaskResultInvalidRequestError))
+	})
+
+	It("should serve every listener it was given", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command}
+		}
+
+		socket := filepath.Join(GinkgoT().TempDir(), "server.sock")
+		multi, err := server.NewTCPServer(server.TCPServerParams{
+			Listen:       []string{"tcp://127.0.0.1:0", "unix://" + socket},
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			Executor:     mockExe,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go multi.Start(context.Background())
+		defer multi.Stop()
+
+		addrs := multi.Addrs()
+		Expect(addrs).To(HaveLen(2))
+		for _, addr := range addrs {
+			conn, err := net.Dial(addr.Network(), addr.String())
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = conn.Write([]byte(`{"command":["` + addr.Network() + `"]}` + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			var response model.TaskResult
+			Expect(json.NewDecoder(conn).Decode(&response)).To(Succeed())
+			Expect(response.Command).To(Equal([]string{addr.Network()}))
+			conn.Close()
+		}
+	})
+
+	Context("Shutdown", func() {
+		It("should finish in-flight tasks and refuse new requests while draining", func() {
+			started := make(chan struct{})
+			finish := make(chan struct{})
+			mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+				close(started)
+				<-finish
+				return &model.TaskResult{Command: request.Command, Output: model.Bytes("finished")}
+			}
+
+			busy, err := net.Dial("tcp", s.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer busy.Close()
+			idle, err := net.Dial("tcp", s.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer idle.Close()
+
+			_, err = busy.Write([]byte(`{"command":["slow"]}` + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(started).Should(BeClosed())
+
+			shutdownErr := make(chan error, 1)
+			go func() {
+				shutdownErr <- s.Shutdown(context.Background())
+			}()
+
+			// New connections are refused
+			Eventually(func() error {
+				conn, err := net.Dial("tcp", s.Addr().String())
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}).Should(HaveOccurred())
+
+			// Requests on open connections get a shutting_down error
+			_, err = idle.Write([]byte(`{"command":["new"]}` + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			var response model.TaskResult
+			Expect(json.NewDecoder(idle).Decode(&response)).To(Succeed())
+			Expect(response.ExitCode).To(Equal(-1))
+			Expect(response.Error).To(Equal(constant.TaskResultShuttingDownError))
+			Consistently(shutdownErr).ShouldNot(Receive())
+
+			// The in-flight task still sends its result
+			close(finish)
+			Expect(json.NewDecoder(busy).Decode(&response)).To(Succeed())
+			Expect(string(response.Output)).To(Equal("finished"))
+			Eventually(shutdownErr).Should(Receive(BeNil()))
+		})
+
+		It("should cancel in-flight tasks when the drain deadline passes", func() {
+			mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+				<-ctx.Done()
+				return &model.TaskResult{Command: request.Command, ExitCode: -1, Error: ctx.Err().Error()}
+			}
+
+			conn, err := net.Dial("tcp", s.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte(`{"command":["stuck"]}` + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			time.Sleep(100 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			Expect(s.Shutdown(ctx)).To(MatchError(context.DeadlineExceeded))
+
+			var response model.TaskResult
+			Expect(json.NewDecoder(conn).Decode(&response)).To(Succeed())
+			Expect(response.Error).To(Equal(context.Canceled.Error()))
+		})
+	})
+
+	It("should log every request with the connection and request ids", func() {
+		logs := gbytes.NewBuffer()
+		logged, err := server.NewTCPServer(server.TCPServerParams{
+			Listen:       []string{"tcp://127.0.0.1:0"},
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			Executor:     mockExe,
+			Logger:       slog.New(slog.NewJSONHandler(logs, nil)),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go logged.Start(context.Background())
+		defer logged.Stop()
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command, ExitCode: 2}
+		}
+
+		conn, err := net.Dial("tcp", logged.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for _, request := range []string{`{"command":["first"]}`, `{"command":["second"]}`} {
+			_, err = conn.Write([]byte(request + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			var response model.TaskResult
+			Expect(decoder.Decode(&response)).To(Succeed())
+		}
+
+		type line struct {
+			Msg       string
+			ConnID    string   `json:"conn_id"`
+			RemoteIP  string   `json:"remote_ip"`
+			RequestID string   `json:"request_id"`
+			Command   []string `json:"command"`
+			ExitCode  *int     `json:"exit_code"`
+			Outcome   string   `json:"outcome"`
+		}
+		var finished []line
+		Eventually(func() []line {
+			finished = nil
+			scanner := bufio.NewScanner(bytes.NewReader(logs.Contents()))
+			for scanner.Scan() {
+				var l line
+				Expect(json.Unmarshal(scanner.Bytes(), &l)).To(Succeed())
+				if l.Msg == "task finished" {
+					finished = append(finished, l)
+				}
+			}
+			return finished
+		}).Should(HaveLen(2))
+
+		for i, command := range []string{"first", "second"} {
+			Expect(finished[i].ConnID).NotTo(BeEmpty())
+			Expect(finished[i].RemoteIP).To(Equal("127.0.0.1"))
+			Expect(finished[i].RequestID).NotTo(BeEmpty())
+			Expect(finished[i].Command).To(Equal([]string{command}))
+			Expect(finished[i].ExitCode).To(HaveValue(Equal(2)))
+			Expect(finished[i].Outcome).To(Equal("non_zero_exit"))
+		}
+		// Both requests came in on the same connection
+		Expect(finished[0].ConnID).To(Equal(finished[1].ConnID))
+		Expect(finished[0].RequestID).NotTo(Equal(finished[1].RequestID))
+	})
 })
@@ -0,0 +1,235 @@
+package server_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// mockSessionExecutor is an executor that can run tasks interactively and feed their stdin
+type mockSessionExecutor struct {
+	mockExecutor
+	ExecuteTaskInteractiveFunc func(ctx context.Context, request *model.TaskRequest, input <-chan executor.TerminalInput, output executor.OutputFunc) *model.TaskResult
+}
+
+func (m *mockSessionExecutor) ExecuteTaskInteractive(ctx context.Context, request *model.TaskRequest, input <-chan executor.TerminalInput, output executor.OutputFunc) *model.TaskResult {
+	return m.ExecuteTaskInteractiveFunc(ctx, request, input, output)
+}
+
+// ExecuteTaskStdin passes stdin on as output until it ends, like cat
+func (m *mockSessionExecutor) ExecuteTaskStdin(ctx context.Context, request *model.TaskRequest, stdin io.Reader, output executor.OutputFunc) *model.TaskResult {
+	b, err := io.ReadAll(stdin)
+	if err != nil {
+		return &model.TaskResult{Command: request.Command, ExitCode: -1, Error: err.Error()}
+	}
+	if output == nil {
+		return &model.TaskResult{Command: request.Command, Output: b}
+	}
+	output(model.StreamStdout, b)
+	return &model.TaskResult{Command: request.Command}
+}
+
+var _ = Describe("Sessions", func() {
+	var (
+		s        *server.TCPServer
+		mockExe  *mockSessionExecutor
+		conn     net.Conn
+		decoder  *json.Decoder
+		killed   chan error
+		readLine func(v any)
+	)
+
+	BeforeEach(func() {
+		killed = make(chan error, 1)
+		mockExe = &mockSessionExecutor{}
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command, Output: model.Bytes("plain")}
+		}
+		// Echo what is typed and tell about resizes until exit is typed
+		mockExe.ExecuteTaskInteractiveFunc = func(ctx context.Context, request *model.TaskRequest, input <-chan executor.TerminalInput, output executor.OutputFunc) *model.TaskResult {
+			output(model.StreamStdout, []byte(fmt.Sprintf("%dx%d", request.Window.Rows, request.Window.Cols)))
+			for {
+				select {
+				case in := <-input:
+					switch {
+					case in.Window != nil:
+						output(model.StreamStdout, []byte(fmt.Sprintf("%dx%d", in.Window.Rows, in.Window.Cols)))
+					case string(in.Data) == "exit\n":
+						return &model.TaskResult{Command: request.Command}
+					default:
+						output(model.StreamStdout, in.Data)
+					}
+				case <-ctx.Done():
+					killed <- context.Cause(ctx)
+					return &model.TaskResult{Command: request.Command, ExitCode: -1}
+				}
+			}
+		}
+		rateLimiter, err := ratelimit.NewIPRateLimiter(constant.DefaultRateLimit, constant.DefaultRateInterval)
+		Expect(err).NotTo(HaveOccurred())
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			Executor:     mockExe,
+			WaitGroup:    &sync.WaitGroup{},
+			RateLimiter:  rateLimiter,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+		Eventually(s.Ready).Should(Succeed())
+
+		conn, err = net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		decoder = json.NewDecoder(conn)
+		readLine = func(v any) {
+			Expect(conn.SetReadDeadline(time.Now().Add(3 * time.Second))).To(Succeed())
+			Expect(decoder.Decode(v)).To(Succeed())
+		}
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		s.Stop()
+	})
+
+	send := func(request string) {
+		_, err := conn.Write([]byte(request + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("should carry input, resizes and output until the task exits", func() {
+		send(`{"command":["sh"],"interactive":true,"window":{"rows":24,"cols":80}}`)
+		var frame model.OutputFrame
+		readLine(&frame)
+		Expect(frame.Type).To(Equal(model.MessageOutput))
+		Expect(string(frame.Data)).To(Equal("24x80"))
+
+		send(`{"type":"resize","window":{"rows":50,"cols":120}}`)
+		readLine(&frame)
+		Expect(string(frame.Data)).To(Equal("50x120"))
+
+		send(`{"type":"input","data":"ls\n"}`)
+		readLine(&frame)
+		Expect(string(frame.Data)).To(Equal("ls\n"))
+
+		send(`{"type":"input","data":"exit\n"}`)
+		var result model.TaskResult
+		readLine(&result)
+		Expect(result.Type).To(Equal(model.MessageResult))
+		Expect(result.Command).To(Equal([]string{"sh"}))
+		Expect(result.ExitCode).To(Equal(0))
+
+		// The connection takes requests again once the session is over
+		send(`{"command":["echo"]}`)
+		readLine(&result)
+		Expect(string(result.Output)).To(Equal("plain"))
+	})
+
+	It("should kill the task when the client goes away", func() {
+		send(`{"command":["sh"],"interactive":true,"window":{"rows":24,"cols":80}}`)
+		var frame model.OutputFrame
+		readLine(&frame)
+
+		conn.Close()
+		var cause error
+		Eventually(killed, 3*time.Second).Should(Receive(&cause))
+		Expect(cause).To(HaveOccurred())
+	})
+
+	It("should kill the task on a cancel without a job id", func() {
+		send(`{"command":["sh"],"interactive":true,"window":{"rows":24,"cols":80}}`)
+		var frame model.OutputFrame
+		readLine(&frame)
+
+		send(`{"type":"cancel"}`)
+		var cause error
+		Eventually(killed, 3*time.Second).Should(Receive(&cause))
+		Expect(cause).To(HaveOccurred())
+		var result model.TaskResult
+		readLine(&result)
+		Expect(result.Type).To(Equal(model.MessageResult))
+		Expect(result.Error).To(Equal(constant.TaskResultKilledError))
+
+		// The connection takes requests again once the session is over
+		send(`{"command":["echo"]}`)
+		readLine(&result)
+		Expect(string(result.Output)).To(Equal("plain"))
+	})
+
+	It("should answer requests that aren't for the task during a session", func() {
+		send(`{"command":["sh"],"interactive":true,"window":{"rows":24,"cols":80}}`)
+		var frame model.OutputFrame
+		readLine(&frame)
+
+		send(`{"type":"status","job_id":"job"}`)
+		var result model.TaskResult
+		readLine(&result)
+		Expect(result.ExitCode).To(Equal(-1))
+		Expect(result.Error).To(Equal(constant.TaskResultInvalidRequestError))
+
+		send(`not json`)
+		result = model.TaskResult{}
+		readLine(&result)
+		Expect(result.Error).To(Equal(constant.TaskResultParseError))
+
+		// The session goes on
+		send(`{"type":"input","data":"ls\n"}`)
+		readLine(&frame)
+		Expect(string(frame.Data)).To(Equal("ls\n"))
+		send(`{"type":"input","data":"exit\n"}`)
+		result = model.TaskResult{}
+		readLine(&result)
+		Expect(result.Type).To(Equal(model.MessageResult))
+		Expect(result.Error).To(BeEmpty())
+	})
+
+	It("should write stdin requests to the task until eof", func() {
+		send(`{"command":["cat"],"stdin":true}`)
+		send(`{"type":"stdin","data":"hello "}`)
+		// Data that isn't UTF-8 comes base64 encoded
+		send(`{"type":"stdin","data":"/3dvcmxk","encoding":"base64"}`)
+		send(`{"type":"eof"}`)
+		var result model.TaskResult
+		readLine(&result)
+		Expect(result.Command).To(Equal([]string{"cat"}))
+		Expect(result.OutputEncoding).To(Equal(model.OutputEncodingBase64))
+		Expect(string(result.Output)).To(Equal(base64.StdEncoding.EncodeToString([]byte("hello \xffworld"))))
+
+		// The connection takes requests again once the task is over
+		send(`{"command":["echo"]}`)
+		readLine(&result)
+		Expect(string(result.Output)).To(Equal("plain"))
+	})
+
+	It("should offer the features and refuse sessions that can't have the connection", func() {
+		send(`{"type":"hello","versions":[1],"features":["interactive","stdin"]}`)
+		var hello model.Hello
+		readLine(&hello)
+		Expect(hello.Features).To(Equal([]string{model.FeatureInteractive, model.FeatureStdin}))
+
+		for _, request := range []string{
+			`{"type":"submit","command":["sh"],"interactive":true}`,
+			`{"type":"submit","command":["cat"],"stdin":true}`,
+			`{"command":["sh"],"interactive":true,"stdin":true}`,
+		} {
+			send(request)
+			var result model.TaskResult
+			readLine(&result)
+			Expect(result.Error).To(Equal(constant.TaskResultInvalidRequestError))
+		}
+	})
+})
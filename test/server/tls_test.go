@@ -0,0 +1,123 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/model"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// writeCertificate writes a self signed certificate with the given common name to dir and loads it
+func writeCertificate(dir, commonName string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certFile := filepath.Join(dir, commonName+".crt")
+	keyFile := filepath.Join(dir, commonName+".key")
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)).To(Succeed())
+	cert, err := server.LoadCertificate(certFile, keyFile)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+var _ = Describe("TLS", func() {
+	var first, second *tls.Certificate
+
+	start := func(params server.TCPServerParams, cert *tls.Certificate) *server.TCPServer {
+		params.ReadTimeout = time.Second
+		params.WriteTimeout = time.Second
+		params.WaitGroup = &sync.WaitGroup{}
+		params.Certificate = cert
+		params.Executor = &mockExecutor{ExecuteTaskFunc: func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command}
+		}}
+		s, err := server.NewTCPServer(params)
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+		DeferCleanup(s.Stop)
+		return s
+	}
+
+	run := func(conn net.Conn) model.TaskResult {
+		_, err := conn.Write([]byte(`{"command":["echo"]}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		var result model.TaskResult
+		Expect(json.NewDecoder(conn).Decode(&result)).To(Succeed())
+		return result
+	}
+
+	BeforeEach(func() {
+		dir := GinkgoT().TempDir()
+		first = writeCertificate(dir, "first")
+		second = writeCertificate(dir, "second")
+	})
+
+	It("should serve a reconfigured certificate to new connections only", func() {
+		s := start(server.TCPServerParams{Address: "127.0.0.1:0"}, first)
+		dial := func() *tls.Conn {
+			conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			Expect(err).NotTo(HaveOccurred())
+			return conn
+		}
+		commonName := func(conn *tls.Conn) string {
+			return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+
+		before := dial()
+		defer before.Close()
+		Expect(commonName(before)).To(Equal("first"))
+		Expect(run(before).Command).To(Equal([]string{"echo"}))
+
+		s.Reconfigure(server.TCPServerSettings{ReadTimeout: time.Second, WriteTimeout: time.Second, Certificate: second})
+		after := dial()
+		defer after.Close()
+		Expect(commonName(after)).To(Equal("second"))
+		Expect(run(before).Command).To(Equal([]string{"echo"}))
+
+		// Settings without a certificate keep the current one
+		s.Reconfigure(server.TCPServerSettings{ReadTimeout: time.Second, WriteTimeout: time.Second})
+		again := dial()
+		defer again.Close()
+		Expect(commonName(again)).To(Equal("second"))
+	})
+
+	It("should identify unix clients through tls", func() {
+		address := fmt.Sprintf("@tcp-server-tls-test-%d", GinkgoRandomSeed())
+		s := start(server.TCPServerParams{Listen: []string{"unix://" + address}}, first)
+
+		conn, err := tls.Dial("unix", address, &tls.Config{InsecureSkipVerify: true})
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		Expect(run(conn).Command).To(Equal([]string{"echo"}))
+		_ = s
+	})
+})
@@ -0,0 +1,126 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/constant"
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+	"github.com/coder/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WebSocketServer", func() {
+	var (
+		s       *server.TCPServer
+		ws      *server.WebSocketServer
+		mockExe *mockExecutor
+		url     string
+	)
+
+	BeforeEach(func() {
+		mockExe = &mockExecutor{}
+		rateLimiter, err := ratelimit.NewIPRateLimiter(constant.DefaultRateLimit, constant.DefaultRateInterval)
+		Expect(err).NotTo(HaveOccurred())
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			ReadTimeout:  3 * time.Second,
+			WriteTimeout: 3 * time.Second,
+			Executor:     mockExe,
+			WaitGroup:    &sync.WaitGroup{},
+			RateLimiter:  rateLimiter,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		ws, err = server.NewWebSocketServer(server.WebSocketServerParams{Address: "127.0.0.1:0", Server: s})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+		go ws.Start(context.Background())
+		url = "ws://" + ws.GetAddr().String() + "/v1/ws"
+	})
+
+	AfterEach(func() {
+		ws.Stop()
+		s.Stop()
+	})
+
+	dial := func() *websocket.Conn {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		conn, _, err := websocket.Dial(ctx, url, nil)
+		Expect(err).NotTo(HaveOccurred())
+		return conn
+	}
+
+	readMessage := func(conn *websocket.Conn, v any) {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		typ, b, err := conn.Read(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(typ).To(Equal(websocket.MessageText))
+		Expect(json.Unmarshal(b, v)).To(Succeed())
+	}
+
+	It("should carry the same messages as a TCP connection", func() {
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			return &model.TaskResult{Command: request.Command, Output: model.Bytes("hello\n")}
+		}
+		conn := dial()
+		defer conn.CloseNow()
+
+		// A message needs no newline, every answer comes in a message of its own
+		ctx := context.Background()
+		Expect(conn.Write(ctx, websocket.MessageText, []byte(`{"command":["echo","hello"]}`))).To(Succeed())
+		var result model.TaskResult
+		readMessage(conn, &result)
+		Expect(result.Command).To(Equal([]string{"echo", "hello"}))
+		Expect(string(result.Output)).To(Equal("hello\n"))
+
+		Expect(conn.Write(ctx, websocket.MessageText, []byte(`{"command":["echo"],"stream":true}`))).To(Succeed())
+		var frame model.OutputFrame
+		readMessage(conn, &frame)
+		Expect(frame.Type).To(Equal(model.MessageOutput))
+		Expect(string(frame.Data)).To(Equal("hello\n"))
+		readMessage(conn, &result)
+		Expect(result.Type).To(Equal(model.MessageResult))
+		Expect(conn.Close(websocket.StatusNormalClosure, "")).To(Succeed())
+	})
+
+	It("should kill the task when the socket closes", func() {
+		cancelled := make(chan error, 1)
+		started := make(chan struct{})
+		mockExe.ExecuteTaskFunc = func(ctx context.Context, request *model.TaskRequest) *model.TaskResult {
+			close(started)
+			select {
+			case <-ctx.Done():
+				cancelled <- context.Cause(ctx)
+			case <-time.After(5 * time.Second):
+				cancelled <- nil
+			}
+			return &model.TaskResult{Command: request.Command, ExitCode: -1}
+		}
+		conn := dial()
+		Expect(conn.Write(context.Background(), websocket.MessageText, []byte(`{"command":["sleep"]}`))).To(Succeed())
+		Eventually(started).Should(BeClosed())
+
+		Expect(conn.CloseNow()).To(Succeed())
+		var cause error
+		Eventually(cancelled, 3*time.Second).Should(Receive(&cause))
+		Expect(cause).To(HaveOccurred())
+	})
+
+	It("should refuse sockets from other origins", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		_, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+			HTTPHeader: http.Header{"Origin": {"http://elsewhere.example.com"}},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+	})
+})
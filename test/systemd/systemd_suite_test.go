@@ -0,0 +1,35 @@
+package systemd_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Oyal2/tcp-server/test/helper"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var (
+	serverPath string
+	buildDir   string
+)
+
+var _ = BeforeSuite(func() {
+	var err error
+	buildDir, err = os.MkdirTemp("", "tcp-server-systemd")
+	Expect(err).NotTo(HaveOccurred())
+	serverPath, err = helper.BuildServerExecutable(buildDir)
+	Expect(err).NotTo(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	if buildDir != "" {
+		os.RemoveAll(buildDir)
+	}
+})
+
+func TestSystemd(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Systemd Suite")
+}
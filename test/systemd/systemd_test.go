@@ -0,0 +1,132 @@
+package systemd_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/systemd"
+	"github.com/Oyal2/tcp-server/pkg/model"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Systemd", func() {
+	var (
+		notifySocket string
+		notifyConn   *net.UnixConn
+		messages     chan string
+	)
+
+	BeforeEach(func() {
+		// A unix datagram socket stands in for systemd
+		notifySocket = filepath.Join(GinkgoT().TempDir(), "notify.sock")
+		var err error
+		notifyConn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifySocket, Net: "unixgram"})
+		Expect(err).NotTo(HaveOccurred())
+
+		// The next spec replaces notifyConn and messages before this goroutine is done with it
+		messages = make(chan string, 100)
+		go func(conn *net.UnixConn, messages chan string) {
+			defer close(messages)
+			buf := make([]byte, 4096)
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				messages <- string(buf[:n])
+			}
+		}(notifyConn, messages)
+	})
+
+	AfterEach(func() {
+		notifyConn.Close()
+	})
+
+	Context("Notifier", func() {
+		It("should send states to NOTIFY_SOCKET and remove it from the environment", func() {
+			GinkgoT().Setenv("NOTIFY_SOCKET", notifySocket)
+			GinkgoT().Setenv("WATCHDOG_USEC", "100000")
+
+			notifier := systemd.NewNotifierFromEnv()
+			Expect(notifier.Enabled()).To(BeTrue())
+			Expect(os.Getenv("NOTIFY_SOCKET")).To(BeEmpty())
+			Expect(notifier.WatchdogInterval()).To(Equal(100 * time.Millisecond))
+			Expect(notifier.Env()).To(ConsistOf("NOTIFY_SOCKET="+notifySocket, "WATCHDOG_USEC=100000"))
+
+			Expect(notifier.Notify(systemd.Ready, systemd.Status("up"))).To(Succeed())
+			Eventually(messages).Should(Receive(Equal("READY=1\nSTATUS=up")))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go notifier.RunWatchdog(ctx, nil)
+			Eventually(messages).Should(Receive(Equal(systemd.Watchdog)))
+		})
+
+		It("should ignore a watchdog meant for another process", func() {
+			GinkgoT().Setenv("NOTIFY_SOCKET", notifySocket)
+			GinkgoT().Setenv("WATCHDOG_USEC", "100000")
+			GinkgoT().Setenv("WATCHDOG_PID", "1")
+
+			Expect(systemd.NewNotifierFromEnv().WatchdogInterval()).To(BeZero())
+		})
+
+		It("should do nothing without NOTIFY_SOCKET", func() {
+			GinkgoT().Setenv("NOTIFY_SOCKET", "")
+
+			notifier := systemd.NewNotifierFromEnv()
+			Expect(notifier.Enabled()).To(BeFalse())
+			Expect(notifier.Notify(systemd.Ready)).To(Succeed())
+		})
+	})
+
+	Context("Socket activation", func() {
+		It("should serve on the socket passed in by systemd and report its state", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+			f, err := l.(*net.TCPListener).File()
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+
+			// systemd sets LISTEN_PID to the pid of the service, exec keeps the shell's pid
+			cmd := exec.Command("sh", "-c", `LISTEN_PID=$$ exec "$0" "$@"`, serverPath,
+				"-listen", "tcp://127.0.0.1:1", "-rate-limit.type", "none", "-executor.allow-root=true")
+			cmd.ExtraFiles = []*os.File{f}
+			cmd.Env = append(os.Environ(),
+				"LISTEN_FDS=1",
+				"LISTEN_FDNAMES=tasks",
+				"NOTIFY_SOCKET="+notifySocket,
+				"WATCHDOG_USEC=200000",
+			)
+			cmd.Stdout = GinkgoWriter
+			cmd.Stderr = GinkgoWriter
+			Expect(cmd.Start()).To(Succeed())
+			defer cmd.Process.Kill()
+
+			Eventually(messages, 10*time.Second).Should(Receive(HavePrefix(systemd.Ready)))
+			Eventually(messages).Should(Receive(Equal(systemd.Watchdog)))
+
+			// The listen config is replaced by the activated socket
+			conn, err := net.Dial("tcp", l.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte(`{"command":["echo","activated"]}` + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			var response model.TaskResult
+			Expect(json.NewDecoder(conn).Decode(&response)).To(Succeed())
+			Expect(string(response.Output)).To(Equal("activated\n"))
+
+			Expect(cmd.Process.Signal(syscall.SIGTERM)).To(Succeed())
+			Eventually(messages, 5*time.Second).Should(Receive(Equal(systemd.Stopping)))
+			Expect(cmd.Wait()).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,45 @@
+package tcpctl_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Oyal2/tcp-server/test/helper"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var (
+	printerPath string
+	ctlPath     string
+	buildDir    string
+)
+
+var _ = BeforeSuite(func() {
+	var err error
+	printerPath, err = helper.BuildPrinterExecutable()
+	Expect(err).NotTo(HaveOccurred())
+
+	buildDir, err = os.MkdirTemp("", "tcpctl")
+	Expect(err).NotTo(HaveOccurred())
+	ctlPath, err = helper.BuildCtlExecutable(buildDir)
+	Expect(err).NotTo(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	if printerPath != "" {
+		err := os.Remove(printerPath)
+		if err != nil {
+			GinkgoWriter.Printf("Failed to remove printer executable: %v\n", err)
+		}
+	}
+	if buildDir != "" {
+		os.RemoveAll(buildDir)
+	}
+})
+
+func TestTcpctl(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tcpctl Suite")
+}
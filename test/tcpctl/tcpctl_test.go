@@ -0,0 +1,164 @@
+package tcpctl_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/pkg/ratelimit"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const token = "secret"
+
+var _ = Describe("tcpctl", func() {
+	var (
+		s   *server.TCPServer
+		env []string
+	)
+
+	// tcpctl runs the binary and returns its stdout, stderr and exit code
+	tcpctl := func(args ...string) (string, string, int) {
+		cmd := exec.Command(ctlPath, args...)
+		cmd.Env = env
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+	}
+
+	BeforeEach(func() {
+		var err error
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			Address:      "127.0.0.1:0",
+			Executor:     executor.NewCommandExecutorWithParams(executor.CommandExecutorParams{AllowRoot: true}),
+			WaitGroup:    &sync.WaitGroup{},
+			ReadTimeout:  3 * time.Second,
+			WriteTimeout: 3 * time.Second,
+			RateLimiter:  ratelimit.NewNoopRateLimiter(),
+			Tokens:       []string{token},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+
+		// Keep the user's own config out of the way
+		env = []string{
+			"HOME=" + GinkgoT().TempDir(),
+			"XDG_CONFIG_HOME=" + GinkgoT().TempDir(),
+			"TCPCTL_ADDRESS=tcp://" + s.Addr().String(),
+			"TCPCTL_TOKEN=" + token,
+		}
+	})
+
+	AfterEach(func() {
+		s.Stop()
+	})
+
+	It("should print the output live and exit with the task's exit code", func() {
+		stdout, stderr, code := tcpctl("run", "--", "sh", "-c", "echo out; echo err >&2; exit 3")
+		Expect(stdout).To(Equal("out\n"))
+		Expect(stderr).To(Equal("err\n"))
+		Expect(code).To(Equal(3))
+
+		stdout, _, code = tcpctl("run", "--", printerPath, "-message=fine")
+		Expect(stdout).To(Equal("fine\n"))
+		Expect(code).To(Equal(0))
+	})
+
+	It("should exit with 124 when the task times out", func() {
+		_, stderr, code := tcpctl("run", "--timeout", "50ms", "--", printerPath, "-sleep=1000")
+		Expect(stderr).To(ContainSubstring("timed out"))
+		Expect(code).To(Equal(124))
+	})
+
+	It("should kill the task on the server when interrupted", func() {
+		cmd := exec.Command(ctlPath, "run", "--", printerPath, "-sleep=10000")
+		cmd.Env = env
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		Expect(cmd.Start()).To(Succeed())
+		Eventually(s.Tasks, 3*time.Second).Should(HaveLen(1))
+
+		Expect(cmd.Process.Signal(os.Interrupt)).To(Succeed())
+		err := cmd.Wait()
+		var exitErr *exec.ExitError
+		Expect(errors.As(err, &exitErr)).To(BeTrue())
+		Expect(exitErr.ExitCode()).To(Equal(130))
+		Expect(stderr.String()).To(ContainSubstring("killed"))
+		Eventually(s.Tasks).Should(BeEmpty())
+	})
+
+	It("should print the result as JSON", func() {
+		stdout, _, code := tcpctl("run", "--json", "--", printerPath, "-message=json")
+		Expect(code).To(Equal(0))
+		var result model.TaskResult
+		Expect(json.Unmarshal([]byte(stdout), &result)).To(Succeed())
+		Expect(string(result.Output)).To(Equal("json\n"))
+		Expect(result.Command).To(Equal([]string{printerPath, "-message=json"}))
+	})
+
+	It("should read the address and token from a config file", func() {
+		configPath := filepath.Join(GinkgoT().TempDir(), "tcpctl.yaml")
+		config := "address: tcp://" + s.Addr().String() + "\ntoken: " + token + "\n"
+		Expect(os.WriteFile(configPath, []byte(config), 0o600)).To(Succeed())
+		env = env[:2]
+
+		_, stderr, code := tcpctl("run", "--", printerPath)
+		Expect(stderr).NotTo(BeEmpty())
+		Expect(code).To(Equal(125))
+
+		stdout, _, code := tcpctl("run", "--config", configPath, "--", printerPath, "-message=configured")
+		Expect(stdout).To(Equal("configured\n"))
+		Expect(code).To(Equal(0))
+
+		// A flag wins over the file
+		_, stderr, code = tcpctl("run", "--config", configPath, "--token", "wrong", "--", printerPath)
+		Expect(stderr).To(ContainSubstring("token"))
+		Expect(code).To(Equal(125))
+	})
+
+	It("should manage jobs", func() {
+		stdout, _, code := tcpctl("submit", "--", printerPath, "-message=background", "-sleep=200")
+		Expect(code).To(Equal(0))
+		jobID := strings.TrimSpace(stdout)
+		Expect(jobID).NotTo(BeEmpty())
+
+		stdout, _, code = tcpctl("jobs")
+		Expect(code).To(Equal(0))
+		Expect(stdout).To(ContainSubstring(jobID))
+		Expect(stdout).To(ContainSubstring(model.JobRunning))
+
+		Eventually(func() string {
+			stdout, _, _ := tcpctl("status", jobID)
+			return stdout
+		}).Should(ContainSubstring("background\n"))
+
+		stdout, _, code = tcpctl("submit", "--json", "--", printerPath, "-sleep=10000")
+		Expect(code).To(Equal(0))
+		var job model.JobStatus
+		Expect(json.Unmarshal([]byte(stdout), &job)).To(Succeed())
+		_, _, code = tcpctl("cancel", job.JobID)
+		Expect(code).To(Equal(0))
+
+		_, stderr, code := tcpctl("status", "unknown")
+		Expect(stderr).To(ContainSubstring("job not found"))
+		Expect(code).To(Equal(1))
+	})
+})
@@ -0,0 +1,156 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Oyal2/tcp-server/internal/server"
+	"github.com/Oyal2/tcp-server/internal/tracing"
+	"github.com/Oyal2/tcp-server/pkg/executor"
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	remoteTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	remoteSpanID  = "00f067aa0ba902b7"
+)
+
+// findSpan returns the first ended span with the given name
+func findSpan(recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func attribute(span sdktrace.ReadOnlySpan, key string) any {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.AsInterface()
+		}
+	}
+	return nil
+}
+
+var _ = Describe("Tracing", func() {
+	var (
+		s        *server.TCPServer
+		recorder *tracetest.SpanRecorder
+	)
+
+	run := func(request model.TaskRequest) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		Expect(json.NewEncoder(conn).Encode(request)).To(Succeed())
+
+		var result model.TaskResult
+		Expect(json.NewDecoder(conn).Decode(&result)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		recorder = tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		otel.SetTracerProvider(provider)
+		DeferCleanup(provider.Shutdown, context.Background())
+
+		var err error
+		s, err = server.NewTCPServer(server.TCPServerParams{
+			Listen:       []string{"tcp://127.0.0.1:0"},
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			Executor:     executor.NewCommandExecutorWithParams(executor.CommandExecutorParams{MaxConcurrent: 1, AllowRoot: true}),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go s.Start(context.Background())
+	})
+
+	AfterEach(func() {
+		s.Stop()
+	})
+
+	It("should trace the connection and the task", func() {
+		run(model.TaskRequest{Command: []string{"sh", "-c", "exit 3"}, Timeout: 1000})
+		Eventually(func() sdktrace.ReadOnlySpan { return findSpan(recorder, "connection") }).ShouldNot(BeNil())
+
+		connection := findSpan(recorder, "connection")
+		for _, name := range []string{"ratelimit", "parse", "task"} {
+			span := findSpan(recorder, name)
+			Expect(span).NotTo(BeNil(), name)
+			Expect(span.Parent().SpanID()).To(Equal(connection.SpanContext().SpanID()), name)
+		}
+
+		task := findSpan(recorder, "task")
+		Expect(attribute(task, "task.command")).To(Equal([]string{"sh", "-c", "exit 3"}))
+		Expect(attribute(task, "task.timeout_ms")).To(Equal(int64(1000)))
+		Expect(attribute(task, "task.exit_code")).To(Equal(int64(3)))
+
+		for _, name := range []string{"queue", "exec"} {
+			span := findSpan(recorder, name)
+			Expect(span).NotTo(BeNil(), name)
+			Expect(span.Parent().SpanID()).To(Equal(task.SpanContext().SpanID()), name)
+		}
+		Expect(attribute(findSpan(recorder, "exec"), "task.exit_code")).To(Equal(int64(3)))
+	})
+
+	It("should join the caller's trace when given a traceparent", func() {
+		run(model.TaskRequest{
+			Command:     []string{printerPath},
+			TraceParent: "00-" + remoteTraceID + "-" + remoteSpanID + "-01",
+		})
+		Eventually(func() sdktrace.ReadOnlySpan { return findSpan(recorder, "connection") }).ShouldNot(BeNil())
+
+		task := findSpan(recorder, "task")
+		Expect(task.SpanContext().TraceID().String()).To(Equal(remoteTraceID))
+		Expect(task.Parent().SpanID().String()).To(Equal(remoteSpanID))
+		Expect(task.Parent().IsRemote()).To(BeTrue())
+		// The task links back to the connection it came in on
+		Expect(task.Links()).To(HaveLen(1))
+		Expect(task.Links()[0].SpanContext.SpanID()).To(Equal(findSpan(recorder, "connection").SpanContext().SpanID()))
+
+		exec := findSpan(recorder, "exec")
+		Expect(exec.SpanContext().TraceID().String()).To(Equal(remoteTraceID))
+	})
+
+	It("should ignore an invalid traceparent", func() {
+		run(model.TaskRequest{Command: []string{printerPath}, TraceParent: "not-a-traceparent"})
+		Eventually(func() sdktrace.ReadOnlySpan { return findSpan(recorder, "connection") }).ShouldNot(BeNil())
+
+		task := findSpan(recorder, "task")
+		Expect(task.Parent().SpanID()).To(Equal(findSpan(recorder, "connection").SpanContext().SpanID()))
+	})
+})
+
+var _ = Describe("File exporter", func() {
+	It("should write spans as JSON lines", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "spans.jsonl")
+		exporter, err := tracing.NewFileExporter(path)
+		Expect(err).NotTo(HaveOccurred())
+		provider := tracing.NewProvider(exporter)
+
+		_, span := provider.Tracer("test").Start(context.Background(), "task")
+		span.End()
+		Expect(provider.Shutdown(context.Background())).To(Succeed())
+
+		b, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		var exported struct {
+			Name     string
+			Resource []struct{ Key string }
+		}
+		Expect(json.Unmarshal(b, &exported)).To(Succeed())
+		Expect(exported.Name).To(Equal("task"))
+	})
+})
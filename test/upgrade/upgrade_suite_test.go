@@ -0,0 +1,45 @@
+package upgrade_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Oyal2/tcp-server/test/helper"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var (
+	printerPath string
+	serverPath  string
+	buildDir    string
+)
+
+var _ = BeforeSuite(func() {
+	var err error
+	printerPath, err = helper.BuildPrinterExecutable()
+	Expect(err).NotTo(HaveOccurred())
+
+	buildDir, err = os.MkdirTemp("", "tcp-server-upgrade")
+	Expect(err).NotTo(HaveOccurred())
+	serverPath, err = helper.BuildServerExecutable(buildDir)
+	Expect(err).NotTo(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	if printerPath != "" {
+		err := os.Remove(printerPath)
+		if err != nil {
+			GinkgoWriter.Printf("Failed to remove printer executable: %v\n", err)
+		}
+	}
+	if buildDir != "" {
+		os.RemoveAll(buildDir)
+	}
+})
+
+func TestUpgrade(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Upgrade Suite")
+}
@@ -0,0 +1,112 @@
+package upgrade_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Oyal2/tcp-server/pkg/model"
+	"github.com/Oyal2/tcp-server/test/helper"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upgrade", func() {
+	var (
+		cmd     *exec.Cmd
+		logPath string
+		address string
+		exited  chan error
+	)
+
+	send := func(conn net.Conn, request model.TaskRequest) {
+		b, err := json.Marshal(request)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = conn.Write(append(b, '\n'))
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		port, err := helper.FreePort()
+		Expect(err).NotTo(HaveOccurred())
+		address = fmt.Sprintf("127.0.0.1:%d", port)
+
+		// Log to a file, the new process inherits it and keeps writing after the old one exits
+		logPath = filepath.Join(GinkgoT().TempDir(), "server.log")
+		logFile, err := os.Create(logPath)
+		Expect(err).NotTo(HaveOccurred())
+		defer logFile.Close()
+
+		cmd = exec.Command(serverPath, "-listen", "tcp://"+address, "-rate-limit.type", "none", "-executor.allow-root=true")
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		Expect(cmd.Start()).To(Succeed())
+		exited = make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		_ = cmd.Process.Kill()
+	})
+
+	It("should hand the listener to a new process on SIGUSR2 and drain the old one", func() {
+		// Start a task on the old process that is still running during the upgrade
+		inflight, err := net.Dial("tcp", address)
+		Expect(err).NotTo(HaveOccurred())
+		defer inflight.Close()
+		send(inflight, model.TaskRequest{Command: []string{printerPath, "-message=old", "-sleep=1000"}})
+		time.Sleep(100 * time.Millisecond)
+
+		Expect(cmd.Process.Signal(syscall.SIGUSR2)).To(Succeed())
+		// Find the new process so we can stop it at the end
+		var match [][]byte
+		Eventually(func() [][]byte {
+			logs, _ := os.ReadFile(logPath)
+			match = regexp.MustCompile(`new process is accepting connections.*pid=(\d+)`).FindSubmatch(logs)
+			return match
+		}, 10*time.Second).ShouldNot(BeNil())
+		pid, err := strconv.Atoi(string(match[1]))
+		Expect(err).NotTo(HaveOccurred())
+		defer syscall.Kill(pid, syscall.SIGKILL)
+		Expect(pid).NotTo(Equal(cmd.Process.Pid))
+
+		// New connections are served by the new process on the same address
+		conn, err := net.Dial("tcp", address)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		send(conn, model.TaskRequest{Command: []string{printerPath, "-message=new"}})
+		var response model.TaskResult
+		Expect(json.NewDecoder(conn).Decode(&response)).To(Succeed())
+		Expect(string(response.Output)).To(Equal("new\n"))
+
+		// The old process finishes its task and exits
+		Expect(json.NewDecoder(inflight).Decode(&response)).To(Succeed())
+		Expect(string(response.Output)).To(Equal("old\n"))
+		Eventually(exited, 5*time.Second).Should(Receive(BeNil()))
+
+		// The new process keeps serving after the old one is gone
+		Expect(syscall.Kill(pid, 0)).To(Succeed())
+		conn2, err := net.Dial("tcp", address)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn2.Close()
+		send(conn2, model.TaskRequest{Command: []string{printerPath, "-message=after"}})
+		Expect(json.NewDecoder(conn2).Decode(&response)).To(Succeed())
+		Expect(string(response.Output)).To(Equal("after\n"))
+	})
+})